@@ -20478,6 +20478,21 @@ class Dashboard extends applyMixins(
             case "reset":
                 setTimeout(() => this.notify($l("Successfully reset data!"), "info", 3000), 500);
                 break;
+            case "deletion-requested":
+                setTimeout(() => this.notify($l("Check your email to confirm the deletion!"), "info", 3000), 500);
+                break;
+            case "deletion-scheduled":
+                setTimeout(() => this.notify($l("Deletion scheduled. Check your email for a link to undo it!"), "info", 3000), 500);
+                break;
+            case "totp-enabled":
+                setTimeout(() => this.notify($l("Two-factor authentication enabled successfully!"), "info", 3000), 500);
+                break;
+            case "totp-disabled":
+                setTimeout(() => this.notify($l("Two-factor authentication disabled."), "info", 3000), 500);
+                break;
+            case "deletion-undone":
+                setTimeout(() => this.notify($l("Deletion canceled successfully!"), "info", 3000), 500);
+                break;
             case "subscribed":
                 setTimeout(() => this.notify($l("Subscription added successfully!"), "info", 3000), 500);
                 break;
@@ -20622,6 +20637,21 @@ class Dashboard extends applyMixins(
         return !this.account.devices.length;
     }
 
+    _isDefaultVault(name) {
+        return name === "default";
+    }
+
+    _totpPending(totp) {
+        return !!totp && !totp.enabled;
+    }
+
+    _deletionMessage(deletion) {
+        const date = new Date(deletion.purge).toLocaleString();
+        return deletion.vault ?
+            $l("The vault \"{0}\" will be deleted on {1}. Until then, you can still undo the deletion.", deletion.vault, date) :
+            $l("Your account will be deleted on {0}. Until then, you can still undo the deletion.", date);
+    }
+
     _downloadApp() {
         window.open("https://padlock.io/downloads/", "_blank");
     }
@@ -20670,8 +20700,10 @@ class Dashboard extends applyMixins(
                 )
                     .then(() => {
                         this.$.deleteAccountButton.success();
-                        this.alert("Account deleted successfully. Sorry to see you go!", { type: "success" })
-                            .then(() => window.close());
+                        this.alert($l(
+                            "We've sent an email to {0}. Please open the link in this email to confirm " +
+                            "the deletion of your account.", this.account.email
+                        ), { type: "success" });
                     })
                     .catch((e) => {
                         this.$.deleteAccountButton.fail();
@@ -8,13 +8,16 @@ require (
 	github.com/gorilla/csrf v1.6.2
 	github.com/gorilla/securecookie v1.1.2-0.20191028042304-61b4ad17eb88
 	github.com/hashicorp/golang-lru v0.5.3
-	github.com/pkg/errors v0.8.2-0.20200103123654-004deef56200
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/common v0.26.0
 	github.com/rs/cors v1.7.1-0.20191212210812-fdcf4f9773b8
 	github.com/rs/xhandler v0.0.0-20170707052532-1eb70cf1520d
 	github.com/syndtr/goleveldb v1.0.1-0.20190923125748-758128399b1d
-	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
 	gopkg.in/throttled/throttled.v2 v2.2.4
 	gopkg.in/tylerb/graceful.v1 v1.2.15
 	gopkg.in/urfave/cli.v1 v1.20.0
-	gopkg.in/yaml.v2 v2.2.7
+	gopkg.in/yaml.v2 v2.3.0
 )
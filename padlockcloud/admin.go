@@ -0,0 +1,110 @@
+package padlockcloud
+
+import "io"
+import "fmt"
+import "errors"
+import "strconv"
+import "strings"
+import "net/http"
+import "crypto/subtle"
+
+// Trailers sent along with a backup streamed from the admin interface, since the number of records
+// and any errors are only known once the archive has been written
+const (
+	backupCountTrailer = "X-Backup-Records"
+	backupErrorTrailer = "X-Backup-Error"
+)
+
+// Settings for the admin interface, which is served separately from the main server and allows
+// creating backups of a running instance and, if enabled, exporting metrics
+type AdminConfig struct {
+	// Address to serve the admin interface on, e.g. "127.0.0.1:3001". The admin interface is disabled
+	// if empty
+	Addr string `yaml:"addr"`
+	// Token that needs to be provided in the `Authorization` header of all requests to the admin
+	// interface, as in "Authorization: Bearer {token}"
+	Token string `yaml:"token"`
+}
+
+// Returns the handler for the admin interface. All requests are rejected unless they carry the
+// configured admin token
+func (server *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backup", server.serveBackup)
+	if server.Metrics != nil {
+		mux.Handle("/metrics", server.Metrics)
+	}
+
+	token := server.Config.Admin.Token
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Streams a backup of the storage as written by `WriteBackup`. The number of records written and any
+// error occurring after the response was started are reported in the response trailers
+func (server *Server) serveBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Trailer", backupCountTrailer+", "+backupErrorTrailer)
+
+	count, err := WriteBackup(w, server.Storage)
+	w.Header().Set(backupCountTrailer, strconv.Itoa(count))
+	if err != nil {
+		server.Error.Printf("%s - backup:write - %v\n", FormatRequest(r), err)
+		w.Header().Set(backupErrorTrailer, err.Error())
+		return
+	}
+
+	server.Info.Printf("%s - backup:write - %d records\n", FormatRequest(r), count)
+}
+
+// Fetches a backup from the admin interface of a running server at `addr` and writes it to `w`.
+// Returns the number of records written
+func FetchBackup(w io.Writer, addr string, token string) (int, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/backup", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Failed to fetch backup from %s: %s", addr, res.Status)
+	}
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return 0, err
+	}
+
+	// Trailers are only available once the body has been read completely
+	if msg := res.Trailer.Get(backupErrorTrailer); msg != "" {
+		return 0, errors.New(msg)
+	}
+
+	count, err := strconv.Atoi(res.Trailer.Get(backupCountTrailer))
+	if err != nil {
+		return 0, errors.New("Backup response is incomplete")
+	}
+
+	return count, nil
+}
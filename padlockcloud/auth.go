@@ -1,7 +1,6 @@
 package padlockcloud
 
 import "time"
-import "encoding/json"
 import "encoding/base64"
 import "net/http"
 import "regexp"
@@ -173,6 +172,11 @@ type Account struct {
 	// A set of api keys that can be used to access the data associated with this
 	// account
 	AuthTokens []*AuthToken
+	// Maximum size of the data store in bytes, overriding the server default. A value of 0 means the
+	// server default applies, a negative value means there is no limit
+	MaxStoreSize int64
+	// Settings for two-factor authentication. Nil if the account owner never enrolled
+	TOTP *TOTP `yaml:"totp,omitempty"`
 }
 
 // Implements the `Key` method of the `Storable` interface
@@ -182,7 +186,7 @@ func (acc *Account) Key() []byte {
 
 // Implementation of the `Storable.Deserialize` method
 func (acc *Account) Deserialize(data []byte) error {
-	return json.Unmarshal(data, acc)
+	return unmarshalVersioned(acc, data, acc)
 }
 
 // Implementation of the `Storable.Serialize` method
@@ -190,7 +194,7 @@ func (acc *Account) Serialize() ([]byte, error) {
 	if acc.Created.IsZero() {
 		acc.Created = time.Now()
 	}
-	return json.Marshal(acc)
+	return marshalVersioned(acc, acc)
 }
 
 // Adds an api key to this account. If an api key for the given device
@@ -303,6 +307,11 @@ func (a *Account) ToMap() map[string]interface{} {
 	}
 
 	obj["devices"] = devices
+
+	if a.TOTP != nil {
+		obj["totp"] = a.TOTP.ToMap()
+	}
+
 	return obj
 }
 
@@ -314,6 +323,11 @@ type AuthRequest struct {
 	AuthToken *AuthToken
 	Created   time.Time
 	Redirect  string
+	// Key of a shared vault. If set, activating the request also accepts the invite to that vault
+	SharedVault string
+	// If true, activating the request confirms the deletion of the account instead of activating
+	// the auth token
+	DeleteAccount bool
 }
 
 // Implementation of the `Storable.Key` interface method
@@ -327,12 +341,12 @@ func (ar *AuthRequest) Key() []byte {
 
 // Implementation of the `Storable.Deserialize` method
 func (ar *AuthRequest) Deserialize(data []byte) error {
-	return json.Unmarshal(data, ar)
+	return unmarshalVersioned(ar, data, ar)
 }
 
 // Implementation of the `Storable.Serialize` method
 func (ar *AuthRequest) Serialize() ([]byte, error) {
-	return json.Marshal(ar)
+	return marshalVersioned(ar, ar)
 }
 
 // Creates a new `AuthRequest` with a given `email`
@@ -367,4 +381,6 @@ func NewAuthRequest(email string, tType string, actType string, device *Device)
 func init() {
 	RegisterStorable(&Account{}, "auth-accounts")
 	RegisterStorable(&AuthRequest{}, "auth-requests")
+	RegisterSchema(&Account{})
+	RegisterSchema(&AuthRequest{})
 }
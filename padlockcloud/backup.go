@@ -0,0 +1,286 @@
+package padlockcloud
+
+import "io"
+import "os"
+import "fmt"
+import "time"
+import "sort"
+import "bufio"
+import "strings"
+import "path/filepath"
+import "io/ioutil"
+import "compress/gzip"
+import "encoding/json"
+
+// Version of the backup archive format
+const backupVersion = 1
+
+// Prefix and suffix of archive file names created by scheduled backups
+const (
+	backupFilePrefix = "padlock-backup-"
+	backupFileSuffix = ".jsonl.gz"
+)
+
+// Configuration for scheduled backups
+type BackupConfig struct {
+	// Directory to write backup archives to. Scheduled backups are disabled if empty
+	Dir string `yaml:"dir"`
+	// Time between backups
+	Interval time.Duration `yaml:"interval"`
+	// Number of archives to keep. A value of 0 means all archives are kept
+	Keep int `yaml:"keep"`
+}
+
+// A consistent, read-only view of a storage at a given point in time
+type StorageSnapshot interface {
+	// Returns an iterator over all records of the type of the given `Storable`
+	Iterator(Storable) (StorageIterator, error)
+	// Releases all resources associated with the snapshot
+	Release()
+}
+
+// Implemented by storages that support taking snapshots
+type SnapshotStorage interface {
+	Snapshot() (StorageSnapshot, error)
+}
+
+// First line of a backup archive
+type backupHeader struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// A single record within a backup archive
+type backupRecord struct {
+	Type string `json:"type"`
+	Key  []byte `json:"key"`
+	Data []byte `json:"data"`
+}
+
+// Returns the storage records are ultimately written to, bypassing decorators like `EncryptedStorage`
+func backendStorage(s Storage) Storage {
+	if d, ok := s.(interface {
+		backend() Storage
+	}); ok {
+		return backendStorage(d.backend())
+	}
+	return s
+}
+
+// Returns a storage along with all storages it decorates, outermost first
+func storageChain(s Storage) []Storage {
+	chain := []Storage{s}
+	for {
+		d, ok := s.(interface {
+			backend() Storage
+		})
+		if !ok {
+			return chain
+		}
+		s = d.backend()
+		chain = append(chain, s)
+	}
+}
+
+// Writes all records of all registered `Storable` types to `w` as gzip-compressed JSON lines.
+// Records are written as stored, so records of an encrypted storage remain encrypted. If the
+// storage supports snapshots, the backup reflects a consistent state even while the storage
+// is being written to. Otherwise, records are read as they are being written. Returns the number
+// of records written
+func WriteBackup(w io.Writer, storage Storage) (int, error) {
+	storage = backendStorage(storage)
+
+	var source interface {
+		Iterator(Storable) (StorageIterator, error)
+	} = storage
+
+	if s, ok := storage.(SnapshotStorage); ok {
+		snapshot, err := s.Snapshot()
+		if err == nil {
+			defer snapshot.Release()
+			source = snapshot
+		} else if err != ErrSnapshotUnsupported {
+			return 0, err
+		}
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	if err := enc.Encode(&backupHeader{backupVersion, time.Now()}); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, typ := range sortedStorableTypes() {
+		iter, err := source.Iterator(&rawStorable{typ: typ})
+		if err != nil {
+			return count, err
+		}
+
+		for iter.Next() {
+			raw := &rawStorable{typ: typ}
+			if err := iter.Get(raw); err == nil {
+				err = enc.Encode(&backupRecord{StorableTypes[typ], iter.Key(), raw.data})
+			}
+			if err != nil {
+				iter.Release()
+				return count, err
+			}
+			count++
+		}
+
+		err = iter.Error()
+		iter.Release()
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, gz.Close()
+}
+
+// Reads a backup archive created by `WriteBackup` and writes all records contained in it to
+// `storage`, overwriting existing records with the same keys. Returns the number of records restored
+func RestoreBackup(r io.Reader, storage Storage) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(gz))
+
+	header := &backupHeader{}
+	if err := dec.Decode(header); err != nil {
+		return 0, err
+	}
+	if header.Version != backupVersion {
+		return 0, fmt.Errorf("Unsupported backup version: %d", header.Version)
+	}
+
+	storage = backendStorage(storage)
+
+	types := make(map[string]*rawStorable)
+	for typ, loc := range StorableTypes {
+		types[loc] = &rawStorable{typ: typ}
+	}
+
+	count := 0
+	for {
+		rec := &backupRecord{}
+		if err := dec.Decode(rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return count, err
+		}
+
+		t := types[rec.Type]
+		if t == nil {
+			return count, fmt.Errorf("Unsupported record type in backup: %s", rec.Type)
+		}
+
+		if err := storage.Put(&rawStorable{t.typ, rec.Key, rec.Data}); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Writes a backup to the given path. The archive is written to a temporary file first
+// so that incomplete backups never show up under the given path
+func WriteBackupFile(path string, storage Storage) (int, error) {
+	return writeBackupFile(path, func(w io.Writer) (int, error) {
+		return WriteBackup(w, storage)
+	})
+}
+
+// Fetches a backup from the admin interface of a running server (see `FetchBackup`) and writes
+// it to the given path
+func FetchBackupFile(path string, addr string, token string) (int, error) {
+	return writeBackupFile(path, func(w io.Writer) (int, error) {
+		return FetchBackup(w, addr, token)
+	})
+}
+
+func writeBackupFile(path string, write func(io.Writer) (int, error)) (int, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".backup-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	count, err := write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return count, err
+	}
+
+	return count, os.Rename(f.Name(), path)
+}
+
+// Restores a backup from the given path
+func RestoreBackupFile(path string, storage Storage) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return RestoreBackup(f, storage)
+}
+
+// Writes a new backup archive to the configured directory and removes old archives exceeding
+// the configured number of archives to keep. Returns the path of the new archive
+func RunScheduledBackup(storage Storage, config *BackupConfig) (string, int, error) {
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return "", 0, err
+	}
+
+	path := filepath.Join(config.Dir, backupFilePrefix+time.Now().UTC().Format("20060102T150405.000")+backupFileSuffix)
+
+	count, err := WriteBackupFile(path, storage)
+	if err != nil {
+		return "", count, err
+	}
+
+	return path, count, rotateBackups(config.Dir, config.Keep)
+}
+
+// Removes the oldest backup archives in `dir`, keeping the `keep` most recent ones
+func rotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var archives []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), backupFilePrefix) && strings.HasSuffix(f.Name(), backupFileSuffix) {
+			archives = append(archives, f.Name())
+		}
+	}
+
+	// Archive names contain their creation time so sorting them puts the oldest ones first
+	sort.Strings(archives)
+
+	for len(archives) > keep {
+		if err := os.Remove(filepath.Join(dir, archives[0])); err != nil {
+			return err
+		}
+		archives = archives[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package padlockcloud
+
+import "testing"
+import "io/ioutil"
+import "os"
+import "fmt"
+import "bytes"
+import "time"
+import "path/filepath"
+import "net/http/httptest"
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "db")}}
+	if err := from.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+
+	acc := &Account{Email: "martin@padlock.io"}
+	if err := from.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Put(&DataStore{Account: acc, Content: []byte("some data")}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := from.Put(&testKeyedStrbl{fmt.Sprintf("key%03d", i), "value"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	count, err := WriteBackup(&buf, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 12 {
+		t.Fatalf("Expected 12 records to be backed up, got %d", count)
+	}
+
+	to := &BoltStorage{Config: &BoltConfig{Path: filepath.Join(dir, "padlock.db")}}
+	if err := to.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	if count, err := RestoreBackup(&buf, to); err != nil || count != 12 {
+		t.Fatalf("Expected 12 records to be restored, got %d (%v)", count, err)
+	}
+
+	if err := (&StorageMigration{From: from, To: to}).Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RestoreBackup(bytes.NewBufferString("not a backup"), to); err == nil {
+		t.Fatal("Expected error for invalid archive")
+	}
+}
+
+func testSnapshot(t *testing.T, storage Storage) {
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := storage.Put(&testKeyedStrbl{"before", "value"}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := storage.(SnapshotStorage).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made after taking the snapshot should not be visible. Writes may have to wait for
+	// the snapshot to be released, depending on the storage
+	done := make(chan error)
+	go func() {
+		if err := storage.Put(&testKeyedStrbl{"after", "value"}); err != nil {
+			done <- err
+			return
+		}
+		done <- storage.Delete(&testKeyedStrbl{Name: "before"})
+	}()
+
+	iter, err := snapshot.Iterator(&testKeyedStrbl{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter.Seek([]byte("b"))
+
+	var keys []string
+	for iter.Next() {
+		s := &testKeyedStrbl{}
+		if err := iter.Get(s); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Release()
+	snapshot.Release()
+
+	if len(keys) != 1 || keys[0] != "before" {
+		t.Fatalf("Expected snapshot to only contain 'before', got %v", keys)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Get(&testKeyedStrbl{Name: "after"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLevelDBSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testSnapshot(t, &LevelDBStorage{Config: &LevelDBConfig{Path: dir}})
+}
+
+func TestBoltSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testSnapshot(t, &BoltStorage{Config: &BoltConfig{Path: filepath.Join(dir, "padlock.db")}})
+}
+
+func TestBackupEncryptedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &EncryptionConfig{
+		KeyId: "key1",
+		Keys:  map[string]string{"key1": newTestEncryptionKey()},
+	}
+
+	from := &EncryptedStorage{
+		Storage: &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "db")}},
+		Config:  config,
+	}
+	if err := from.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+
+	if err := from.Put(&testKeyedStrbl{"key", "secret value"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := WriteBackup(&buf, from); err != nil {
+		t.Fatal(err)
+	}
+
+	to := &EncryptedStorage{
+		Storage: &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "db2")}},
+		Config:  config,
+	}
+	if err := to.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	if _, err := RestoreBackup(&buf, to); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored records should still be encrypted
+	raw := &rawStorable{typ: typeFromStorable(&testKeyedStrbl{}), key: []byte("key")}
+	if err := to.Storage.Get(raw); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := encryptionKeyId(raw.data); id != "key1" {
+		t.Fatalf("Expected restored record to be encrypted with key1, got '%s'", id)
+	}
+
+	s := &testKeyedStrbl{Name: "key"}
+	if err := to.Get(s); err != nil || s.Value != "secret value" {
+		t.Fatalf("Expected 'secret value', got '%s' (%v)", s.Value, err)
+	}
+}
+
+func TestScheduledBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "db")}}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := storage.Put(&Account{Email: "martin@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &BackupConfig{Dir: filepath.Join(dir, "backups"), Keep: 2}
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path, _, err := RunScheduledBackup(storage, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	files, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 backups to be kept, got %d", len(files))
+	}
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Fatal("Expected oldest backup to be removed")
+	}
+
+	restored := &BoltStorage{Config: &BoltConfig{Path: filepath.Join(dir, "padlock.db")}}
+	if err := restored.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if _, err := RestoreBackupFile(paths[2], restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Get(&Account{Email: "martin@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnlineBackup(t *testing.T) {
+	ctx := newServerTestContextWithConfig(&ServerConfig{Admin: AdminConfig{Addr: "127.0.0.1:0", Token: "secret"}})
+
+	acc := &Account{Email: "martin@padlock.io"}
+	if err := ctx.storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.storage.Put(&DataStore{Account: acc, Content: []byte("some data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := httptest.NewServer(ctx.server.AdminHandler())
+	defer admin.Close()
+
+	var buf bytes.Buffer
+	if _, err := FetchBackup(&buf, admin.URL, "wrong"); err == nil {
+		t.Fatal("Requests without the admin token should be rejected")
+	}
+
+	count, err := FetchBackup(&buf, admin.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 records to be backed up, got %d", count)
+	}
+
+	to := &MemoryStorage{}
+	to.Open()
+	if n, err := RestoreBackup(&buf, to); err != nil || n != count {
+		t.Fatalf("Expected %d records to be restored, got %d (%v)", count, n, err)
+	}
+
+	if err := to.Get(&DataStore{Account: acc}); err != nil {
+		t.Fatal(err)
+	}
+}
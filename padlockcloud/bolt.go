@@ -0,0 +1,402 @@
+package padlockcloud
+
+import "os"
+import "time"
+import "path/filepath"
+import bolt "go.etcd.io/bbolt"
+
+// Number of records loaded into memory at once while iterating over a bucket
+const boltIteratorBatchSize = 100
+
+type BoltConfig struct {
+	// Path to database file
+	Path string `yaml:"path"`
+}
+
+// BoltDB implementation of the `Storage` interface. All `Storable` types are kept in a single database
+// file, using a separate bucket for each type
+type BoltStorage struct {
+	Config *BoltConfig
+	db     *bolt.DB
+}
+
+// Implementation of the `Storage.Open` interface method
+func (s *BoltStorage) Open() error {
+	if dir := filepath.Dir(s.Config.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	db, err := bolt.Open(s.Config.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	// Create bucket for each supported `Storable` type
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, loc := range StorableTypes {
+			if _, err := tx.CreateBucketIfNotExists([]byte(loc)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return err
+	}
+
+	s.db = db
+
+	return nil
+}
+
+// Implementation of the `Storage.Close` interface method
+func (s *BoltStorage) Close() error {
+	if s.db == nil {
+		return nil
+	}
+
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+func (s *BoltStorage) Ready() bool {
+	return s.db != nil
+}
+
+func (s *BoltStorage) CanStore(t Storable) bool {
+	_, err := s.getBucketName(t)
+	return err == nil
+}
+
+// Get bucket name for a given type
+func (s *BoltStorage) getBucketName(t Storable) ([]byte, error) {
+	if t == nil {
+		return nil, ErrUnregisteredStorable
+	}
+
+	loc, ok := StorableTypes[typeFromStorable(t)]
+	if !ok {
+		return nil, ErrUnregisteredStorable
+	}
+
+	return []byte(loc), nil
+}
+
+// Implementation of the `Storage.Get` interface method
+func (s *BoltStorage) Get(t Storable) error {
+	if s.db == nil {
+		return ErrStorageClosed
+	}
+
+	name, err := s.getBucketName(t)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		// Values returned by bolt are only valid for the lifetime of the transaction
+		// so we need to copy them
+		if val := tx.Bucket(name).Get(t.Key()); val != nil {
+			data = append([]byte{}, val...)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if data == nil {
+		return ErrNotFound
+	}
+
+	return t.Deserialize(data)
+}
+
+// Implementation of the `Storage.Put` interface method
+func (s *BoltStorage) Put(t Storable) error {
+	if s.db == nil {
+		return ErrStorageClosed
+	}
+
+	name, err := s.getBucketName(t)
+	if err != nil {
+		return err
+	}
+
+	data, err := t.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).Put(t.Key(), data)
+	})
+}
+
+// Implementation of the `Storage.Delete` interface method
+func (s *BoltStorage) Delete(t Storable) error {
+	if s.db == nil {
+		return ErrStorageClosed
+	}
+
+	name, err := s.getBucketName(t)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).Delete(t.Key())
+	})
+}
+
+// Implementation of the `Storage.Iterator` interface method
+func (s *BoltStorage) Iterator(t Storable) (StorageIterator, error) {
+	if s.db == nil {
+		return nil, ErrStorageClosed
+	}
+
+	name, err := s.getBucketName(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltIterator{db: s.db, bucket: name, i: -1}, nil
+}
+
+// Implementation of the `Storage.Update` interface method
+func (s *BoltStorage) Update(fn func(StorageTx) error) error {
+	if s.db == nil {
+		return ErrStorageClosed
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{s, tx})
+	})
+}
+
+// Implementation of the `SnapshotStorage.Snapshot` interface method. The snapshot holds a read
+// transaction open until it is released, which may block the database file from growing
+func (s *BoltStorage) Snapshot() (StorageSnapshot, error) {
+	if s.db == nil {
+		return nil, ErrStorageClosed
+	}
+
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltSnapshot{s, tx}, nil
+}
+
+type boltSnapshot struct {
+	storage *BoltStorage
+	tx      *bolt.Tx
+}
+
+func (s *boltSnapshot) Iterator(t Storable) (StorageIterator, error) {
+	name, err := s.storage.getBucketName(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltCursorIterator{cursor: s.tx.Bucket(name).Cursor()}, nil
+}
+
+func (s *boltSnapshot) Release() {
+	s.tx.Rollback()
+}
+
+// Iterator over a bucket within a transaction
+type boltCursorIterator struct {
+	cursor  *bolt.Cursor
+	key     []byte
+	value   []byte
+	started bool
+	seek    []byte
+}
+
+func (iter *boltCursorIterator) Next() bool {
+	if iter.cursor == nil {
+		return false
+	}
+
+	if iter.seek != nil {
+		iter.key, iter.value = iter.cursor.Seek(iter.seek)
+		iter.seek = nil
+		iter.started = true
+	} else if !iter.started {
+		iter.key, iter.value = iter.cursor.First()
+		iter.started = true
+	} else {
+		iter.key, iter.value = iter.cursor.Next()
+	}
+
+	return iter.key != nil
+}
+
+func (iter *boltCursorIterator) Seek(key []byte) {
+	iter.seek = append([]byte{}, key...)
+}
+
+func (iter *boltCursorIterator) Key() []byte {
+	return iter.key
+}
+
+func (iter *boltCursorIterator) Get(t Storable) error {
+	return t.Deserialize(append([]byte{}, iter.value...))
+}
+
+func (iter *boltCursorIterator) Release() {
+	iter.cursor = nil
+}
+
+func (iter *boltCursorIterator) Error() error {
+	return nil
+}
+
+// Implementation of the `StorageTx` interface for `BoltStorage`
+type boltTx struct {
+	storage *BoltStorage
+	tx      *bolt.Tx
+}
+
+func (tx *boltTx) Get(t Storable) error {
+	name, err := tx.storage.getBucketName(t)
+	if err != nil {
+		return err
+	}
+
+	val := tx.tx.Bucket(name).Get(t.Key())
+	if val == nil {
+		return ErrNotFound
+	}
+
+	return t.Deserialize(append([]byte{}, val...))
+}
+
+func (tx *boltTx) Put(t Storable) error {
+	name, err := tx.storage.getBucketName(t)
+	if err != nil {
+		return err
+	}
+
+	data, err := t.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return tx.tx.Bucket(name).Put(t.Key(), data)
+}
+
+func (tx *boltTx) Delete(t Storable) error {
+	name, err := tx.storage.getBucketName(t)
+	if err != nil {
+		return err
+	}
+
+	return tx.tx.Bucket(name).Delete(t.Key())
+}
+
+// Iterator for a bolt bucket. Records are loaded in batches, each within its own short-lived
+// read transaction, so that the storage can safely be written to while iterating
+type BoltIterator struct {
+	db     *bolt.DB
+	bucket []byte
+	keys   [][]byte
+	values [][]byte
+	i      int
+	done   bool
+	err    error
+	// Key to start the next batch at, set after seeking
+	seek []byte
+}
+
+// Loads the next batch of records following the last key of the current batch
+func (iter *BoltIterator) loadBatch() error {
+	var last []byte
+	if len(iter.keys) > 0 {
+		last = iter.keys[len(iter.keys)-1]
+	}
+
+	seek := iter.seek
+	iter.seek = nil
+
+	iter.keys = nil
+	iter.values = nil
+	iter.i = 0
+
+	return iter.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(iter.bucket).Cursor()
+
+		var k, v []byte
+		if seek != nil {
+			k, v = c.Seek(seek)
+		} else if last == nil {
+			k, v = c.First()
+		} else if k, v = c.Seek(last); k != nil && string(k) == string(last) {
+			k, v = c.Next()
+		}
+
+		for ; k != nil && len(iter.keys) < boltIteratorBatchSize; k, v = c.Next() {
+			iter.keys = append(iter.keys, append([]byte{}, k...))
+			iter.values = append(iter.values, append([]byte{}, v...))
+		}
+
+		return nil
+	})
+}
+
+func (iter *BoltIterator) Next() bool {
+	if iter.done {
+		return false
+	}
+
+	if iter.i+1 < len(iter.keys) {
+		iter.i = iter.i + 1
+		return true
+	}
+
+	if iter.seek == nil && iter.i >= 0 && len(iter.keys) < boltIteratorBatchSize {
+		// The last batch was not full so there are no more records
+		iter.done = true
+		return false
+	}
+
+	if err := iter.loadBatch(); err != nil || len(iter.keys) == 0 {
+		iter.err = err
+		iter.done = true
+		return false
+	}
+
+	return true
+}
+
+func (iter *BoltIterator) Seek(key []byte) {
+	iter.seek = append([]byte{}, key...)
+	iter.keys = nil
+	iter.values = nil
+	iter.i = -1
+	iter.done = false
+}
+
+func (iter *BoltIterator) Key() []byte {
+	return iter.keys[iter.i]
+}
+
+func (iter *BoltIterator) Get(t Storable) error {
+	return t.Deserialize(iter.values[iter.i])
+}
+
+func (iter *BoltIterator) Release() {
+	iter.keys = nil
+	iter.values = nil
+	iter.done = true
+}
+
+func (iter *BoltIterator) Error() error {
+	return iter.err
+}
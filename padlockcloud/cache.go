@@ -0,0 +1,267 @@
+package padlockcloud
+
+import "fmt"
+import "sync"
+import "reflect"
+import "sync/atomic"
+import "github.com/hashicorp/golang-lru"
+
+type CacheConfig struct {
+	// Maximum number of records cached per `Storable` type. Caching is disabled if 0
+	Size int `yaml:"size"`
+	// Maximum number of records cached for specific types, mapped by type identifier (e.g. "auth-accounts").
+	// A value of 0 disables caching for a type
+	Types map[string]int `yaml:"types"`
+}
+
+// Returns the maximum number of cached records for a given type
+func (c *CacheConfig) sizeFor(typ reflect.Type) int {
+	if size, ok := c.Types[StorableTypes[typ]]; ok {
+		return size
+	}
+	return c.Size
+}
+
+// Hit and miss counts for a single `Storable` type
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+type typeCache struct {
+	lru    *lru.Cache
+	hits   uint64
+	misses uint64
+}
+
+// Implementation of the `Storage` interface that wraps another storage, keeping the most recently used
+// records of each type in memory. Records are cached in their serialized form so that callers never share
+// instances. Writes go through to the underlying storage and update or invalidate cached records
+type CachedStorage struct {
+	Storage
+	Config *CacheConfig
+	caches map[reflect.Type]*typeCache
+	// Incremented on every invalidation. Records read from the underlying storage are only cached if
+	// no invalidation happened in the meantime, so concurrent writes never leave stale records behind
+	epoch uint64
+	mutex sync.Mutex
+}
+
+// Implementation of the `Storage.Open` interface method
+func (s *CachedStorage) Open() error {
+	known := make(map[string]bool)
+	for _, loc := range StorableTypes {
+		known[loc] = true
+	}
+	for loc := range s.Config.Types {
+		if !known[loc] {
+			return fmt.Errorf("Unknown record type in cache config: %s", loc)
+		}
+	}
+
+	caches := make(map[reflect.Type]*typeCache)
+
+	for typ := range StorableTypes {
+		size := s.Config.sizeFor(typ)
+		if size <= 0 {
+			continue
+		}
+
+		c, err := lru.New(size)
+		if err != nil {
+			return err
+		}
+		caches[typ] = &typeCache{lru: c}
+	}
+
+	s.mutex.Lock()
+	s.caches = caches
+	s.mutex.Unlock()
+
+	return s.Storage.Open()
+}
+
+// Implementation of the `Storage.Close` interface method
+func (s *CachedStorage) Close() error {
+	s.mutex.Lock()
+	s.caches = nil
+	s.mutex.Unlock()
+
+	return s.Storage.Close()
+}
+
+func (s *CachedStorage) backend() Storage {
+	return s.Storage
+}
+
+// Returns the cache for the type of a given `Storable` or nil if records of this type are not cached
+func (s *CachedStorage) cache(t Storable) *typeCache {
+	if t == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.caches[typeFromStorable(t)]
+}
+
+// Removes the given keys from the cache
+func (s *CachedStorage) invalidate(c *typeCache, keys ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.epoch++
+	for _, key := range keys {
+		c.lru.Remove(key)
+	}
+}
+
+// Implementation of the `Storage.Get` interface method
+func (s *CachedStorage) Get(t Storable) error {
+	c := s.cache(t)
+	if c == nil {
+		return s.Storage.Get(t)
+	}
+
+	key := string(t.Key())
+
+	if data, ok := c.lru.Get(key); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return t.Deserialize(data.([]byte))
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+
+	s.mutex.Lock()
+	epoch := s.epoch
+	s.mutex.Unlock()
+
+	rec := &recordingStorable{Storable: t}
+	if err := s.Storage.Get(rec); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	if s.epoch == epoch {
+		c.lru.Add(key, rec.data)
+	}
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// Implementation of the `Storage.Put` interface method
+func (s *CachedStorage) Put(t Storable) error {
+	c := s.cache(t)
+	if c == nil {
+		return s.Storage.Put(t)
+	}
+
+	// The written record is not added to the cache, since concurrent writes to the same key may reach
+	// the underlying storage in a different order than the cache. Instead, the key is invalidated once
+	// the write is done, so the next `Get` reads the record from the underlying storage
+	err := s.Storage.Put(t)
+	s.invalidate(c, string(t.Key()))
+	return err
+}
+
+// Implementation of the `Storage.Delete` interface method
+func (s *CachedStorage) Delete(t Storable) error {
+	c := s.cache(t)
+	if c == nil {
+		return s.Storage.Delete(t)
+	}
+
+	err := s.Storage.Delete(t)
+	s.invalidate(c, string(t.Key()))
+	return err
+}
+
+// Implementation of the `Storage.Update` interface method. Records written within the transaction
+// are invalidated once the transaction is done, whether or not it was successful
+func (s *CachedStorage) Update(fn func(StorageTx) error) error {
+	tx := &cachedTx{storage: s, keys: make(map[*typeCache][]string)}
+
+	defer func() {
+		for c, keys := range tx.keys {
+			s.invalidate(c, keys...)
+		}
+	}()
+
+	return s.Storage.Update(func(t StorageTx) error {
+		tx.tx = t
+		return fn(tx)
+	})
+}
+
+// Returns the hit and miss counts for all cached types, mapped by type identifier
+func (s *CachedStorage) Stats() map[string]CacheStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := make(map[string]CacheStats)
+	for typ, c := range s.caches {
+		stats[StorableTypes[typ]] = CacheStats{
+			Hits:   atomic.LoadUint64(&c.hits),
+			Misses: atomic.LoadUint64(&c.misses),
+		}
+	}
+	return stats
+}
+
+// Returns the first `CachedStorage` found among a storage and the storages it decorates, if any
+func findCachedStorage(s Storage) *CachedStorage {
+	for _, s := range storageChain(s) {
+		if c, ok := s.(*CachedStorage); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// Implementation of the `StorageTx` interface for `CachedStorage`. Keeps track of all written keys
+// so they can be invalidated after the transaction
+type cachedTx struct {
+	tx      StorageTx
+	storage *CachedStorage
+	keys    map[*typeCache][]string
+}
+
+func (tx *cachedTx) touch(t Storable) {
+	if c := tx.storage.cache(t); c != nil {
+		tx.keys[c] = append(tx.keys[c], string(t.Key()))
+	}
+}
+
+func (tx *cachedTx) Get(t Storable) error {
+	return tx.tx.Get(t)
+}
+
+func (tx *cachedTx) Put(t Storable) error {
+	tx.touch(t)
+	return tx.tx.Put(t)
+}
+
+func (tx *cachedTx) Delete(t Storable) error {
+	tx.touch(t)
+	return tx.tx.Delete(t)
+}
+
+// Wraps a `Storable`, keeping a copy of the data it was deserialized from
+type recordingStorable struct {
+	Storable
+	data []byte
+}
+
+func (r *recordingStorable) storableType() reflect.Type {
+	return typeFromStorable(r.Storable)
+}
+
+func (r *recordingStorable) Deserialize(data []byte) error {
+	if err := r.Storable.Deserialize(data); err != nil {
+		return err
+	}
+	r.data = append([]byte{}, data...)
+	return nil
+}
@@ -0,0 +1,194 @@
+package padlockcloud
+
+import "testing"
+import "errors"
+import "bytes"
+import "strings"
+import "sync"
+import "fmt"
+
+func TestCachedStorage(t *testing.T) {
+	testStorage(t, &CachedStorage{
+		Storage: &MemoryStorage{},
+		Config:  &CacheConfig{Size: 2},
+	})
+}
+
+func TestCachedStorageStats(t *testing.T) {
+	backend := &MemoryStorage{}
+	storage := &CachedStorage{
+		Storage: backend,
+		Config:  &CacheConfig{Size: 10, Types: map[string]int{"mystrbl": 0}},
+	}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := backend.Put(&testKeyedStrbl{"key", "value"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		s := &testKeyedStrbl{Name: "key"}
+		if err := storage.Get(s); err != nil || s.Value != "value" {
+			t.Fatalf("Expected 'value', got '%s' (%v)", s.Value, err)
+		}
+	}
+
+	// Records should be served from the cache, so changes made to the backend directly go unnoticed
+	if err := backend.Put(&testKeyedStrbl{"key", "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	s := &testKeyedStrbl{Name: "key"}
+	if err := storage.Get(s); err != nil || s.Value != "value" {
+		t.Fatalf("Expected cached value, got '%s' (%v)", s.Value, err)
+	}
+
+	stats := storage.Stats()
+	if stats["mykeyedstrbl"] != (CacheStats{Hits: 3, Misses: 1}) {
+		t.Fatalf("Expected 3 hits and 1 miss, got %+v", stats["mykeyedstrbl"])
+	}
+
+	// Caching is disabled for this type
+	if _, ok := stats["mystrbl"]; ok {
+		t.Fatal("Expected no cache for 'mystrbl'")
+	}
+	var str testStrbl = "value"
+	if err := storage.Put(&str); err != nil {
+		t.Fatal(err)
+	}
+	str = "changed"
+	if err := backend.Put(&str); err != nil {
+		t.Fatal(err)
+	}
+	var res testStrbl
+	if err := storage.Get(&res); err != nil || res != "changed" {
+		t.Fatalf("Expected uncached value, got '%s' (%v)", res, err)
+	}
+}
+
+func TestCachedStorageInvalidation(t *testing.T) {
+	backend := &MemoryStorage{}
+	storage := &CachedStorage{
+		Storage: backend,
+		Config:  &CacheConfig{Size: 10},
+	}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	get := func(expected string) {
+		s := &testKeyedStrbl{Name: "key"}
+		err := storage.Get(s)
+		if expected == "" && err != ErrNotFound {
+			t.Fatalf("Expected ErrNotFound, got %v", err)
+		} else if expected != "" && (err != nil || s.Value != expected) {
+			t.Fatalf("Expected '%s', got '%s' (%v)", expected, s.Value, err)
+		}
+	}
+
+	// Writes should invalidate the cache rather than update it
+	if err := storage.Put(&testKeyedStrbl{"key", "value"}); err != nil {
+		t.Fatal(err)
+	}
+	get("value")
+	get("value")
+	if stats := storage.Stats()["mykeyedstrbl"]; stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("Expected record to be cached on first read, got %+v", stats)
+	}
+
+	if err := storage.Put(&testKeyedStrbl{"key", "value2"}); err != nil {
+		t.Fatal(err)
+	}
+	get("value2")
+
+	// After concurrent writes, the cache should agree with the underlying storage
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			storage.Put(&testKeyedStrbl{"key", fmt.Sprintf("concurrent%d", i)})
+			storage.Get(&testKeyedStrbl{Name: "key"})
+		}(i)
+	}
+	wg.Wait()
+	stored := &testKeyedStrbl{Name: "key"}
+	if err := backend.Get(stored); err != nil {
+		t.Fatal(err)
+	}
+	get(stored.Value)
+
+	if err := storage.Put(&testKeyedStrbl{"key", "value2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records written within a transaction should be invalidated, whether or not it succeeds
+	txErr := errors.New("transaction failed")
+	if err := storage.Update(func(tx StorageTx) error {
+		return tx.Put(&testKeyedStrbl{"key", "value3"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	get("value3")
+
+	if err := storage.Update(func(tx StorageTx) error {
+		if err := tx.Put(&testKeyedStrbl{"key", "value4"}); err != nil {
+			return err
+		}
+		return txErr
+	}); err != txErr {
+		t.Fatalf("Expected transaction error, got %v", err)
+	}
+	get("value3")
+
+	if err := storage.Delete(&testKeyedStrbl{Name: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	get("")
+}
+
+func TestCachedStorageEviction(t *testing.T) {
+	storage := &CachedStorage{
+		Storage: &MemoryStorage{},
+		Config:  &CacheConfig{Size: 2},
+	}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := storage.Put(&testKeyedStrbl{name, "value"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"a", "b", "c", "c", "b", "a"} {
+		if err := storage.Get(&testKeyedStrbl{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "a" should have been evicted when "c" was read
+	if stats := storage.Stats()["mykeyedstrbl"]; stats.Hits != 2 || stats.Misses != 4 {
+		t.Fatalf("Expected 2 hits and 4 misses, got %+v", stats)
+	}
+
+	m := NewMetrics()
+	m.Cache = findCachedStorage(&MeteredStorage{storage, m})
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+
+	for _, line := range []string{
+		`padlock_cache_hits_total{type="mykeyedstrbl"} 2`,
+		`padlock_cache_misses_total{type="mykeyedstrbl"} 4`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected output to contain '%s', got:\n%s", line, buf.String())
+		}
+	}
+}
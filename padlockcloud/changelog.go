@@ -0,0 +1,423 @@
+package padlockcloud
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "strconv"
+import "time"
+
+// Opaque, encrypted change to a vault, appended to its change log by a client. Changes are stored as
+// separate records, keyed by the key of the change log and their sequence number, so appending a change
+// doesn't require rewriting the whole log. The snapshot of a change log is stored the same way, under the
+// sequence number of the last change it covers
+type ChangeRecord struct {
+	Account *Account `json:"-"`
+	// Name of the vault the change belongs to. Empty for the default vault
+	Vault string `json:"-"`
+	// Sequence number assigned by the server, increasing by one with each change
+	Seq int64
+	// Time the change was appended
+	Created time.Time
+	// Id of the auth token used to append this change
+	TokenId string
+	Content []byte
+}
+
+// Returns the prefix shared by the keys of all records belonging to the change log of a vault. Neither
+// emails nor vault names can contain "#", so the prefixes of different change logs never overlap
+func changeKeyPrefix(email string, vault string) []byte {
+	return append(vaultKey(email, vault), '#')
+}
+
+// Implementation of the `Storable.Key` interface method. Sequence numbers are padded so records are
+// ordered by sequence number
+func (c *ChangeRecord) Key() []byte {
+	return append(changeKeyPrefix(c.Account.Email, c.Vault), fmt.Sprintf("%020d", c.Seq)...)
+}
+
+// Splits the key of a change record into the email of the account, the name of the vault and the
+// sequence number
+func splitChangeKey(key []byte) (string, string, int64, error) {
+	i := bytes.LastIndexByte(key, '#')
+	if i == -1 {
+		return "", "", 0, fmt.Errorf("Invalid change record key: %s", key)
+	}
+
+	seq, err := strconv.ParseInt(string(key[i+1:]), 10, 64)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("Invalid change record key: %s", key)
+	}
+
+	email, vault := splitVaultKey(key[:i])
+	return email, vault, seq, nil
+}
+
+// Implementation of the `Storable.Deserialize` interface method
+func (c *ChangeRecord) Deserialize(data []byte) error {
+	return json.Unmarshal(data, c)
+}
+
+// Implementation of the `Storable.Serialize` interface method
+func (c *ChangeRecord) Serialize() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func (c *ChangeRecord) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"seq":     c.Seq,
+		"created": c.Created,
+		"tokenId": c.TokenId,
+		"content": c.Content,
+	}
+}
+
+// ChangeLog holds the data of a vault synchronized in delta mode. It consists of a base snapshot, which
+// covers all changes up to `SnapshotSeq`, followed by the changes appended since. Both are opaque to
+// the server. Delta mode is independent of the data store of the vault. The record itself only keeps
+// track of sequence numbers and sizes, while the snapshot and changes are stored as `ChangeRecord`s
+type ChangeLog struct {
+	Account *Account `json:"-"`
+	// Name of the vault the change log belongs to. Empty for the default vault
+	Vault string `json:"-"`
+	// Sequence number of the most recent change. Kept when the log is cleared, so sequence numbers
+	// are never reused for the same vault
+	LastSeq int64
+	// Sequence number of the last change included in the snapshot
+	SnapshotSeq int64
+	// Combined size of the snapshot and all changes in bytes
+	Size int64
+	// Snapshot and changes appended since the snapshot was taken, oldest change first. Only populated
+	// by `LoadChangeLog` and not stored along with the log. Logs written before changes were stored
+	// separately still hold them inline
+	Snapshot []byte          `json:",omitempty"`
+	Changes  []*ChangeRecord `json:",omitempty"`
+}
+
+// Implementation of the `Storable.Key` interface method
+func (l *ChangeLog) Key() []byte {
+	return vaultKey(l.Account.Email, l.Vault)
+}
+
+// Implementation of the `Storable.Deserialize` interface method
+func (l *ChangeLog) Deserialize(data []byte) error {
+	if err := json.Unmarshal(data, l); err != nil {
+		return err
+	}
+	l.normalize()
+	return nil
+}
+
+// Implementation of the `Storable.Serialize` interface method
+func (l *ChangeLog) Serialize() ([]byte, error) {
+	header := *l
+	header.Snapshot, header.Changes = nil, nil
+	return json.Marshal(&header)
+}
+
+// Derives the sequence number and size from the snapshot and changes held by the log, for logs that
+// hold them inline, i.e. logs written before changes were stored separately and logs read from exports
+func (l *ChangeLog) normalize() {
+	if l.Snapshot == nil && len(l.Changes) == 0 {
+		return
+	}
+
+	if l.LastSeq < l.SnapshotSeq {
+		l.LastSeq = l.SnapshotSeq
+	}
+
+	l.Size = int64(len(l.Snapshot))
+	for _, c := range l.Changes {
+		l.Size += int64(len(c.Content))
+		if c.Seq > l.LastSeq {
+			l.LastSeq = c.Seq
+		}
+	}
+}
+
+// Returns the sequence number of the most recent change
+func (l *ChangeLog) Seq() int64 {
+	return l.LastSeq
+}
+
+// Returns true if the log holds neither a snapshot nor any changes, e.g. because it has been cleared
+func (l *ChangeLog) Empty() bool {
+	return l.Size == 0 && l.Seq() == l.SnapshotSeq
+}
+
+// Returns the changes a client that has seen all changes up to `seq` needs to catch up. If some of these
+// changes have been compacted into the snapshot, the snapshot is included as well and the client should
+// replace its local state with it before applying the changes. The log needs to be loaded through
+// `LoadChangeLog` with the same `seq` first
+func (l *ChangeLog) Since(seq int64) map[string]interface{} {
+	res := map[string]interface{}{
+		"seq": l.Seq(),
+	}
+
+	if l.needsSnapshot(seq) {
+		res["snapshot"] = map[string]interface{}{
+			"seq":     l.SnapshotSeq,
+			"content": l.Snapshot,
+		}
+		seq = l.SnapshotSeq
+	}
+
+	changes := make([]map[string]interface{}, 0)
+	for _, c := range l.Changes {
+		if c.Seq > seq {
+			changes = append(changes, c.ToMap())
+		}
+	}
+	res["changes"] = changes
+
+	return res
+}
+
+// Whether a client that has seen all changes up to `seq` needs the snapshot to catch up
+func (l *ChangeLog) needsSnapshot(seq int64) bool {
+	return seq < l.SnapshotSeq || seq > l.Seq()
+}
+
+// Number of attempts at reading a change log before `LoadChangeLog` falls back to reading it within a
+// transaction
+var maxChangeLogReads = 3
+
+// Loads a change log along with the changes a client that has seen all changes up to `seq` needs to
+// catch up, including the snapshot if necessary. Use a `seq` of 0 to load the snapshot and all changes.
+// Returns `ErrNotFound` if nothing has been appended to the log yet
+func LoadChangeLog(storage Storage, log *ChangeLog, seq int64) error {
+	// The log and its records are read separately, so a concurrent compaction may remove the snapshot or
+	// changes in between. In that case, the log is read again
+	for i := 0; i < maxChangeLogReads; i++ {
+		if ok, err := loadChangeLog(storage, storage, log, seq); err != nil || ok {
+			return err
+		}
+	}
+
+	// Compactions can't overlap with a transaction
+	return storage.Update(func(tx StorageTx) error {
+		_, err := loadChangeLog(storage, tx, log, seq)
+		return err
+	})
+}
+
+// Reads a change log through `tx` and its records from `storage`. Returns false if the log was compacted
+// or cleared while reading the records
+func loadChangeLog(storage Storage, tx StorageTx, log *ChangeLog, seq int64) (bool, error) {
+	*log = ChangeLog{Account: log.Account, Vault: log.Vault}
+	if err := tx.Get(log); err != nil {
+		return false, err
+	}
+
+	// Logs written before changes were stored separately already hold them
+	if log.Snapshot != nil || len(log.Changes) != 0 {
+		return true, nil
+	}
+
+	from := seq + 1
+	if log.needsSnapshot(seq) {
+		from = log.SnapshotSeq
+	}
+
+	iter, err := storage.Iterator(&ChangeRecord{})
+	if err != nil {
+		return false, err
+	}
+	defer iter.Release()
+
+	records := NewPrefixIterator(iter, changeKeyPrefix(log.Account.Email, log.Vault))
+	records.Seek((&ChangeRecord{Account: log.Account, Vault: log.Vault, Seq: from}).Key())
+
+	for records.Next() {
+		c := &ChangeRecord{Account: log.Account, Vault: log.Vault}
+		if err := records.Get(c); err != nil {
+			return false, err
+		}
+
+		switch {
+		case c.Seq == log.SnapshotSeq:
+			log.Snapshot = c.Content
+		case c.Seq > log.SnapshotSeq && c.Seq <= log.Seq():
+			log.Changes = append(log.Changes, c)
+		}
+	}
+
+	if err := records.Error(); err != nil {
+		return false, err
+	}
+
+	// Appending changes doesn't affect the records read, but compacting or clearing the log moves the
+	// snapshot
+	current := &ChangeLog{Account: log.Account, Vault: log.Vault}
+	if err := tx.Get(current); err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return current.SnapshotSeq == log.SnapshotSeq, nil
+}
+
+// Moves the snapshot and changes of logs written before changes were stored separately into their own
+// records. The log itself needs to be stored afterwards
+func (l *ChangeLog) migrate(tx StorageTx) error {
+	if l.Snapshot != nil {
+		if err := tx.Put(&ChangeRecord{Account: l.Account, Vault: l.Vault, Seq: l.SnapshotSeq, Content: l.Snapshot}); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range l.Changes {
+		c.Account, c.Vault = l.Account, l.Vault
+		if err := tx.Put(c); err != nil {
+			return err
+		}
+	}
+
+	l.Snapshot, l.Changes = nil, nil
+
+	return nil
+}
+
+// Removes the records holding the snapshot and the changes up to and including `seq`. Returns their
+// combined size
+func (l *ChangeLog) removeRecords(tx StorageTx, seq int64) (int64, error) {
+	var size int64
+
+	// Records only exist for the sequence numbers covered by the log, so there is no need for iterating
+	for s := l.SnapshotSeq; s <= seq; s++ {
+		c := &ChangeRecord{Account: l.Account, Vault: l.Vault, Seq: s}
+		if err := tx.Get(c); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		size += int64(len(c.Content))
+
+		if err := tx.Delete(c); err != nil {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+// Removes the snapshot and all changes of a change log. The log itself is kept with the current
+// sequence number, so changes appended to the same vault later on continue where it left off
+func clearChangeLog(tx StorageTx, log *ChangeLog) error {
+	if err := tx.Get(log); err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Logs written before changes were stored separately are cleared by simply dropping them
+	log.Snapshot, log.Changes = nil, nil
+
+	if _, err := log.removeRecords(tx, log.Seq()); err != nil {
+		return err
+	}
+
+	log.SnapshotSeq = log.Seq()
+	log.Size = 0
+
+	return tx.Put(log)
+}
+
+// Removes a change log along with its snapshot and all changes
+func deleteChangeLog(tx StorageTx, log *ChangeLog) error {
+	if err := tx.Get(log); err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := log.removeRecords(tx, log.Seq()); err != nil {
+		return err
+	}
+
+	return tx.Delete(log)
+}
+
+// Appends a change to the change log of a vault, failing with a `StoreQuotaExceeded` error if the storage
+// used by the account would exceed `quota` bytes. Returns the new change along with its sequence number
+func AppendChange(storage Storage, log *ChangeLog, content []byte, author *AuthToken, quota int64) (*ChangeRecord, error) {
+	change := &ChangeRecord{
+		Account: log.Account,
+		Vault:   log.Vault,
+		Created: time.Now(),
+		Content: content,
+	}
+
+	if author != nil {
+		change.TokenId = author.Id
+	}
+
+	if err := updateWithinQuota(storage, log.Account, quota, func(tx StorageTx) error {
+		if err := tx.Get(log); err != nil && err != ErrNotFound {
+			return err
+		}
+
+		if err := log.migrate(tx); err != nil {
+			return err
+		}
+
+		change.Seq = log.Seq() + 1
+		if err := tx.Put(change); err != nil {
+			return err
+		}
+
+		log.LastSeq = change.Seq
+		log.Size += int64(len(content))
+
+		return tx.Put(log)
+	}); err != nil {
+		return nil, err
+	}
+
+	return change, nil
+}
+
+// Replaces all changes up to and including `seq` with a new snapshot. Fails with a `BadRequest` error if
+// `seq` lies before the current snapshot or after the most recent change and with a `StoreQuotaExceeded`
+// error if the storage used by the account would exceed `quota` bytes
+func CompactChangeLog(storage Storage, log *ChangeLog, seq int64, snapshot []byte, quota int64) error {
+	return updateWithinQuota(storage, log.Account, quota, func(tx StorageTx) error {
+		if err := tx.Get(log); err != nil && err != ErrNotFound {
+			return err
+		}
+
+		if err := log.migrate(tx); err != nil {
+			return err
+		}
+
+		if seq < log.SnapshotSeq || seq > log.Seq() {
+			return &BadRequest{"invalid sequence number"}
+		}
+
+		removed, err := log.removeRecords(tx, seq)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Put(&ChangeRecord{
+			Account: log.Account,
+			Vault:   log.Vault,
+			Seq:     seq,
+			Created: time.Now(),
+			Content: snapshot,
+		}); err != nil {
+			return err
+		}
+
+		log.SnapshotSeq = seq
+		log.Size += int64(len(snapshot)) - removed
+
+		return tx.Put(log)
+	})
+}
+
+func init() {
+	RegisterStorable(&ChangeLog{}, "data-store-changes")
+	RegisterStorable(&ChangeRecord{}, "data-store-change-records")
+}
@@ -0,0 +1,276 @@
+package padlockcloud
+
+import "io"
+import "fmt"
+import "reflect"
+import "compress/flate"
+import "compress/gzip"
+import "encoding/json"
+import "github.com/golang/snappy"
+
+// Kinds of problems detected by `CheckStorage`
+const (
+	// Record that can't be deserialized
+	ProblemUndecodable = "undecodable"
+	// Data store, history or shared vault without a corresponding account
+	ProblemOrphaned = "orphaned"
+	// Nil entry in the auth tokens of an account
+	ProblemNilAuthToken = "nil-auth-token"
+	// Several auth tokens of an account sharing the same id
+	ProblemDuplicateTokenId = "duplicate-token-id"
+	// Auth token that is expired or unused for too long but was never removed
+	ProblemExpiredAuthToken = "expired-auth-token"
+	// Auth request without an auth token
+	ProblemMissingAuthToken = "missing-auth-token"
+)
+
+// Identifiers of the record types holding vault contents. Since removing them means losing user data,
+// problems with these records are only repaired for types listed in `StorageCheckOptions.RepairData`
+var vaultDataTypes = []string{"data-stores", "data-store-history", "data-store-changes", "data-store-change-records"}
+
+// Options for `CheckStorage`
+type StorageCheckOptions struct {
+	// Fix problems along the way by removing the affected records or, in the case of accounts, the
+	// affected auth tokens
+	Repair bool
+	// Identifiers of the record types holding vault contents (see `vaultDataTypes`) whose affected records
+	// may be removed when repairing. Problems with records of the other types are only reported
+	RepairData []string
+}
+
+// Returns true if affected records of the given type may be removed when repairing
+func (opts *StorageCheckOptions) canRepair(loc string) bool {
+	if !opts.Repair {
+		return false
+	}
+	for _, t := range vaultDataTypes {
+		if t == loc {
+			for _, r := range opts.RepairData {
+				if r == loc {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Problem with a single record found by `CheckStorage`
+type StorageProblem struct {
+	// Identifier of the record type
+	Type string
+	// Key of the affected record
+	Key []byte
+	// Kind of problem, e.g. `ProblemOrphaned`
+	Kind string
+	// Human-readable description of the problem
+	Detail string
+	// Whether the problem has been repaired
+	Repaired bool
+}
+
+func (p *StorageProblem) String() string {
+	s := fmt.Sprintf("%s %s: %s - %s", p.Type, p.Key, p.Kind, p.Detail)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Result of a storage check
+type StorageCheck struct {
+	// Number of checked records per type identifier
+	Checked map[string]int
+	// Problems found, in the order they were encountered
+	Problems []*StorageProblem
+}
+
+// Returns the number of repaired problems
+func (c *StorageCheck) Repaired() int {
+	count := 0
+	for _, p := range c.Problems {
+		if p.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// Scans all records of all registered types for problems like undecodable records, orphaned data
+// stores or invalid auth tokens, repairing them if requested (see `StorageCheckOptions`). Errors that
+// don't indicate a malformed record, like missing encryption keys, records written with a newer schema
+// version or failing requests, abort the check
+func CheckStorage(storage Storage, opts *StorageCheckOptions) (*StorageCheck, error) {
+	check := &StorageCheck{Checked: make(map[string]int)}
+
+	for _, typ := range sortedStorableTypes() {
+		iter, err := storage.Iterator(&rawStorable{typ: typ})
+		if err != nil {
+			return check, err
+		}
+
+		for iter.Next() {
+			raw := &rawStorable{typ: typ, key: append([]byte{}, iter.Key()...)}
+			check.Checked[StorableTypes[typ]]++
+
+			problems, fix, err := checkRecord(storage, iter, raw)
+			if err != nil {
+				iter.Release()
+				return check, fmt.Errorf("Failed to check %s record %s: %v", StorableTypes[typ], raw.key, err)
+			}
+
+			check.Problems = append(check.Problems, problems...)
+
+			if len(problems) == 0 || !opts.canRepair(StorableTypes[typ]) {
+				continue
+			}
+
+			if err := fix(); err != nil {
+				iter.Release()
+				return check, fmt.Errorf("Failed to repair %s record %s: %v", StorableTypes[typ], raw.key, err)
+			}
+
+			for _, p := range problems {
+				p.Repaired = true
+			}
+		}
+
+		err = iter.Error()
+		iter.Release()
+		if err != nil {
+			return check, err
+		}
+	}
+
+	return check, nil
+}
+
+// Returns true if an error returned when reading a record indicates that its bytes are malformed, as
+// opposed to errors caused by the environment
+func isDecodeError(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError, flate.CorruptInputError:
+		return true
+	}
+	switch err {
+	case snappy.ErrCorrupt, gzip.ErrHeader, gzip.ErrChecksum, io.ErrUnexpectedEOF, ErrMissingCompressionHeader:
+		return true
+	}
+	return false
+}
+
+// Checks the auth tokens of an account, returning the problems found along with the tokens that remain
+// once nil entries, duplicate ids and expired tokens are removed
+func checkAuthTokens(authTokens []*AuthToken, problem func(string, string, ...interface{}) *StorageProblem) ([]*StorageProblem, []*AuthToken) {
+	var problems []*StorageProblem
+
+	tokens := make([]*AuthToken, 0, len(authTokens))
+	for i, token := range authTokens {
+		if token == nil {
+			problems = append(problems, problem(ProblemNilAuthToken, "auth token at index %d is nil", i))
+		} else {
+			tokens = append(tokens, token)
+		}
+	}
+
+	// Of several tokens sharing the same id, keep the one that was used most recently
+	latest := make(map[string]*AuthToken)
+	counts := make(map[string]int)
+	for _, token := range tokens {
+		if token.Id == "" {
+			continue
+		}
+		counts[token.Id]++
+		if l := latest[token.Id]; l == nil || token.LastUsed.After(l.LastUsed) {
+			latest[token.Id] = token
+		}
+	}
+
+	unique := tokens[:0]
+	reported := make(map[string]bool)
+	for _, token := range tokens {
+		if token.Id == "" || latest[token.Id] == token {
+			unique = append(unique, token)
+		} else if !reported[token.Id] {
+			reported[token.Id] = true
+			problems = append(problems, problem(ProblemDuplicateTokenId, "auth token id %s is used by %d tokens", token.Id, counts[token.Id]))
+		}
+	}
+
+	// Apply the same rules the server applies when authenticating requests
+	valid := &Account{AuthTokens: append([]*AuthToken{}, unique...)}
+	valid.ExpireUnusedAuthTokens()
+	valid.RemoveExpiredAuthTokens()
+	if expired := len(unique) - len(valid.AuthTokens); expired > 0 {
+		problems = append(problems, problem(ProblemExpiredAuthToken, "%d auth tokens are expired", expired))
+	}
+
+	return problems, valid.AuthTokens
+}
+
+// Checks the record the iterator is positioned at, returning the problems found along with a function
+// for repairing them. Fails if the record can't be read for reasons other than malformed data
+func checkRecord(storage Storage, iter StorageIterator, raw *rawStorable) ([]*StorageProblem, func() error, error) {
+	loc := StorableTypes[raw.typ]
+
+	problem := func(kind string, format string, args ...interface{}) *StorageProblem {
+		return &StorageProblem{Type: loc, Key: raw.key, Kind: kind, Detail: fmt.Sprintf(format, args...)}
+	}
+
+	remove := func() error {
+		return storage.Delete(raw)
+	}
+
+	t := reflect.New(raw.typ).Interface().(Storable)
+	if err := iter.Get(t); isDecodeError(err) {
+		return []*StorageProblem{problem(ProblemUndecodable, "%v", err)}, remove, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	switch rec := t.(type) {
+	case *Account:
+		problems, _ := checkAuthTokens(rec.AuthTokens, problem)
+
+		return problems, func() error {
+			// Read the account again within a transaction, so auth tokens created or used since it was
+			// checked aren't lost
+			return storage.Update(func(tx StorageTx) error {
+				acc := &Account{Email: string(raw.key)}
+				if err := tx.Get(acc); err == ErrNotFound {
+					return nil
+				} else if err != nil {
+					return err
+				}
+
+				_, acc.AuthTokens = checkAuthTokens(acc.AuthTokens, problem)
+
+				data, err := acc.Serialize()
+				if err != nil {
+					return err
+				}
+				return tx.Put(&rawStorable{raw.typ, raw.key, data})
+			})
+		}, nil
+	case *AuthRequest:
+		if rec.AuthToken == nil {
+			return []*StorageProblem{problem(ProblemMissingAuthToken, "auth request has no auth token")}, remove, nil
+		}
+	case *DataStore, *StoreHistory, *SharedVault, *ChangeLog, *ChangeRecord, *PendingDeletion:
+		email, _ := splitVaultKey(raw.key)
+		if _, ok := rec.(*ChangeRecord); ok {
+			var err error
+			if email, _, _, err = splitChangeKey(raw.key); err != nil {
+				return []*StorageProblem{problem(ProblemUndecodable, "%v", err)}, remove, nil
+			}
+		}
+		if err := storage.Get(&Account{Email: email}); err == ErrNotFound {
+			return []*StorageProblem{problem(ProblemOrphaned, "no account exists for %s", email)}, remove, nil
+		} else if err != nil && !isDecodeError(err) {
+			return nil, nil, err
+		}
+	}
+
+	return nil, nil, nil
+}
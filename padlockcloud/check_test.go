@@ -0,0 +1,195 @@
+package padlockcloud
+
+import "testing"
+import "time"
+import "fmt"
+
+func TestCheckStorage(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	now := time.Now()
+
+	healthy := &Account{Email: "healthy@padlock.io", AuthTokens: []*AuthToken{
+		{Email: "healthy@padlock.io", Token: "a", Id: "1", Type: "api", LastUsed: now},
+	}}
+	broken := &Account{Email: "broken@padlock.io", AuthTokens: []*AuthToken{
+		nil,
+		{Email: "broken@padlock.io", Token: "a", Id: "1", Type: "api", LastUsed: now.Add(-time.Hour)},
+		{Email: "broken@padlock.io", Token: "b", Id: "1", Type: "api", LastUsed: now},
+		{Email: "broken@padlock.io", Token: "c", Id: "2", Type: "web", LastUsed: now, Expires: now.Add(-time.Hour)},
+		{Email: "broken@padlock.io", Token: "d", Id: "3", Type: "api", LastUsed: now.Add(-60 * 24 * time.Hour)},
+	}}
+
+	for _, s := range []Storable{
+		healthy,
+		broken,
+		&DataStore{Account: healthy, Content: []byte("data")},
+		&DataStore{Account: healthy, Vault: "work", Content: []byte("data")},
+		&DataStore{Account: &Account{Email: "deleted@padlock.io"}, Content: []byte("data")},
+		&StoreHistory{Account: &Account{Email: "deleted@padlock.io"}},
+		&SharedVault{Owner: "deleted@padlock.io", Vault: "team"},
+		&AuthRequest{Token: "token", AuthToken: &AuthToken{Email: "healthy@padlock.io"}},
+		&AuthRequest{Token: "invalid"},
+		&rawStorable{typeFromStorable(&Account{}), []byte("garbage@padlock.io"), []byte("not json")},
+	} {
+		if err := storage.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]int{
+		ProblemNilAuthToken:     1,
+		ProblemDuplicateTokenId: 1,
+		ProblemExpiredAuthToken: 1,
+		ProblemOrphaned:         3,
+		ProblemMissingAuthToken: 1,
+		ProblemUndecodable:      1,
+	}
+
+	// Problems with records holding vault contents are only repaired if requested explicitly
+	isVaultData := func(p *StorageProblem) bool {
+		return p.Type == "data-stores" || p.Type == "data-store-history"
+	}
+
+	checkProblems := func(check *StorageCheck, repaired func(*StorageProblem) bool) {
+		kinds := make(map[string]int)
+		for _, p := range check.Problems {
+			kinds[p.Kind]++
+			if p.Repaired != repaired(p) {
+				t.Errorf("Expected problem '%s' to have repaired=%t", p, repaired(p))
+			}
+		}
+		for kind, count := range expected {
+			if kinds[kind] != count {
+				t.Errorf("Expected %d problems of kind %s, got %d", count, kind, kinds[kind])
+			}
+		}
+		if len(check.Problems) != 8 {
+			t.Errorf("Expected 8 problems, got %d", len(check.Problems))
+		}
+	}
+
+	// Checking without repairing should not change anything
+	check, err := CheckStorage(storage, &StorageCheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProblems(check, func(*StorageProblem) bool { return false })
+
+	if check.Checked["auth-accounts"] != 3 || check.Checked["data-stores"] != 3 {
+		t.Errorf("Unexpected number of checked records: %v", check.Checked)
+	}
+
+	if err := storage.Get(&DataStore{Account: &Account{Email: "deleted@padlock.io"}}); err != nil {
+		t.Fatalf("Orphaned data store should not be removed without repairing, got %v", err)
+	}
+
+	check, err = CheckStorage(storage, &StorageCheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProblems(check, func(p *StorageProblem) bool { return !isVaultData(p) })
+
+	if err := storage.Get(&StoreHistory{Account: &Account{Email: "deleted@padlock.io"}}); err != nil {
+		t.Fatalf("Orphaned history should not be removed unless requested, got %v", err)
+	}
+
+	check, err = CheckStorage(storage, &StorageCheckOptions{
+		Repair:     true,
+		RepairData: []string{"data-stores", "data-store-history"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(check.Problems) != 2 || check.Repaired() != 2 {
+		t.Fatalf("Expected remaining 2 problems to be repaired, got %v", check.Problems)
+	}
+
+	// All problems should be gone after repairing
+	if check, err = CheckStorage(storage, &StorageCheckOptions{}); err != nil {
+		t.Fatal(err)
+	} else if len(check.Problems) != 0 {
+		t.Fatalf("Expected no problems after repairing, got %v", check.Problems)
+	}
+
+	acc := &Account{Email: "broken@padlock.io"}
+	if err := storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.AuthTokens) != 1 || acc.AuthTokens[0].Token != "b" {
+		t.Fatalf("Expected only the most recently used token to remain, got %v", acc.AuthTokens)
+	}
+
+	if err := storage.Get(&DataStore{Account: healthy}); err != nil {
+		t.Fatalf("Data stores with an account should be kept, got %v", err)
+	}
+	if err := storage.Get(&DataStore{Account: healthy, Vault: "work"}); err != nil {
+		t.Fatalf("Named vaults with an account should be kept, got %v", err)
+	}
+	if err := storage.Get(&DataStore{Account: &Account{Email: "deleted@padlock.io"}}); err != ErrNotFound {
+		t.Fatalf("Expected orphaned data store to be removed, got %v", err)
+	}
+	if err := storage.Get(&AuthRequest{Token: "invalid"}); err != ErrNotFound {
+		t.Fatalf("Expected auth request without auth token to be removed, got %v", err)
+	}
+	if err := storage.Get(&AuthRequest{Token: "token"}); err != nil {
+		t.Fatalf("Valid auth requests should be kept, got %v", err)
+	}
+}
+
+func TestCheckStorageErrors(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	// Records written with a newer schema version aren't malformed and should abort the check
+	newer := []byte(fmt.Sprintf(`{"SchemaVersion":%d}`, CurrentSchemaVersion(&Account{})+1))
+	if err := storage.Put(&rawStorable{typeFromStorable(&Account{}), []byte("newer@padlock.io"), newer}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CheckStorage(storage, &StorageCheckOptions{Repair: true}); err == nil {
+		t.Fatal("Expected check to fail")
+	}
+
+	if err := storage.Get(&rawStorable{typ: typeFromStorable(&Account{}), key: []byte("newer@padlock.io")}); err != nil {
+		t.Fatalf("Record should not be removed, got %v", err)
+	}
+
+	// The same goes for records encrypted with an unknown key
+	encrypted := &EncryptedStorage{
+		Storage: storage,
+		Config:  &EncryptionConfig{KeyId: "key1", Keys: map[string]string{"key1": newTestEncryptionKey()}},
+	}
+	if err := encrypted.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete(&Account{Email: "newer@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.Put(&Account{Email: "encrypted@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load a different key without reopening the underlying storage, which would clear it
+	other := &EncryptedStorage{
+		Storage: storage,
+		Config:  &EncryptionConfig{KeyId: "key2", Keys: map[string]string{"key2": newTestEncryptionKey()}},
+	}
+	var err error
+	if other.keys, err = other.Config.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckStorage(other, &StorageCheckOptions{Repair: true}); err == nil {
+		t.Fatal("Expected check to fail for records encrypted with an unknown key")
+	}
+	if err := storage.Get(&rawStorable{typ: typeFromStorable(&Account{}), key: []byte("encrypted@padlock.io")}); err != nil {
+		t.Fatalf("Record should not be removed, got %v", err)
+	}
+}
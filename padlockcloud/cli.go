@@ -3,7 +3,11 @@ package padlockcloud
 import "fmt"
 import "path/filepath"
 import "io/ioutil"
+import "os"
 import "errors"
+import "time"
+import "strings"
+import "strconv"
 import "encoding/base64"
 import "gopkg.in/yaml.v2"
 import "gopkg.in/urfave/cli.v1"
@@ -11,7 +15,12 @@ import "gopkg.in/urfave/cli.v1"
 type CliConfig struct {
 	Log     LogConfig     `yaml:"log"`
 	Server  ServerConfig  `yaml:"server"`
+	Storage StorageConfig `yaml:"storage"`
 	LevelDB LevelDBConfig `yaml:"leveldb"`
+	Bolt    BoltConfig    `yaml:"bolt"`
+	Memory  MemoryConfig  `yaml:"memory"`
+	S3      S3Config      `yaml:"s3"`
+	Cache   CacheConfig   `yaml:"cache"`
 	Email   EmailConfig   `yaml:"email"`
 }
 
@@ -40,20 +49,112 @@ type CliApp struct {
 
 func (cliApp *CliApp) InitWithConfig(config *CliConfig) error {
 	cliApp.Config = config
-	cliApp.Storage = &LevelDBStorage{
-		Config: &config.LevelDB,
+
+	// Backends are created once per name so that types routed to the same backend share it
+	backends := make(map[string]Storage)
+	backend := func(name string) (Storage, error) {
+		if name == "" {
+			name = "leveldb"
+		}
+
+		if s, ok := backends[name]; ok {
+			return s, nil
+		}
+
+		var s Storage
+		switch name {
+		case "leveldb":
+			s = &LevelDBStorage{
+				Config: &config.LevelDB,
+			}
+		case "bolt":
+			s = &BoltStorage{
+				Config: &config.Bolt,
+			}
+		case "memory":
+			s = &MemoryStorage{
+				Config: &config.Memory,
+			}
+		case "s3":
+			s = &S3Storage{
+				Config: &config.S3,
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported storage backend: %s", name)
+		}
+
+		backends[name] = s
+		return s, nil
+	}
+
+	storage, err := backend(config.Storage.Backend)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Storage.Routes) != 0 {
+		routed := &RoutedStorage{
+			Default: storage,
+			Routes:  make(map[string]Storage),
+		}
+		for typ, name := range config.Storage.Routes {
+			if routed.Routes[typ], err = backend(name); err != nil {
+				return err
+			}
+		}
+		storage = routed
+	}
+
+	cliApp.Storage = storage
+
+	if config.Storage.Encryption.KeyId != "" {
+		cliApp.Storage = &EncryptedStorage{
+			Storage: cliApp.Storage,
+			Config:  &config.Storage.Encryption,
+		}
+	}
+
+	if config.Storage.Compression.Algorithm != "" {
+		cliApp.Storage = &CompressedStorage{
+			Storage: cliApp.Storage,
+			Config:  &config.Storage.Compression,
+		}
+	}
+
+	if config.Cache.Size > 0 || len(config.Cache.Types) > 0 {
+		cliApp.Storage = &CachedStorage{
+			Storage: cliApp.Storage,
+			Config:  &config.Cache,
+		}
 	}
 
 	return nil
 }
 
+// Creates a storage from a spec in the form `<backend>:<path>`, e.g. `bolt:path/to/padlock.db`
+func storageFromSpec(spec string) (Storage, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid storage spec '%s', expected <backend>:<path>", spec)
+	}
+
+	switch parts[0] {
+	case "leveldb":
+		return &LevelDBStorage{Config: &LevelDBConfig{Path: parts[1]}}, nil
+	case "bolt":
+		return &BoltStorage{Config: &BoltConfig{Path: parts[1]}}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported storage backend: %s", parts[0])
+	}
+}
+
 func (cliApp *CliApp) InitServer() error {
 	var storage Storage
 	var sender Sender
 	logger := NewLog(&cliApp.Config.Log, nil)
 
 	if cliApp.Config.Server.Test {
-		storage = &MemoryStorage{}
+		storage = &MemoryStorage{Config: &cliApp.Config.Memory}
 		sender = &RecordSender{}
 		// Also use CORS when in test mode
 		cliApp.Config.Server.Cors = true
@@ -98,19 +199,29 @@ func (cliApp *CliApp) ListAccounts(context *cli.Context) error {
 	}
 	defer cliApp.Storage.Close()
 
+	opts := &PageOptions{
+		Token: context.String("page"),
+		Limit: context.Int("limit"),
+	}
+	if prefix := context.String("prefix"); prefix != "" {
+		opts.Prefix = []byte(prefix)
+	}
+
 	acc := &Account{}
-	iter, err := cliApp.Storage.Iterator(acc)
+	output := ""
+	next, err := IteratePage(cliApp.Storage, acc, opts, func(key []byte) error {
+		output = output + acc.Email + "\n"
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	defer iter.(*LevelDBIterator).Release()
 
-	output := ""
-	for iter.Next() {
-		iter.Get(acc)
-		output = output + acc.Email + "\n"
+	if next != "" {
+		output = output + fmt.Sprintf("\nMore accounts available. Use --page %s to show the next page.\n", next)
 	}
-	fmt.Print(output)
+
+	fmt.Fprint(cliApp.Writer, output)
 
 	return nil
 }
@@ -153,13 +264,89 @@ func (cliApp *CliApp) DisplayAccount(context *cli.Context) error {
 		return err
 	}
 
+	usage, err := GetStoreUsage(cliApp.Storage, acc, cliApp.Config.Server.MaxStoreSize)
+	if err != nil {
+		return err
+	}
+
 	yamlData, err := yaml.Marshal(acc)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(string(yamlData))
+	usageData, err := yaml.Marshal(map[string]*StoreUsage{"usage": usage})
+	if err != nil {
+		return err
+	}
+
+	vaults, err := GetVaults(cliApp.Storage, acc)
+	if err != nil {
+		return err
+	}
 
+	vaultData, err := yaml.Marshal(map[string][]*Vault{"vaults": vaults})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cliApp.Writer, string(yamlData)+string(usageData)+string(vaultData))
+
+	return nil
+}
+
+func (cliApp *CliApp) SetStoreQuota(context *cli.Context) error {
+	email := context.Args().Get(0)
+	size, err := strconv.ParseInt(context.Args().Get(1), 10, 64)
+	if email == "" || err != nil {
+		return errors.New("Please provide an email address and a size in bytes!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	return cliApp.Storage.Update(func(tx StorageTx) error {
+		acc := &Account{Email: email}
+		if err := tx.Get(acc); err != nil {
+			return err
+		}
+
+		acc.MaxStoreSize = size
+
+		return tx.Put(acc)
+	})
+}
+
+func (cliApp *CliApp) ResetTOTP(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return errors.New("Please provide an email address!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	if err := cliApp.Storage.Update(func(tx StorageTx) error {
+		acc := &Account{Email: email}
+		if err := tx.Get(acc); err != nil {
+			return err
+		}
+
+		if acc.TOTP == nil {
+			return fmt.Errorf("Two-factor authentication is not enabled for %s", email)
+		}
+
+		acc.TOTP = nil
+
+		return tx.Put(acc)
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cliApp.Writer, "Turned off two-factor authentication for %s\n", email)
 	return nil
 }
 
@@ -168,14 +355,411 @@ func (cliApp *CliApp) DeleteAccount(context *cli.Context) error {
 	if email == "" {
 		return errors.New("Please provide an email address!")
 	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	return RemoveAccount(cliApp.Storage, email)
+}
+
+func (cliApp *CliApp) ExportAccount(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return errors.New("Please provide an email address!")
+	}
+
+	path := context.Args().Get(1)
+	if path == "" {
+		path = email + ".tar.gz"
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	acc := &Account{Email: email}
+	if err := cliApp.Storage.Get(acc); err != nil {
+		return err
+	}
+
+	export, err := NewAccountExport(cliApp.Storage, acc)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = export.Write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cliApp.Writer, "Exported %d vaults of %s to %s\n", len(export.Manifest.Vaults), email, path)
+	return nil
+}
+
+func (cliApp *CliApp) ImportAccount(context *cli.Context) error {
+	path := context.Args().Get(0)
+	if path == "" {
+		return errors.New("Please provide an export archive to import!")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	export, err := ReadAccountExport(f)
+	if err != nil {
+		return err
+	}
+
+	email := context.String("email")
+	if email == "" {
+		email = export.Manifest.Email
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	// The quota is not enforced for imports by the server admin
+	if err := ImportAccountExport(cliApp.Storage, &Account{Email: email}, export, 0); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cliApp.Writer, "Imported %d vaults into %s\n", len(export.Manifest.Vaults), email)
+	return nil
+}
+
+func (cliApp *CliApp) DisplayHistory(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return errors.New("Please provide an email address!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	acc := &Account{Email: email}
+	vault := context.String("vault")
+	if err := checkVaultExists(cliApp.Storage, acc, vault); err != nil {
+		return err
+	}
+
+	history := &StoreHistory{Account: acc, Vault: vault}
+	if err := cliApp.Storage.Get(history); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	output := ""
+	for i := len(history.Revisions) - 1; i >= 0; i-- {
+		rev := history.Revisions[i]
+		output = output + fmt.Sprintf("%s  %s  %8d bytes  %s\n",
+			rev.Id, rev.Created.Format(time.RFC3339), len(rev.Content), rev.Device)
+	}
+	fmt.Print(output)
+
+	return nil
+}
+
+func (cliApp *CliApp) RestoreRevision(context *cli.Context) error {
+	email := context.Args().Get(0)
+	id := context.Args().Get(1)
+	if email == "" || id == "" {
+		return errors.New("Please provide an email address and a revision id!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
 	acc := &Account{Email: email}
+	vault := context.String("vault")
+	if err := checkVaultExists(cliApp.Storage, acc, vault); err != nil {
+		return err
+	}
+
+	if _, err := RestoreDataStore(cliApp.Storage, acc, vault, id, nil, &cliApp.Config.Server.History, 0); err != nil {
+		if err == ErrNotFound {
+			return fmt.Errorf("No revision %s found for %s", id, email)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (cliApp *CliApp) ListDeletions(context *cli.Context) error {
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	deletions, err := ListPendingDeletions(cliApp.Storage)
+	if err != nil {
+		return err
+	}
+
+	output := ""
+	for _, d := range deletions {
+		vault := d.Vault
+		if d.IsAccount() {
+			vault = "(account)"
+		}
+		output = output + fmt.Sprintf("%s  %s  requested %s  purge %s\n",
+			d.Email, vault, d.Requested.Format(time.RFC3339), d.Purge.Format(time.RFC3339))
+	}
+	fmt.Fprint(cliApp.Writer, output)
+
+	return nil
+}
+
+func (cliApp *CliApp) RestoreDeletion(context *cli.Context) error {
+	email := context.Args().Get(0)
+	if email == "" {
+		return errors.New("Please provide an email address!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	d := &PendingDeletion{Email: email, Vault: context.String("vault")}
+	if err := cliApp.Storage.Get(d); err == ErrNotFound {
+		return fmt.Errorf("No pending deletion found for %s", d.Key())
+	} else if err != nil {
+		return err
+	}
+
+	return cliApp.Storage.Delete(d)
+}
+
+func (cliApp *CliApp) Reencrypt(context *cli.Context) error {
+	var storage *EncryptedStorage
+	for _, s := range storageChain(cliApp.Storage) {
+		if e, ok := s.(*EncryptedStorage); ok {
+			storage = e
+			break
+		}
+	}
+	if storage == nil {
+		return errors.New("Encryption is not configured. Please provide an encryption key id!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	count, err := storage.Reencrypt()
+	fmt.Printf("Reencrypted %d records with key %s\n", count, storage.Config.KeyId)
+
+	return err
+}
+
+func (cliApp *CliApp) Recompress(context *cli.Context) error {
+	var storage *CompressedStorage
+	for _, s := range storageChain(cliApp.Storage) {
+		if c, ok := s.(*CompressedStorage); ok {
+			storage = c
+			break
+		}
+	}
+	if storage == nil {
+		return errors.New("Compression is not configured. Please provide a compression algorithm!")
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	count, err := storage.Recompress()
+	fmt.Printf("Recompressed %d records using %s\n", count, storage.Config.Algorithm)
+
+	return err
+}
+
+func (cliApp *CliApp) UpgradeSchema(context *cli.Context) error {
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	counts, err := UpgradeSchema(cliApp.Storage)
+	for _, typ := range sortedStorableTypes() {
+		if count, ok := counts[StorableTypes[typ]]; ok {
+			fmt.Fprintf(cliApp.Writer, "Upgraded %d %s records to schema version %d\n", count, StorableTypes[typ], schemaVersion(typ))
+		}
+	}
+
+	return err
+}
+
+func (cliApp *CliApp) CheckStorage(context *cli.Context) error {
+	opts := &StorageCheckOptions{
+		Repair:     context.Bool("repair"),
+		RepairData: context.StringSlice("repair-data"),
+	}
+
+	for _, loc := range opts.RepairData {
+		valid := false
+		for _, t := range vaultDataTypes {
+			valid = valid || t == loc
+		}
+		if !valid {
+			return fmt.Errorf("Invalid record type for --repair-data: %s. Supported types are %s", loc, strings.Join(vaultDataTypes, ", "))
+		}
+	}
+
+	if err := cliApp.Storage.Open(); err != nil {
+		return err
+	}
+	defer cliApp.Storage.Close()
+
+	check, err := CheckStorage(cliApp.Storage, opts)
+
+	for _, p := range check.Problems {
+		fmt.Fprintln(cliApp.Writer, p)
+	}
+	for _, typ := range sortedStorableTypes() {
+		if count, ok := check.Checked[StorableTypes[typ]]; ok {
+			fmt.Fprintf(cliApp.Writer, "Checked %d %s records\n", count, StorableTypes[typ])
+		}
+	}
+	fmt.Fprintf(cliApp.Writer, "Found %d problems, repaired %d\n", len(check.Problems), check.Repaired())
+
+	if err != nil {
+		return err
+	}
+
+	if !opts.Repair && len(check.Problems) != 0 {
+		return errors.New("Storage check found problems. Run again with --repair to fix them!")
+	}
+
+	if check.Repaired() != len(check.Problems) {
+		return fmt.Errorf("Some problems affect records holding vault contents and were not repaired. "+
+			"Create a backup and use --repair-data to remove the affected records of the given types (%s)", strings.Join(vaultDataTypes, ", "))
+	}
+
+	return nil
+}
+
+func (cliApp *CliApp) MigrateStorage(context *cli.Context) error {
+	fromSpec := context.String("from")
+	toSpec := context.String("to")
+	if fromSpec == "" || toSpec == "" {
+		return errors.New("Please provide both a source and a target storage!")
+	}
+	if fromSpec == toSpec {
+		return errors.New("Source and target storage must be different!")
+	}
+
+	from, err := storageFromSpec(fromSpec)
+	if err != nil {
+		return err
+	}
+	to, err := storageFromSpec(toSpec)
+	if err != nil {
+		return err
+	}
+
+	if err := from.Open(); err != nil {
+		return err
+	}
+	defer from.Close()
+
+	if err := to.Open(); err != nil {
+		return err
+	}
+	defer to.Close()
+
+	migration := &StorageMigration{
+		From:     from,
+		To:       to,
+		DryRun:   context.Bool("dry-run"),
+		Progress: cliApp.Writer,
+	}
+
+	if migration.DryRun {
+		fmt.Fprintln(cliApp.Writer, "Dry run - no records will be written")
+	}
+
+	if err := migration.Run(); err != nil {
+		return err
+	}
+
+	if migration.DryRun {
+		return nil
+	}
+
+	return migration.Verify()
+}
+
+func (cliApp *CliApp) Backup(context *cli.Context) error {
+	path := context.Args().Get(0)
+	if path == "" {
+		return errors.New("Please provide a file to write the backup to!")
+	}
+
+	var count int
+	var err error
+
+	// Fetch the backup from the running server if its admin interface is enabled, since the storage
+	// can't be opened by another process while it's in use
+	if admin := cliApp.Config.Server.Admin; admin.Addr != "" {
+		count, err = FetchBackupFile(path, admin.Addr, admin.Token)
+	} else {
+		if err := cliApp.Storage.Open(); err != nil {
+			return err
+		}
+		defer cliApp.Storage.Close()
+
+		count, err = WriteBackupFile(path, cliApp.Storage)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cliApp.Writer, "Backed up %d records to %s\n", count, path)
+	return nil
+}
+
+func (cliApp *CliApp) Restore(context *cli.Context) error {
+	path := context.Args().Get(0)
+	if path == "" {
+		return errors.New("Please provide a backup file to restore!")
+	}
 
 	if err := cliApp.Storage.Open(); err != nil {
 		return err
 	}
 	defer cliApp.Storage.Close()
 
-	return cliApp.Storage.Delete(acc)
+	count, err := RestoreBackupFile(path, cliApp.Storage)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cliApp.Writer, "Restored %d records from %s\n", count, path)
+	return nil
 }
 
 func genSecret() (string, error) {
@@ -234,6 +818,13 @@ func NewCliApp() *CliApp {
 			EnvVar:      "PC_NOTIFY_ERRORS",
 			Destination: &config.Log.NotifyErrors,
 		},
+		cli.StringFlag{
+			Name:        "storage",
+			Value:       "leveldb",
+			Usage:       "Storage backend to use (leveldb, bolt, memory or s3)",
+			EnvVar:      "PC_STORAGE",
+			Destination: &config.Storage.Backend,
+		},
 		cli.StringFlag{
 			Name:        "db-path",
 			Value:       "db",
@@ -241,6 +832,109 @@ func NewCliApp() *CliApp {
 			EnvVar:      "PC_LEVELDB_PATH",
 			Destination: &config.LevelDB.Path,
 		},
+		cli.StringFlag{
+			Name:        "bolt-path",
+			Value:       "padlock.db",
+			Usage:       "Path to bolt database file",
+			EnvVar:      "PC_BOLT_PATH",
+			Destination: &config.Bolt.Path,
+		},
+		cli.StringFlag{
+			Name:        "memory-snapshot",
+			Value:       "",
+			Usage:       "Backup archive to populate the in-memory storage with (memory backend or test mode only)",
+			EnvVar:      "PC_MEMORY_SNAPSHOT",
+			Destination: &config.Memory.Snapshot,
+		},
+		cli.BoolFlag{
+			Name:        "memory-persist",
+			Usage:       "Write the in-memory storage back to the snapshot file on shutdown",
+			EnvVar:      "PC_MEMORY_PERSIST",
+			Destination: &config.Memory.Persist,
+		},
+		cli.StringFlag{
+			Name:        "s3-endpoint",
+			Value:       "",
+			Usage:       "Url of the S3-compatible API endpoint",
+			EnvVar:      "PC_S3_ENDPOINT",
+			Destination: &config.S3.Endpoint,
+		},
+		cli.StringFlag{
+			Name:        "s3-region",
+			Value:       "us-east-1",
+			Usage:       "Region used for signing S3 requests",
+			EnvVar:      "PC_S3_REGION",
+			Destination: &config.S3.Region,
+		},
+		cli.StringFlag{
+			Name:        "s3-bucket",
+			Value:       "",
+			Usage:       "Name of the S3 bucket to store records in",
+			EnvVar:      "PC_S3_BUCKET",
+			Destination: &config.S3.Bucket,
+		},
+		cli.StringFlag{
+			Name:        "s3-prefix",
+			Value:       "",
+			Usage:       "Prefix for all object names in the S3 bucket",
+			EnvVar:      "PC_S3_PREFIX",
+			Destination: &config.S3.Prefix,
+		},
+		cli.StringFlag{
+			Name:        "s3-access-key",
+			Value:       "",
+			Usage:       "Access key for the S3 API",
+			EnvVar:      "PC_S3_ACCESS_KEY",
+			Destination: &config.S3.AccessKey,
+		},
+		cli.StringFlag{
+			Name:        "s3-secret-key",
+			Value:       "",
+			Usage:       "Secret key for the S3 API",
+			EnvVar:      "PC_S3_SECRET_KEY",
+			Destination: &config.S3.SecretKey,
+		},
+		cli.DurationFlag{
+			Name:        "s3-timeout",
+			Value:       30 * time.Second,
+			Usage:       "Time limit for requests to the S3 API",
+			EnvVar:      "PC_S3_TIMEOUT",
+			Destination: &config.S3.Timeout,
+		},
+		cli.StringFlag{
+			Name:        "encryption-key-id",
+			Value:       "",
+			Usage:       "Id of the key used for encrypting records at rest. Leave empty to disable encryption",
+			EnvVar:      "PC_ENCRYPTION_KEY_ID",
+			Destination: &config.Storage.Encryption.KeyId,
+		},
+		cli.StringFlag{
+			Name:        "encryption-key-file",
+			Value:       "",
+			Usage:       "File containing line-separated encryption keys in the form <id>:<base64 key>",
+			EnvVar:      "PC_ENCRYPTION_KEY_FILE",
+			Destination: &config.Storage.Encryption.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "compression",
+			Value:       "",
+			Usage:       "Algorithm for compressing data stores (snappy, gzip or none). Leave empty to disable compression",
+			EnvVar:      "PC_COMPRESSION",
+			Destination: &config.Storage.Compression.Algorithm,
+		},
+		cli.BoolFlag{
+			Name:        "compression-strict",
+			Usage:       "Reject records without a compression header. Only enable once all records have been recompressed",
+			EnvVar:      "PC_COMPRESSION_STRICT",
+			Destination: &config.Storage.Compression.Strict,
+		},
+		cli.IntFlag{
+			Name:        "cache-size",
+			Value:       0,
+			Usage:       "Maximum number of records to cache in memory per record type. Set to 0 to disable caching",
+			EnvVar:      "PC_CACHE_SIZE",
+			Destination: &config.Cache.Size,
+		},
 		cli.StringFlag{
 			Name:        "email-server",
 			Value:       "",
@@ -276,6 +970,34 @@ func NewCliApp() *CliApp {
 			EnvVar:      "PC_EMAIL_FROM",
 			Destination: &config.Email.From,
 		},
+		cli.IntFlag{
+			Name:        "history-size",
+			Value:       0,
+			Usage:       "Number of data store revisions to keep per account. Use 0 to disable revision history",
+			EnvVar:      "PC_HISTORY_SIZE",
+			Destination: &config.Server.History.Size,
+		},
+		cli.Int64Flag{
+			Name:        "max-store-size",
+			Value:       0,
+			Usage:       "Maximum storage used by each account in bytes, including history and change logs. Use 0 to disable the limit",
+			EnvVar:      "PC_MAX_STORE_SIZE",
+			Destination: &config.Server.MaxStoreSize,
+		},
+		cli.IntFlag{
+			Name:        "max-vaults",
+			Value:       0,
+			Usage:       "Maximum number of vaults per account, including the default vault. Use 0 to disable the limit",
+			EnvVar:      "PC_MAX_VAULTS",
+			Destination: &config.Server.MaxVaults,
+		},
+		cli.DurationFlag{
+			Name:        "history-max-age",
+			Value:       0,
+			Usage:       "Maximum age of data store revisions to keep, e.g. 720h. Use 0 to keep revisions regardless of age",
+			EnvVar:      "PC_HISTORY_MAX_AGE",
+			Destination: &config.Server.History.MaxAge,
+		},
 		cli.StringFlag{
 			Name:        "whitelist-path",
 			Value:       "",
@@ -351,6 +1073,61 @@ func NewCliApp() *CliApp {
 					EnvVar:      "PC_SKELETON_IP",
 					Destination: &config.Server.SkeletonIP,
 				},
+				cli.BoolFlag{
+					Name:        "metrics",
+					Usage:       "Collect and export metrics in the Prometheus format",
+					EnvVar:      "PC_METRICS",
+					Destination: &config.Server.Metrics.Enabled,
+				},
+				cli.StringFlag{
+					Name:        "metrics-addr",
+					Value:       "",
+					Usage:       "Address to serve metrics on, e.g. 127.0.0.1:9090. If empty, metrics are only served by the admin interface under /metrics",
+					EnvVar:      "PC_METRICS_ADDR",
+					Destination: &config.Server.Metrics.Addr,
+				},
+				cli.StringFlag{
+					Name:        "admin-addr",
+					Value:       "",
+					Usage:       "Address to serve the admin interface on, e.g. 127.0.0.1:3001. Leave empty to disable the admin interface",
+					EnvVar:      "PC_ADMIN_ADDR",
+					Destination: &config.Server.Admin.Addr,
+				},
+				cli.StringFlag{
+					Name:        "admin-token",
+					Value:       "",
+					Usage:       "Token required for accessing the admin interface",
+					EnvVar:      "PC_ADMIN_TOKEN",
+					Destination: &config.Server.Admin.Token,
+				},
+				cli.StringFlag{
+					Name:        "backup-dir",
+					Value:       "",
+					Usage:       "Directory for scheduled backups. Leave empty to disable scheduled backups",
+					EnvVar:      "PC_BACKUP_DIR",
+					Destination: &config.Server.Backup.Dir,
+				},
+				cli.DurationFlag{
+					Name:        "backup-interval",
+					Value:       24 * time.Hour,
+					Usage:       "Time between scheduled backups",
+					EnvVar:      "PC_BACKUP_INTERVAL",
+					Destination: &config.Server.Backup.Interval,
+				},
+				cli.IntFlag{
+					Name:        "backup-keep",
+					Value:       7,
+					Usage:       "Number of scheduled backups to keep. Use 0 to keep all backups",
+					EnvVar:      "PC_BACKUP_KEEP",
+					Destination: &config.Server.Backup.Keep,
+				},
+				cli.DurationFlag{
+					Name:        "deletion-grace-period",
+					Value:       0,
+					Usage:       "Time during which deleted accounts and vaults can still be restored. Use 0 to delete data immediately",
+					EnvVar:      "PC_DELETION_GRACE_PERIOD",
+					Destination: &config.Server.DeletionGracePeriod,
+				},
 			},
 			Action: cliApp.RunServer,
 		},
@@ -359,8 +1136,22 @@ func NewCliApp() *CliApp {
 			Usage: "Commands for managing accounts",
 			Subcommands: []cli.Command{
 				{
-					Name:   "list",
-					Usage:  "List existing accounts",
+					Name:  "list",
+					Usage: "List existing accounts, sorted by email",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "prefix",
+							Usage: "Only list accounts with emails starting with this prefix",
+						},
+						cli.IntFlag{
+							Name:  "limit",
+							Usage: "Maximum number of accounts to list. Use 0 to list all accounts",
+						},
+						cli.StringFlag{
+							Name:  "page",
+							Usage: "Token for continuing a previous listing",
+						},
+					},
 					Action: cliApp.ListAccounts,
 				},
 				{
@@ -373,12 +1164,170 @@ func NewCliApp() *CliApp {
 					Usage:  "Display account",
 					Action: cliApp.DisplayAccount,
 				},
+				{
+					Name:      "set-quota",
+					Usage:     "Set the maximum data store size for an account. Use 0 for the server default and -1 for no limit",
+					ArgsUsage: "email bytes",
+					Action:    cliApp.SetStoreQuota,
+				},
+				{
+					Name:      "reset-totp",
+					Usage:     "Turn off two-factor authentication for an account, e.g. if the owner lost their device and recovery codes",
+					ArgsUsage: "email",
+					Action:    cliApp.ResetTOTP,
+				},
 				{
 					Name:   "delete",
 					Usage:  "Delete account",
 					Action: cliApp.DeleteAccount,
 				},
+				{
+					Name:      "export",
+					Usage:     "Export all data of an account to an archive. Defaults to {email}.tar.gz",
+					ArgsUsage: "email [file]",
+					Action:    cliApp.ExportAccount,
+				},
+				{
+					Name:      "import",
+					Usage:     "Import the vaults contained in an export archive, creating the account if necessary",
+					ArgsUsage: "file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "email",
+							Usage: "Account to import into. Defaults to the account the archive was exported from",
+						},
+					},
+					Action: cliApp.ImportAccount,
+				},
+				{
+					Name:      "history",
+					Usage:     "List previous revisions of an accounts data store",
+					ArgsUsage: "email",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "vault",
+							Usage: "Name of the vault. Defaults to the default vault",
+						},
+					},
+					Action: cliApp.DisplayHistory,
+				},
+				{
+					Name:      "restore",
+					Usage:     "Restore a previous revision of an accounts data store",
+					ArgsUsage: "email revision",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "vault",
+							Usage: "Name of the vault. Defaults to the default vault",
+						},
+					},
+					Action: cliApp.RestoreRevision,
+				},
+			},
+		},
+		{
+			Name:  "deletions",
+			Usage: "Commands for managing pending deletions of accounts and vaults",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List pending deletions along with the time they will be carried out",
+					Action: cliApp.ListDeletions,
+				},
+				{
+					Name:      "restore",
+					Usage:     "Cancel the pending deletion of an account or, with --vault, one of its vaults",
+					ArgsUsage: "email",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "vault",
+							Usage: "Name of the vault. Use 'default' for a reset of the default vault",
+						},
+					},
+					Action: cliApp.RestoreDeletion,
+				},
+			},
+		},
+		{
+			Name:  "storage",
+			Usage: "Commands for maintaining the storage",
+			Subcommands: []cli.Command{
+				{
+					Name:   "reencrypt",
+					Usage:  "Encrypt all records with the current encryption key",
+					Action: cliApp.Reencrypt,
+				},
+				{
+					Name:   "recompress",
+					Usage:  "Compress all records with the current compression algorithm",
+					Action: cliApp.Recompress,
+				},
+				{
+					Name:   "upgrade",
+					Usage:  "Rewrite all records to the current schema version. Stop the server before running this",
+					Action: cliApp.UpgradeSchema,
+				},
+				{
+					Name:  "migrate",
+					Usage: "Copy all records to another storage. Can be run again to resume an interrupted migration",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "from",
+							Usage: "Source storage in the form <backend>:<path>, e.g. leveldb:db",
+						},
+						cli.StringFlag{
+							Name:  "to",
+							Usage: "Target storage in the form <backend>:<path>, e.g. bolt:padlock.db",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Only report what would be copied without writing anything",
+						},
+					},
+					Action: cliApp.MigrateStorage,
+				},
+				{
+					Name:  "check",
+					Usage: "Check all records for problems like orphaned data stores or invalid auth tokens",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "repair",
+							Usage: "Remove affected records and auth tokens. Stop the server and create a backup before running this",
+						},
+						cli.StringSliceFlag{
+							Name:  "repair-data",
+							Usage: "Also remove affected records of the given type holding vault contents (data-stores, data-store-history, data-store-changes or data-store-change-records). Can be repeated",
+						},
+					},
+					Action: cliApp.CheckStorage,
+				},
+			},
+		},
+		{
+			Name:      "backup",
+			Usage:     "Write all records to a backup archive",
+			ArgsUsage: "file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "admin-addr",
+					Usage:       "Address of the admin interface of a running server to fetch the backup from",
+					EnvVar:      "PC_ADMIN_ADDR",
+					Destination: &config.Server.Admin.Addr,
+				},
+				cli.StringFlag{
+					Name:        "admin-token",
+					Usage:       "Token for accessing the admin interface",
+					EnvVar:      "PC_ADMIN_TOKEN",
+					Destination: &config.Server.Admin.Token,
+				},
 			},
+			Action: cliApp.Backup,
+		},
+		{
+			Name:      "restore",
+			Usage:     "Restore all records from a backup archive",
+			ArgsUsage: "file",
+			Action:    cliApp.Restore,
 		},
 		{
 			Name:   "gensecret",
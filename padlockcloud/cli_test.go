@@ -16,12 +16,12 @@ func NewSampleConfig(dir string) CliConfig {
 	secret, _ := genSecret()
 
 	return CliConfig{
-		LogConfig{
+		Log: LogConfig{
 			LogFile:      logfile,
 			ErrFile:      errfile,
 			NotifyErrors: "notify@padlock.io",
 		},
-		ServerConfig{
+		Server: ServerConfig{
 			AssetsPath: "../assets",
 			Port:       5555,
 			TLSCert:    "",
@@ -29,10 +29,16 @@ func NewSampleConfig(dir string) CliConfig {
 			BaseUrl:    "http://example.com",
 			Secret:     secret,
 		},
-		LevelDBConfig{
+		Storage: StorageConfig{
+			Backend: "leveldb",
+		},
+		LevelDB: LevelDBConfig{
 			Path: dbpath,
 		},
-		EmailConfig{
+		Bolt: BoltConfig{
+			Path: filepath.Join(dir, "padlock.db"),
+		},
+		Email: EmailConfig{
 			User:     "emailuser",
 			Password: "emailpassword",
 			Server:   "myemailserver.com",
@@ -126,3 +132,85 @@ func TestCliConfigFile(t *testing.T) {
 
 	app.Server.Stop(time.Second)
 }
+
+func TestCliStorageBackend(t *testing.T) {
+	cfg := NewSampleConfig("")
+	app := NewCliApp()
+
+	if err := app.InitWithConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := app.Storage.(*LevelDBStorage); !ok {
+		t.Fatalf("Expected LevelDB storage, got %T", app.Storage)
+	}
+
+	cfg.Storage.Backend = "bolt"
+	if err := app.InitWithConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := app.Storage.(*BoltStorage); !ok || s.Config.Path != cfg.Bolt.Path {
+		t.Fatalf("Expected bolt storage at %s, got %T", cfg.Bolt.Path, app.Storage)
+	}
+
+	cfg.Storage.Encryption.KeyId = "key1"
+	if err := app.InitWithConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := app.Storage.(*EncryptedStorage); !ok {
+		t.Fatalf("Expected encrypted storage, got %T", app.Storage)
+	} else if _, ok := s.Storage.(*BoltStorage); !ok {
+		t.Fatalf("Expected encrypted storage to wrap bolt storage, got %T", s.Storage)
+	}
+
+	// Records should be compressed before being encrypted, with the cache in front of both
+	cfg.Storage.Compression.Algorithm = "snappy"
+	cfg.Cache.Size = 100
+	if err := app.InitWithConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	chain := storageChain(app.Storage)
+	if len(chain) != 4 {
+		t.Fatalf("Expected 4 storage layers, got %d", len(chain))
+	}
+	if _, ok := chain[0].(*CachedStorage); !ok {
+		t.Fatalf("Expected cached storage, got %T", chain[0])
+	}
+	if _, ok := chain[1].(*CompressedStorage); !ok {
+		t.Fatalf("Expected compressed storage, got %T", chain[1])
+	}
+	if _, ok := chain[2].(*EncryptedStorage); !ok {
+		t.Fatalf("Expected encrypted storage, got %T", chain[2])
+	}
+
+	// Routed types should share backends of the same name
+	cfg = CliConfig{}
+	cfg.Storage.Backend = "bolt"
+	cfg.Storage.Routes = map[string]string{
+		"auth-requests":      "memory",
+		"data-stores":        "s3",
+		"data-store-history": "s3",
+	}
+	if err := app.InitWithConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := app.Storage.(*RoutedStorage); !ok {
+		t.Fatalf("Expected routed storage, got %T", app.Storage)
+	} else if _, ok := s.Default.(*BoltStorage); !ok {
+		t.Fatalf("Expected bolt storage as default, got %T", s.Default)
+	} else if _, ok := s.Routes["auth-requests"].(*MemoryStorage); !ok {
+		t.Fatalf("Expected auth requests to be routed to memory storage, got %T", s.Routes["auth-requests"])
+	} else if s3, ok := s.Routes["data-stores"].(*S3Storage); !ok || s.Routes["data-store-history"] != s3 {
+		t.Fatal("Expected data stores and their history to be routed to the same s3 storage")
+	}
+
+	cfg.Storage.Routes["data-stores"] = "unknown"
+	if err := app.InitWithConfig(&cfg); err == nil {
+		t.Fatal("Unsupported storage backends in routes should result in an error")
+	}
+
+	cfg.Storage.Routes = nil
+	cfg.Storage.Backend = "unknown"
+	if err := app.InitWithConfig(&cfg); err == nil {
+		t.Fatal("Unsupported storage backends should result in an error")
+	}
+}
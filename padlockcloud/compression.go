@@ -0,0 +1,306 @@
+package padlockcloud
+
+import "io"
+import "fmt"
+import "bytes"
+import "errors"
+import "reflect"
+import "io/ioutil"
+import "compress/gzip"
+import "github.com/golang/snappy"
+
+// Prefix of the header written in front of every record by `CompressedStorage`. Followed by a single
+// byte identifying the compression algorithm
+var compressionMagic = []byte("\x00PCZ")
+
+// Supported compression algorithms along with the header bytes identifying them
+var compressionAlgorithms = map[string]byte{
+	"none":   0,
+	"snappy": 1,
+	"gzip":   2,
+}
+
+// Returned when reading a record without a compression header in strict mode
+var ErrMissingCompressionHeader = errors.New("padlock: record has no compression header")
+
+// Record types compressed by default
+var defaultCompressedTypes = []string{"data-stores", "data-store-history", "data-store-changes", "data-store-change-records"}
+
+type CompressionConfig struct {
+	// Algorithm used for compressing records. Supported values are "snappy", "gzip" and "none".
+	// With "none", records are written uncompressed but compressed records can still be read
+	Algorithm string `yaml:"algorithm"`
+	// Identifiers of the record types to compress. Defaults to data stores and their history
+	Types []string `yaml:"types"`
+	// Reject records without a compression header, i.e. records written before compression was enabled
+	// for their type, with `ErrMissingCompressionHeader` instead of reading them as is. Should only be
+	// enabled once all records have been rewritten via `CompressedStorage.Recompress`
+	Strict bool `yaml:"strict"`
+}
+
+// Implementation of the `Storage` interface that wraps another storage, compressing records of the
+// configured types before handing them over. Every record is written with a header identifying the
+// algorithm, even if it is stored uncompressed. Records without a header are read as is unless strict
+// mode is enabled, so compression can be enabled for existing databases and applied to all records via
+// `Recompress`
+type CompressedStorage struct {
+	Storage
+	Config *CompressionConfig
+	types  map[reflect.Type]bool
+}
+
+// Implementation of the `Storage.Open` interface method
+func (s *CompressedStorage) Open() error {
+	if _, ok := compressionAlgorithms[s.Config.Algorithm]; !ok {
+		return fmt.Errorf("Unsupported compression algorithm: %s", s.Config.Algorithm)
+	}
+
+	names := s.Config.Types
+	if len(names) == 0 {
+		names = defaultCompressedTypes
+	}
+
+	known := make(map[string]reflect.Type)
+	for typ, loc := range StorableTypes {
+		known[loc] = typ
+	}
+
+	types := make(map[reflect.Type]bool)
+	for _, name := range names {
+		typ, ok := known[name]
+		if !ok {
+			return fmt.Errorf("Unknown record type in compression config: %s", name)
+		}
+		types[typ] = true
+	}
+	s.types = types
+
+	return s.Storage.Open()
+}
+
+func (s *CompressedStorage) backend() Storage {
+	return s.Storage
+}
+
+// Returns the algorithm given in the header of a record or an empty string if the record has no header
+func compressionAlgorithm(data []byte) string {
+	if len(data) <= len(compressionMagic) || !bytes.HasPrefix(data, compressionMagic) {
+		return ""
+	}
+
+	for name, b := range compressionAlgorithms {
+		if data[len(compressionMagic)] == b {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// Compresses data using the given algorithm and prepends the header identifying it. With "none", the
+// header is followed by the data as is
+func compress(algorithm string, data []byte) ([]byte, error) {
+	b, ok := compressionAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported compression algorithm: %s", algorithm)
+	}
+
+	out := append(append([]byte{}, compressionMagic...), b)
+
+	switch algorithm {
+	case "none":
+		return append(out, data...), nil
+	case "snappy":
+		return append(out, snappy.Encode(nil, data)...), nil
+	default:
+		buf := bytes.NewBuffer(out)
+		gz := gzip.NewWriter(buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// Decompresses data according to its header. Data without a header is returned unchanged unless `strict`
+// is true, in which case it is rejected with `ErrMissingCompressionHeader`
+func decompress(data []byte, strict bool) ([]byte, error) {
+	algorithm := compressionAlgorithm(data)
+	if algorithm == "" {
+		if strict {
+			return nil, ErrMissingCompressionHeader
+		}
+		return data, nil
+	}
+
+	data = data[len(compressionMagic)+1:]
+
+	switch algorithm {
+	case "none":
+		return data, nil
+	case "snappy":
+		return snappy.Decode(nil, data)
+	default:
+		return gunzip(bytes.NewReader(data))
+	}
+}
+
+// Reads and decompresses gzip-compressed data
+func gunzip(r io.Reader) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return ioutil.ReadAll(gz)
+}
+
+func (s *CompressedStorage) wrap(t Storable) Storable {
+	if t == nil || !s.types[typeFromStorable(t)] {
+		return t
+	}
+	return &compressedStorable{t, s}
+}
+
+// Implementation of the `Storage.Get` interface method
+func (s *CompressedStorage) Get(t Storable) error {
+	return s.Storage.Get(s.wrap(t))
+}
+
+// Implementation of the `Storage.Put` interface method
+func (s *CompressedStorage) Put(t Storable) error {
+	return s.Storage.Put(s.wrap(t))
+}
+
+// Implementation of the `Storage.Iterator` interface method
+func (s *CompressedStorage) Iterator(t Storable) (StorageIterator, error) {
+	iter, err := s.Storage.Iterator(t)
+	if err != nil {
+		return nil, err
+	}
+	if !s.types[typeFromStorable(t)] {
+		return iter, nil
+	}
+	return &compressedIterator{iter, s}, nil
+}
+
+// Implementation of the `Storage.Update` interface method
+func (s *CompressedStorage) Update(fn func(StorageTx) error) error {
+	return s.Storage.Update(func(tx StorageTx) error {
+		return fn(&compressedTx{tx, s})
+	})
+}
+
+// Compresses all records of the configured types that are not yet compressed with the current
+// algorithm, returning the number of updated records. Records without a header are rewritten even in
+// strict mode
+func (s *CompressedStorage) Recompress() (int, error) {
+	if s.types == nil {
+		return 0, ErrStorageClosed
+	}
+
+	count := 0
+
+	for _, typ := range sortedStorableTypes() {
+		if !s.types[typ] {
+			continue
+		}
+
+		iter, err := s.Storage.Iterator(&rawStorable{typ: typ})
+		if err != nil {
+			return count, err
+		}
+
+		for iter.Next() {
+			raw := &rawStorable{typ: typ, key: append([]byte{}, iter.Key()...)}
+			if err := iter.Get(raw); err != nil {
+				iter.Release()
+				return count, err
+			}
+
+			if compressionAlgorithm(raw.data) == s.Config.Algorithm {
+				continue
+			}
+
+			data, err := decompress(raw.data, false)
+			if err == nil {
+				raw.data, err = compress(s.Config.Algorithm, data)
+			}
+			if err == nil {
+				err = s.Storage.Put(raw)
+			}
+			if err != nil {
+				iter.Release()
+				return count, fmt.Errorf("Failed to recompress %s record %s: %v", StorableTypes[typ], raw.key, err)
+			}
+
+			count++
+		}
+
+		err = iter.Error()
+		iter.Release()
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// Wraps a `Storable`, compressing it on serialization and decompressing it on deserialization
+type compressedStorable struct {
+	Storable
+	storage *CompressedStorage
+}
+
+func (c *compressedStorable) storableType() reflect.Type {
+	return typeFromStorable(c.Storable)
+}
+
+func (c *compressedStorable) Serialize() ([]byte, error) {
+	data, err := c.Storable.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return compress(c.storage.Config.Algorithm, data)
+}
+
+func (c *compressedStorable) Deserialize(data []byte) error {
+	data, err := decompress(data, c.storage.Config.Strict)
+	if err != nil {
+		return err
+	}
+	return c.Storable.Deserialize(data)
+}
+
+// Iterator that decompresses records before populating `Storable` objects
+type compressedIterator struct {
+	StorageIterator
+	storage *CompressedStorage
+}
+
+func (iter *compressedIterator) Get(t Storable) error {
+	return iter.StorageIterator.Get(&compressedStorable{t, iter.storage})
+}
+
+// Implementation of the `StorageTx` interface for `CompressedStorage`
+type compressedTx struct {
+	tx      StorageTx
+	storage *CompressedStorage
+}
+
+func (tx *compressedTx) Get(t Storable) error {
+	return tx.tx.Get(tx.storage.wrap(t))
+}
+
+func (tx *compressedTx) Put(t Storable) error {
+	return tx.tx.Put(tx.storage.wrap(t))
+}
+
+func (tx *compressedTx) Delete(t Storable) error {
+	return tx.tx.Delete(t)
+}
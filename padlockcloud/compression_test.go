@@ -0,0 +1,166 @@
+package padlockcloud
+
+import "testing"
+import "bytes"
+import "strings"
+
+func TestCompressedStorage(t *testing.T) {
+	for _, algorithm := range []string{"none", "snappy", "gzip"} {
+		t.Run(algorithm, func(t *testing.T) {
+			testStorage(t, &CompressedStorage{
+				Storage: &MemoryStorage{},
+				Config:  &CompressionConfig{Algorithm: algorithm, Types: []string{"mystrbl", "mykeyedstrbl"}},
+			})
+		})
+	}
+}
+
+func TestCompressionHeader(t *testing.T) {
+	backend := &MemoryStorage{}
+	config := &CompressionConfig{Algorithm: "none", Types: []string{"mykeyedstrbl"}}
+	storage := &CompressedStorage{Storage: backend, Config: config}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	// Content that looks like a compressed record should be read back unchanged
+	value := "\x00PCZ\x01not actually compressed"
+	if err := storage.Put(&testKeyedStrbl{"key", value}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := &rawStorable{typ: typeFromStorable(&testKeyedStrbl{}), key: []byte("key")}
+	if err := backend.Get(raw); err != nil {
+		t.Fatal(err)
+	}
+	if compressionAlgorithm(raw.data) != "none" {
+		t.Fatal("Expected header to be written for uncompressed records")
+	}
+
+	s := &testKeyedStrbl{Name: "key"}
+	if err := storage.Get(s); err != nil || s.Value != value {
+		t.Fatalf("Expected original value, got '%s' (%v)", s.Value, err)
+	}
+
+	// Records without a header should be read as is unless strict mode is enabled
+	if err := backend.Put(&testKeyedStrbl{"legacy", "value"}); err != nil {
+		t.Fatal(err)
+	}
+	s = &testKeyedStrbl{Name: "legacy"}
+	if err := storage.Get(s); err != nil || s.Value != "value" {
+		t.Fatalf("Expected legacy value, got '%s' (%v)", s.Value, err)
+	}
+
+	config.Strict = true
+	if err := storage.Get(&testKeyedStrbl{Name: "legacy"}); err != ErrMissingCompressionHeader {
+		t.Fatalf("Expected ErrMissingCompressionHeader, got %v", err)
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	backend := &MemoryStorage{}
+	config := &CompressionConfig{Algorithm: "none", Types: []string{"mykeyedstrbl"}}
+	storage := &CompressedStorage{Storage: backend, Config: config}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	value := strings.Repeat("compressible ", 100)
+	if err := storage.Put(&testKeyedStrbl{"uncompressed", value}); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Algorithm = "snappy"
+	if err := storage.Put(&testKeyedStrbl{"snappy", value}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written before compression was enabled
+	if err := backend.Put(&testKeyedStrbl{"legacy", value}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := &rawStorable{typ: typeFromStorable(&testKeyedStrbl{}), key: []byte("uncompressed")}
+	if err := backend.Get(raw); err != nil {
+		t.Fatal(err)
+	}
+	if compressionAlgorithm(raw.data) != "none" {
+		t.Fatal("Expected record to be stored uncompressed")
+	}
+
+	// Records without a header should be recompressed even in strict mode
+	config.Algorithm = "gzip"
+	config.Strict = true
+	if count, err := storage.Recompress(); err != nil || count != 3 {
+		t.Fatalf("Expected 3 records to be recompressed, got %d (%v)", count, err)
+	}
+
+	// Running it again should be a no-op
+	if count, err := storage.Recompress(); err != nil || count != 0 {
+		t.Fatalf("Expected no records to be recompressed, got %d (%v)", count, err)
+	}
+
+	for _, name := range []string{"uncompressed", "snappy", "legacy"} {
+		raw := &rawStorable{typ: typeFromStorable(&testKeyedStrbl{}), key: []byte(name)}
+		if err := backend.Get(raw); err != nil {
+			t.Fatal(err)
+		}
+		if compressionAlgorithm(raw.data) != "gzip" || len(raw.data) >= len(value) {
+			t.Fatalf("Expected record %s to be compressed with gzip", name)
+		}
+
+		s := &testKeyedStrbl{Name: name}
+		if err := storage.Get(s); err != nil || s.Value != value {
+			t.Fatalf("Expected original value, got '%s' (%v)", s.Value, err)
+		}
+	}
+
+	// Records of types that are not configured for compression should be left alone
+	var str testStrbl = "value"
+	if err := storage.Put(&str); err != nil {
+		t.Fatal(err)
+	}
+	raw = &rawStorable{typ: typeFromStorable(&str), key: str.Key()}
+	if err := backend.Get(raw); err != nil || !bytes.Equal(raw.data, []byte("value")) {
+		t.Fatalf("Expected record to be stored as is, got '%s' (%v)", raw.data, err)
+	}
+}
+
+func TestCompressedEncryptedStorage(t *testing.T) {
+	backend := &MemoryStorage{}
+	storage := &CompressedStorage{
+		Storage: &EncryptedStorage{
+			Storage: backend,
+			Config: &EncryptionConfig{
+				KeyId: "key1",
+				Keys:  map[string]string{"key1": newTestEncryptionKey()},
+			},
+		},
+		Config: &CompressionConfig{Algorithm: "snappy", Types: []string{"mykeyedstrbl"}},
+	}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	value := strings.Repeat("compressible ", 100)
+	if err := storage.Put(&testKeyedStrbl{"key", value}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records should be compressed before being encrypted
+	raw := &rawStorable{typ: typeFromStorable(&testKeyedStrbl{}), key: []byte("key")}
+	if err := backend.Get(raw); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := encryptionKeyId(raw.data); id != "key1" || len(raw.data) >= len(value) {
+		t.Fatalf("Expected record to be compressed and encrypted")
+	}
+
+	s := &testKeyedStrbl{Name: "key"}
+	if err := storage.Get(s); err != nil || s.Value != value {
+		t.Fatalf("Expected original value, got '%s' (%v)", s.Value, err)
+	}
+}
@@ -0,0 +1,292 @@
+package padlockcloud
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PendingDeletion marks an account or one of its vaults as scheduled for deletion. The data itself remains
+// untouched until the grace period has passed and the deletion is carried out by `Server.PurgeDeletions`,
+// so it can be restored in the meantime
+type PendingDeletion struct {
+	Email string
+	// Name of the vault to delete, `DefaultVault` for resetting the default vault. Empty if the whole
+	// account is deleted
+	Vault string
+	// Secret for cancelling the deletion via the link sent to the account owner
+	Token string
+	// Time the deletion was requested
+	Requested time.Time
+	// Time after which the deletion is carried out
+	Purge time.Time
+}
+
+// Implementation of the `Storable.Key` interface method
+func (d *PendingDeletion) Key() []byte {
+	if d.Vault == "" {
+		return []byte(d.Email)
+	}
+	return []byte(d.Email + "/" + d.Vault)
+}
+
+// Implementation of the `Storable.Deserialize` interface method
+func (d *PendingDeletion) Deserialize(data []byte) error {
+	return unmarshalVersioned(d, data, d)
+}
+
+// Implementation of the `Storable.Serialize` interface method
+func (d *PendingDeletion) Serialize() ([]byte, error) {
+	return marshalVersioned(d, d)
+}
+
+// Returns true if the whole account is scheduled for deletion rather than a single vault
+func (d *PendingDeletion) IsAccount() bool {
+	return d.Vault == ""
+}
+
+// Returns true if the grace period has passed
+func (d *PendingDeletion) Due() bool {
+	return !d.Purge.After(time.Now())
+}
+
+// Returns the token for cancelling the deletion, which identifies the deletion along with its secret
+func (d *PendingDeletion) UndoToken() string {
+	return base64.RawURLEncoding.EncodeToString(d.Key()) + "." + d.Token
+}
+
+// Returns the link for cancelling the deletion
+func (d *PendingDeletion) UndoLink(baseUrl string) string {
+	return fmt.Sprintf("%s/undelete/?t=%s", baseUrl, d.UndoToken())
+}
+
+// Parses a token as returned by `PendingDeletion.UndoToken`. Returns the deletion it refers to along with
+// the secret, which still needs to be verified
+func parseUndoToken(s string) (*PendingDeletion, string, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, "", ErrNotFound
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, "", ErrNotFound
+	}
+
+	email, vault := splitVaultKey(key)
+	return &PendingDeletion{Email: email, Vault: vault}, parts[1], nil
+}
+
+func (d *PendingDeletion) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"email":     d.Email,
+		"vault":     d.Vault,
+		"undoToken": d.UndoToken(),
+		"requested": d.Requested,
+		"purge":     d.Purge,
+	}
+}
+
+// Schedules the account with the given email or, if `vault` is not empty, one of its vaults for deletion
+// after `grace` has passed. If a deletion is already pending, it is returned unchanged
+func ScheduleDeletion(storage Storage, email string, vault string, grace time.Duration) (*PendingDeletion, error) {
+	var d *PendingDeletion
+
+	if err := storage.Update(func(tx StorageTx) error {
+		var err error
+		d, err = scheduleDeletion(tx, email, vault, grace)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func scheduleDeletion(tx StorageTx, email string, vault string, grace time.Duration) (*PendingDeletion, error) {
+	d := &PendingDeletion{Email: email, Vault: vault}
+
+	if err := tx.Get(d); err == nil {
+		return d, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	token, err := token()
+	if err != nil {
+		return nil, err
+	}
+
+	d.Token = token
+	d.Requested = time.Now()
+	d.Purge = d.Requested.Add(grace)
+
+	return d, tx.Put(d)
+}
+
+// Cancels the pending deletion referred to by an undo token. Returns `ErrNotFound` if no such deletion
+// is pending or the token is invalid
+func CancelDeletion(storage Storage, undoToken string) (*PendingDeletion, error) {
+	d, token, err := parseUndoToken(undoToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storage.Update(func(tx StorageTx) error {
+		if err := tx.Get(d); err != nil {
+			return err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(d.Token), []byte(token)) != 1 {
+			return ErrNotFound
+		}
+
+		return tx.Delete(d)
+	}); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Lists the deletions pending for an account, the deletion of the account itself first
+func GetPendingDeletions(storage Storage, email string) ([]*PendingDeletion, error) {
+	var deletions []*PendingDeletion
+
+	acc := &PendingDeletion{Email: email}
+	if err := storage.Get(acc); err == nil {
+		deletions = append(deletions, acc)
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	iter, err := storage.Iterator(&PendingDeletion{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	vaults := NewPrefixIterator(iter, []byte(email+"/"))
+	for vaults.Next() {
+		d := &PendingDeletion{}
+		if err := vaults.Get(d); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+
+	return deletions, nil
+}
+
+// Lists all pending deletions
+func ListPendingDeletions(storage Storage) ([]*PendingDeletion, error) {
+	iter, err := storage.Iterator(&PendingDeletion{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var deletions []*PendingDeletion
+	for iter.Next() {
+		d := &PendingDeletion{}
+		if err := iter.Get(d); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+
+	return deletions, nil
+}
+
+// Notifies the account owner about a scheduled deletion, including a link for undoing it
+func (server *Server) SendDeletionEmail(r *http.Request, d *PendingDeletion) error {
+	var body bytes.Buffer
+	if err := server.Templates.DeletionEmail.Execute(&body, map[string]interface{}{
+		"email":     d.Email,
+		"vault":     d.Vault,
+		"purge":     d.Purge.Format("January 2, 2006 at 15:04 MST"),
+		"undo_link": d.UndoLink(server.BaseUrl(r)),
+	}); err != nil {
+		return err
+	}
+
+	subject := "Your Padlock Cloud account is scheduled for deletion"
+	if !d.IsAccount() {
+		subject = fmt.Sprintf("Your vault \"%s\" is scheduled for deletion", d.Vault)
+	}
+
+	go func() {
+		if err := server.SendEmail(d.Email, subject, body.String()); err != nil {
+			server.LogError(&ServerError{err}, r)
+		}
+	}()
+
+	return nil
+}
+
+// Carries out all deletions whose grace period has passed. Returns the number of deletions performed
+func (server *Server) PurgeDeletions() (int, error) {
+	deletions, err := ListPendingDeletions(server.Storage)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, d := range deletions {
+		if !d.Due() {
+			continue
+		}
+
+		if d.IsAccount() {
+			err = server.DeleteAccount(d.Email)
+		} else {
+			err = server.purgeVault(d)
+		}
+		if err != nil {
+			return n, err
+		}
+
+		// The record is usually removed along with the data, but make sure it doesn't linger
+		if err := server.Storage.Delete(d); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+func (server *Server) purgeVault(d *PendingDeletion) error {
+	acc := &Account{Email: d.Email}
+	data := &DataStore{Account: acc, Vault: d.Vault}
+	if d.Vault == DefaultVault {
+		data.Vault = ""
+	}
+
+	recipients, err := server.storeEventRecipients(data)
+	if err != nil {
+		return err
+	}
+
+	if err := DeleteVault(server.Storage, acc, d.Vault); err != nil {
+		// The vault may have been deleted through the api in the meantime
+		if _, ok := err.(*VaultNotFound); ok {
+			return nil
+		}
+		return err
+	}
+
+	server.Events.Publish(NewStoreEvent(StoreEventDelete, data, nil), recipients...)
+
+	return nil
+}
+
+func init() {
+	RegisterStorable(&PendingDeletion{}, "pending-deletions")
+	RegisterSchema(&PendingDeletion{})
+}
@@ -0,0 +1,358 @@
+package padlockcloud
+
+import "fmt"
+import "bytes"
+import "errors"
+import "reflect"
+import "strings"
+import "io/ioutil"
+import "crypto/aes"
+import "crypto/cipher"
+import "encoding/base64"
+
+// Prefix identifying records encrypted by `EncryptedStorage`
+var encryptionMagic = []byte("\x00PCE\x01")
+
+// Error singletons
+var (
+	// A record was encrypted with a key that is not known to the storage
+	ErrUnknownEncryptionKey = errors.New("padlock: unknown encryption key")
+	// An encrypted record could not be parsed or authenticated
+	ErrInvalidCiphertext = errors.New("padlock: invalid ciphertext")
+)
+
+type EncryptionConfig struct {
+	// Id of the key used for encrypting records. Encryption is disabled if empty
+	KeyId string `yaml:"key_id"`
+	// Base64-encoded AES keys (16, 24 or 32 bytes) mapped by their ids. Keys no longer used for encrypting
+	// should be kept around until all records have been reencrypted
+	Keys map[string]string `yaml:"keys"`
+	// Path to a file containing additional keys, one `<id>:<base64 key>` pair per line
+	KeyFile string `yaml:"key_file"`
+}
+
+// Loads the keys from the config and the key file
+func (c *EncryptionConfig) loadKeys() (map[string]cipher.AEAD, error) {
+	encoded := make(map[string]string)
+	for id, key := range c.Keys {
+		encoded[id] = key
+	}
+
+	if c.KeyFile != "" {
+		data, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("Invalid line in key file %s", c.KeyFile)
+			}
+			encoded[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	keys := make(map[string]cipher.AEAD)
+	for id, key := range encoded {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("Invalid encryption key id: '%s'", id)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption key %s: %v", id, err)
+		}
+
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption key %s: %v", id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[id] = aead
+	}
+
+	if _, ok := keys[c.KeyId]; !ok {
+		return nil, fmt.Errorf("No encryption key found for key id %s", c.KeyId)
+	}
+
+	return keys, nil
+}
+
+// Implementation of the `Storage` interface that wraps another storage, encrypting each record
+// with AES-GCM before handing it over. Records that have not been encrypted yet are read as is,
+// so encryption can be enabled for existing databases and applied to all records via `Reencrypt`
+type EncryptedStorage struct {
+	Storage
+	Config *EncryptionConfig
+	keys   map[string]cipher.AEAD
+}
+
+// Implementation of the `Storage.Open` interface method
+func (s *EncryptedStorage) Open() error {
+	keys, err := s.Config.loadKeys()
+	if err != nil {
+		return err
+	}
+
+	s.keys = keys
+
+	return s.Storage.Open()
+}
+
+func (s *EncryptedStorage) backend() Storage {
+	return s.Storage
+}
+
+// Additional data used for binding an encrypted record to its type and key
+func encryptionAD(typ reflect.Type, key []byte) []byte {
+	return append([]byte(StorableTypes[typ]+":"), key...)
+}
+
+// Returns the id of the key a record was encrypted with or an empty string if the record is not encrypted
+func encryptionKeyId(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, encryptionMagic) {
+		return "", nil
+	}
+
+	data = data[len(encryptionMagic):]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", ErrInvalidCiphertext
+	}
+
+	return string(data[1 : 1+int(data[0])]), nil
+}
+
+// Encrypts a record using the current key
+func (s *EncryptedStorage) encrypt(typ reflect.Type, key []byte, data []byte) ([]byte, error) {
+	aead := s.keys[s.Config.KeyId]
+	if aead == nil {
+		return nil, ErrStorageClosed
+	}
+
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, encryptionMagic...)
+	out = append(out, byte(len(s.Config.KeyId)))
+	out = append(out, s.Config.KeyId...)
+	out = append(out, nonce...)
+
+	return aead.Seal(out, nonce, data, encryptionAD(typ, key)), nil
+}
+
+// Decrypts a record. Unencrypted records are returned unchanged
+func (s *EncryptedStorage) decrypt(typ reflect.Type, key []byte, data []byte) ([]byte, error) {
+	id, err := encryptionKeyId(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" {
+		return data, nil
+	}
+
+	aead := s.keys[id]
+	if aead == nil {
+		return nil, ErrUnknownEncryptionKey
+	}
+
+	data = data[len(encryptionMagic)+1+len(id):]
+	if len(data) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], encryptionAD(typ, key))
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+
+	return plain, nil
+}
+
+func (s *EncryptedStorage) wrap(t Storable) Storable {
+	if t == nil {
+		return nil
+	}
+	return &encryptedStorable{t, s}
+}
+
+// Implementation of the `Storage.Get` interface method
+func (s *EncryptedStorage) Get(t Storable) error {
+	return s.Storage.Get(s.wrap(t))
+}
+
+// Implementation of the `Storage.Put` interface method
+func (s *EncryptedStorage) Put(t Storable) error {
+	return s.Storage.Put(s.wrap(t))
+}
+
+// Implementation of the `Storage.Iterator` interface method
+func (s *EncryptedStorage) Iterator(t Storable) (StorageIterator, error) {
+	iter, err := s.Storage.Iterator(t)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedIterator{iter, s}, nil
+}
+
+// Implementation of the `Storage.Update` interface method
+func (s *EncryptedStorage) Update(fn func(StorageTx) error) error {
+	return s.Storage.Update(func(tx StorageTx) error {
+		return fn(&encryptedTx{tx, s})
+	})
+}
+
+// Encrypts all records that are not yet encrypted with the current key, returning the number of
+// updated records
+func (s *EncryptedStorage) Reencrypt() (int, error) {
+	if s.keys == nil {
+		return 0, ErrStorageClosed
+	}
+
+	count := 0
+
+	for typ := range StorableTypes {
+		iter, err := s.Storage.Iterator(&rawStorable{typ: typ})
+		if err != nil {
+			return count, err
+		}
+
+		for iter.Next() {
+			raw := &rawStorable{typ: typ, key: append([]byte{}, iter.Key()...)}
+			if err := iter.Get(raw); err != nil {
+				iter.Release()
+				return count, err
+			}
+
+			if id, _ := encryptionKeyId(raw.data); id == s.Config.KeyId {
+				continue
+			}
+
+			plain, err := s.decrypt(typ, raw.key, raw.data)
+			if err == nil {
+				raw.data, err = s.encrypt(typ, raw.key, plain)
+			}
+			if err == nil {
+				err = s.Storage.Put(raw)
+			}
+			if err != nil {
+				iter.Release()
+				return count, fmt.Errorf("Failed to reencrypt %s record %s: %v", StorableTypes[typ], raw.key, err)
+			}
+
+			count++
+		}
+
+		err = iter.Error()
+		iter.Release()
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// Wraps a `Storable`, encrypting it on serialization and decrypting it on deserialization
+type encryptedStorable struct {
+	Storable
+	storage *EncryptedStorage
+}
+
+func (e *encryptedStorable) storableType() reflect.Type {
+	return typeFromStorable(e.Storable)
+}
+
+func (e *encryptedStorable) Serialize() ([]byte, error) {
+	data, err := e.Storable.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return e.storage.encrypt(e.storableType(), e.Key(), data)
+}
+
+func (e *encryptedStorable) Deserialize(data []byte) error {
+	plain, err := e.storage.decrypt(e.storableType(), e.Key(), data)
+	if err != nil {
+		return err
+	}
+	return e.Storable.Deserialize(plain)
+}
+
+// Iterator that decrypts records before populating `Storable` objects. Since the key of a `Storable` is not
+// necessarily known before deserializing it, the key provided by the underlying iterator is used for
+// authenticating the record
+type encryptedIterator struct {
+	StorageIterator
+	storage *EncryptedStorage
+}
+
+func (iter *encryptedIterator) Get(t Storable) error {
+	raw := &rawStorable{typ: typeFromStorable(t), key: iter.Key()}
+	if err := iter.StorageIterator.Get(raw); err != nil {
+		return err
+	}
+
+	plain, err := iter.storage.decrypt(raw.typ, raw.key, raw.data)
+	if err != nil {
+		return err
+	}
+
+	return t.Deserialize(plain)
+}
+
+// Implementation of the `StorageTx` interface for `EncryptedStorage`
+type encryptedTx struct {
+	tx      StorageTx
+	storage *EncryptedStorage
+}
+
+func (tx *encryptedTx) Get(t Storable) error {
+	return tx.tx.Get(tx.storage.wrap(t))
+}
+
+func (tx *encryptedTx) Put(t Storable) error {
+	return tx.tx.Put(tx.storage.wrap(t))
+}
+
+func (tx *encryptedTx) Delete(t Storable) error {
+	return tx.tx.Delete(t)
+}
+
+// `Storable` holding the serialized data of a record of a given type. Used for accessing records
+// without knowing their contents
+type rawStorable struct {
+	typ  reflect.Type
+	key  []byte
+	data []byte
+}
+
+func (r *rawStorable) storableType() reflect.Type {
+	return r.typ
+}
+
+func (r *rawStorable) Key() []byte {
+	return r.key
+}
+
+func (r *rawStorable) Serialize() ([]byte, error) {
+	return r.data, nil
+}
+
+func (r *rawStorable) Deserialize(data []byte) error {
+	r.data = append([]byte{}, data...)
+	return nil
+}
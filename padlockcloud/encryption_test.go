@@ -0,0 +1,183 @@
+package padlockcloud
+
+import "testing"
+import "io/ioutil"
+import "os"
+import "bytes"
+import "path/filepath"
+import "encoding/base64"
+
+func newTestEncryptionKey() string {
+	key, _ := randomBytes(32)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testStorage(t, &EncryptedStorage{
+		Storage: &BoltStorage{
+			Config: &BoltConfig{
+				Path: filepath.Join(dir, "padlock.db"),
+			},
+		},
+		Config: &EncryptionConfig{
+			KeyId: "key1",
+			Keys:  map[string]string{"key1": newTestEncryptionKey()},
+		},
+	})
+}
+
+func TestEncryptedStorageRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &LevelDBStorage{
+		Config: &LevelDBConfig{
+			Path: dir,
+		},
+	}
+
+	if err := backend.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a record before encryption is enabled
+	plain := &testKeyedStrbl{"plain", "unencrypted value"}
+	if err := backend.Put(plain); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.Close()
+
+	keyFile := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keyFile, []byte("# comment\nkey2:"+newTestEncryptionKey()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &EncryptionConfig{
+		KeyId:   "key1",
+		Keys:    map[string]string{"key1": newTestEncryptionKey()},
+		KeyFile: keyFile,
+	}
+	storage := &EncryptedStorage{Storage: backend, Config: config}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unencrypted records should still be readable
+	s := &testKeyedStrbl{Name: "plain"}
+	if err := storage.Get(s); err != nil || s.Value != plain.Value {
+		t.Fatalf("Expected '%s', got '%s' (%v)", plain.Value, s.Value, err)
+	}
+
+	encrypted := &testKeyedStrbl{"encrypted", "secret value"}
+	if err := storage.Put(encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := &rawStorable{typ: typeFromStorable(encrypted), key: encrypted.Key()}
+	if err := backend.Get(raw); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw.data, []byte(encrypted.Value)) {
+		t.Fatal("Record should be encrypted")
+	}
+	if id, _ := encryptionKeyId(raw.data); id != "key1" {
+		t.Fatalf("Expected record to be encrypted with key1, got '%s'", id)
+	}
+
+	// Records should be bound to their key
+	moved := &rawStorable{typ: raw.typ, key: []byte("moved"), data: raw.data}
+	if err := backend.Put(moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Get(&testKeyedStrbl{Name: "moved"}); err != ErrInvalidCiphertext {
+		t.Fatalf("Expected invalid ciphertext error, got %v", err)
+	}
+	if err := backend.Delete(moved); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to key from key file and reencrypt existing records
+	storage.Close()
+	config.KeyId = "key2"
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := storage.Reencrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 records to be reencrypted, got %d", count)
+	}
+
+	// All records should be readable through an iterator and be encrypted with the new key
+	iter, err := storage.Iterator(&testKeyedStrbl{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	for iter.Next() {
+		s := &testKeyedStrbl{}
+		if err := iter.Get(s); err != nil {
+			t.Fatal(err)
+		}
+		values[s.Name] = s.Value
+
+		raw := &rawStorable{typ: typeFromStorable(s), key: s.Key()}
+		if err := backend.Get(raw); err != nil {
+			t.Fatal(err)
+		}
+		if id, _ := encryptionKeyId(raw.data); id != "key2" {
+			t.Fatalf("Expected record to be encrypted with key2, got '%s'", id)
+		}
+	}
+	iter.Release()
+
+	if values["plain"] != plain.Value || values["encrypted"] != encrypted.Value {
+		t.Fatalf("Unexpected values after reencryption: %v", values)
+	}
+
+	// Running it again should not touch any records
+	if count, err := storage.Reencrypt(); err != nil || count != 0 {
+		t.Fatalf("Expected no records to be reencrypted, got %d (%v)", count, err)
+	}
+
+	// Records can no longer be read once the old key is gone, unless it is still provided
+	storage.Close()
+	delete(config.Keys, "key1")
+	config.KeyFile = ""
+	config.Keys["key3"] = newTestEncryptionKey()
+	config.KeyId = "key3"
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err := storage.Get(&testKeyedStrbl{Name: "plain"}); err != ErrUnknownEncryptionKey {
+		t.Fatalf("Expected unknown key error, got %v", err)
+	}
+}
+
+func TestEncryptionConfigInvalidKey(t *testing.T) {
+	for _, config := range []*EncryptionConfig{
+		{KeyId: "key1", Keys: map[string]string{"key1": "not base64"}},
+		{KeyId: "key1", Keys: map[string]string{"key1": base64.StdEncoding.EncodeToString([]byte("short"))}},
+		{KeyId: "key2", Keys: map[string]string{"key1": newTestEncryptionKey()}},
+	} {
+		if _, err := config.loadKeys(); err == nil {
+			t.Errorf("Expected error for config %v", config)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package padlockcloud
 
 import "fmt"
 import "net/http"
+import "time"
 
 func JsonifyErrorResponse(e ErrorResponse) []byte {
 	return []byte(fmt.Sprintf("{\"error\":\"%s\",\"message\":\"%s\"}", e.Code(), e.Message()))
@@ -196,6 +197,205 @@ func (e *RateLimitExceeded) Message() string {
 	return http.StatusText(e.Status())
 }
 
+type PreconditionFailed struct {
+	etag string
+}
+
+func (e *PreconditionFailed) Code() string {
+	return "precondition_failed"
+}
+
+func (e *PreconditionFailed) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.etag)
+}
+
+func (e *PreconditionFailed) Status() int {
+	return http.StatusPreconditionFailed
+}
+
+func (e *PreconditionFailed) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "The data has been modified since it was last retrieved")
+}
+
+type UnsupportedContentEncoding struct {
+	encoding string
+}
+
+func (e *UnsupportedContentEncoding) Code() string {
+	return "unsupported_content_encoding"
+}
+
+func (e *UnsupportedContentEncoding) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.encoding)
+}
+
+func (e *UnsupportedContentEncoding) Status() int {
+	return http.StatusUnsupportedMediaType
+}
+
+func (e *UnsupportedContentEncoding) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "The content encoding of the request body is not supported")
+}
+
+type StoreQuotaExceeded struct {
+	quota int64
+}
+
+func (e *StoreQuotaExceeded) Code() string {
+	return "store_quota_exceeded"
+}
+
+func (e *StoreQuotaExceeded) Error() string {
+	return fmt.Sprintf("%s - %d", e.Code(), e.quota)
+}
+
+func (e *StoreQuotaExceeded) Status() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+func (e *StoreQuotaExceeded) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "The data exceeds the maximum allowed size")
+}
+
+type VaultNotFound struct {
+	name string
+}
+
+func (e *VaultNotFound) Code() string {
+	return "vault_not_found"
+}
+
+func (e *VaultNotFound) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.name)
+}
+
+func (e *VaultNotFound) Status() int {
+	return http.StatusNotFound
+}
+
+func (e *VaultNotFound) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "No vault with this name exists")
+}
+
+type VaultExists struct {
+	name string
+}
+
+func (e *VaultExists) Code() string {
+	return "vault_exists"
+}
+
+func (e *VaultExists) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.name)
+}
+
+func (e *VaultExists) Status() int {
+	return http.StatusConflict
+}
+
+func (e *VaultExists) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "A vault with this name already exists")
+}
+
+type TooManyVaults struct {
+	max int
+}
+
+func (e *TooManyVaults) Code() string {
+	return "too_many_vaults"
+}
+
+func (e *TooManyVaults) Error() string {
+	return fmt.Sprintf("%s - %d", e.Code(), e.max)
+}
+
+func (e *TooManyVaults) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *TooManyVaults) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "The maximum number of vaults has been reached")
+}
+
+type VaultAccessDenied struct {
+	name string
+}
+
+func (e *VaultAccessDenied) Code() string {
+	return "vault_access_denied"
+}
+
+func (e *VaultAccessDenied) Error() string {
+	return fmt.Sprintf("%s - %s", e.Code(), e.name)
+}
+
+func (e *VaultAccessDenied) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *VaultAccessDenied) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "You are not allowed to modify this vault")
+}
+
+type TOTPRequired struct {
+}
+
+func (e *TOTPRequired) Code() string {
+	return "totp_required"
+}
+
+func (e *TOTPRequired) Error() string {
+	return e.Code()
+}
+
+func (e *TOTPRequired) Status() int {
+	return http.StatusUnauthorized
+}
+
+func (e *TOTPRequired) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "A two-factor authentication code is required")
+}
+
+type InvalidTOTPCode struct {
+}
+
+func (e *InvalidTOTPCode) Code() string {
+	return "invalid_totp_code"
+}
+
+func (e *InvalidTOTPCode) Error() string {
+	return e.Code()
+}
+
+func (e *InvalidTOTPCode) Status() int {
+	return http.StatusUnauthorized
+}
+
+func (e *InvalidTOTPCode) Message() string {
+	return fmt.Sprintf("%s - %s", http.StatusText(e.Status()), "The provided two-factor authentication code is invalid")
+}
+
+type TOTPLocked struct {
+	until time.Time
+}
+
+func (e *TOTPLocked) Code() string {
+	return "totp_locked"
+}
+
+func (e *TOTPLocked) Error() string {
+	return e.Code()
+}
+
+func (e *TOTPLocked) Status() int {
+	return http.StatusTooManyRequests
+}
+
+func (e *TOTPLocked) Message() string {
+	return fmt.Sprintf("%s - %s %s", http.StatusText(e.Status()),
+		"Too many invalid two-factor authentication codes. Please try again after", e.until.Format(time.RFC1123))
+}
+
 type ServerError struct {
 	error
 }
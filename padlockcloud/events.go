@@ -0,0 +1,403 @@
+package padlockcloud
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "strconv"
+import "sync"
+import "time"
+
+// Types of store events
+const (
+	// The content of a vault was updated or restored from a previous revision
+	StoreEventUpdate = "update"
+	// The content of a vault was removed
+	StoreEventDelete = "delete"
+	// A change was appended to the change log of a vault
+	StoreEventChange = "change"
+	// The change log of a vault was compacted into a new snapshot
+	StoreEventCompact = "compact"
+	// Sent to reconnecting clients that missed events which are no longer available. Clients
+	// should fetch the vaults they are interested in again
+	StoreEventReset = "reset"
+)
+
+// Interval in which a comment is sent to connected clients to keep the connection alive
+var eventHeartbeatInterval = 30 * time.Second
+
+// Time clients should wait before reconnecting after the connection was lost
+var eventRetryInterval = 5 * time.Second
+
+// Number of recent events kept per account for clients resuming a lost connection
+var eventBacklogSize = 50
+
+// Number of most recent events, across all accounts, clients can resume from. Older events are removed
+// from the backlogs, and clients that last saw one of them receive a `StoreEventReset` event
+var eventWindowSize uint64 = 10000
+
+// Maximum time events are kept for clients resuming a lost connection
+var eventBacklogMaxAge = 10 * time.Minute
+
+// Number of events buffered per subscriber. Subscribers falling behind further are disconnected
+var eventBufferSize = 16
+
+// Change to the data of an account, pushed to connected clients
+type StoreEvent struct {
+	// Sequence number of the event, increasing across all accounts
+	Id uint64 `json:"-"`
+	// One of `StoreEventUpdate`, `StoreEventDelete`, `StoreEventChange`, `StoreEventCompact` or
+	// `StoreEventReset`
+	Type string `json:"type"`
+	// Email of the account owning the vault
+	Owner string `json:"owner,omitempty"`
+	// Name of the vault
+	Vault string `json:"vault,omitempty"`
+	// Identifier of the current revision of the vault
+	Revision string `json:"revision,omitempty"`
+	// Sequence number of the appended change for events of type `StoreEventChange` and of the last
+	// change covered by the new snapshot for events of type `StoreEventCompact`
+	Seq int64 `json:"seq,omitempty"`
+	// Id of the auth token used for making the change, i.e. the id of the writing device
+	TokenId string    `json:"tokenId,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Creates an event for a change to a data store, made with the given auth token
+func NewStoreEvent(typ string, data *DataStore, author *AuthToken) *StoreEvent {
+	event := &StoreEvent{
+		Type:  typ,
+		Owner: data.Account.Email,
+		Vault: data.Vault,
+		Time:  time.Now(),
+	}
+
+	if event.Vault == "" {
+		event.Vault = DefaultVault
+	}
+
+	if typ == StoreEventUpdate {
+		event.Revision = data.Revision()
+	}
+
+	if author != nil {
+		event.TokenId = author.Id
+	}
+
+	return event
+}
+
+// Subscription to the events of an account
+type EventSubscription struct {
+	Email string
+	// Id of the auth token used for subscribing. The subscription ends when the token is revoked
+	TokenId string
+	// Receives published events. Closed when the subscriber falls behind, its auth token is revoked or
+	// the hub is closed
+	Events chan *StoreEvent
+}
+
+// Event published to a number of accounts, kept until it is pruned from their backlogs
+type publishedEvent struct {
+	event     *StoreEvent
+	emails    []string
+	published time.Time
+}
+
+// In-process hub distributing store events to subscribers
+type EventHub struct {
+	mutex  sync.Mutex
+	lastId uint64
+	// Id of the most recent event pruned from the backlogs of all accounts. Initially derived from the
+	// time the hub was created, so ids handed out before a restart can be told apart from current ones
+	prunedId uint64
+	subs     map[string]map[*EventSubscription]bool
+	// Events still kept in the backlogs, oldest event first
+	published []*publishedEvent
+	backlog   map[string][]*StoreEvent
+	// Id of the most recent event dropped from the backlog of each account for exceeding
+	// `eventBacklogSize`. Removed along with the backlog once all of its events have been pruned
+	dropped map[string]uint64
+	closed  bool
+}
+
+func NewEventHub() *EventHub {
+	firstId := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	return &EventHub{
+		lastId:   firstId - 1,
+		prunedId: firstId - 1,
+		subs:     make(map[string]map[*EventSubscription]bool),
+		backlog:  make(map[string][]*StoreEvent),
+		dropped:  make(map[string]uint64),
+	}
+}
+
+// Subscribes to the events of the account with the given email, authenticated with the auth token with
+// the id `tokenId`. If `lastId` is not 0, events published after the event with that id are delivered
+// first. If some of these events are no longer available, a single event of type `StoreEventReset` is
+// delivered instead
+func (hub *EventHub) Subscribe(email string, tokenId string, lastId uint64) *EventSubscription {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	sub := &EventSubscription{Email: email, TokenId: tokenId, Events: make(chan *StoreEvent, eventBufferSize)}
+
+	if hub.closed {
+		close(sub.Events)
+		return sub
+	}
+
+	if lastId != 0 {
+		hub.prune(time.Now())
+
+		var missed []*StoreEvent
+		for _, event := range hub.backlog[email] {
+			if event.Id > lastId {
+				missed = append(missed, event)
+			}
+		}
+
+		// Events are lost if the client last saw an event from before a restart or if events it missed
+		// have already been pruned or dropped from the backlog
+		lost := lastId < hub.prunedId || lastId > hub.lastId || hub.dropped[email] > lastId
+		if lost || len(missed) > eventBufferSize {
+			missed = []*StoreEvent{{Id: hub.lastId, Type: StoreEventReset, Time: time.Now()}}
+		}
+
+		for _, event := range missed {
+			sub.Events <- event
+		}
+	}
+
+	if hub.subs[email] == nil {
+		hub.subs[email] = make(map[*EventSubscription]bool)
+	}
+	hub.subs[email][sub] = true
+
+	return sub
+}
+
+// Cancels a subscription
+func (hub *EventHub) Unsubscribe(sub *EventSubscription) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.unsubscribe(sub)
+}
+
+func (hub *EventHub) unsubscribe(sub *EventSubscription) {
+	if subs := hub.subs[sub.Email]; subs[sub] {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(hub.subs, sub.Email)
+		}
+		close(sub.Events)
+	}
+}
+
+// Ends the subscriptions of an account made with the auth token with the id `tokenId`, e.g. because the
+// token has been revoked. All subscriptions of the account are ended if `tokenId` is empty
+func (hub *EventHub) Disconnect(email string, tokenId string) {
+	if hub == nil {
+		return
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for sub := range hub.subs[email] {
+		if tokenId == "" || sub.TokenId == tokenId {
+			hub.unsubscribe(sub)
+		}
+	}
+}
+
+// Publishes an event to all subscribers of the given accounts
+func (hub *EventHub) Publish(event *StoreEvent, emails ...string) {
+	if hub == nil {
+		return
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if hub.closed {
+		return
+	}
+
+	hub.lastId++
+	event.Id = hub.lastId
+
+	now := time.Now()
+	hub.prune(now)
+	hub.published = append(hub.published, &publishedEvent{event, emails, now})
+
+	for _, email := range emails {
+		backlog := append(hub.backlog[email], event)
+		if drop := len(backlog) - eventBacklogSize; drop > 0 {
+			hub.dropped[email] = backlog[drop-1].Id
+			backlog = backlog[drop:]
+		}
+		hub.backlog[email] = backlog
+
+		for sub := range hub.subs[email] {
+			select {
+			case sub.Events <- event:
+			default:
+				// Disconnect subscribers that can't keep up. They'll catch up using the backlog
+				// once they reconnect
+				hub.unsubscribe(sub)
+			}
+		}
+	}
+}
+
+// Removes events from the backlogs once they are no longer among the `eventWindowSize` most recent events
+// or older than `eventBacklogMaxAge`. The backlog of an account is removed entirely once none of its
+// events are left
+func (hub *EventHub) prune(now time.Time) {
+	for len(hub.published) != 0 {
+		p := hub.published[0]
+		if hub.lastId-p.event.Id < eventWindowSize && now.Sub(p.published) < eventBacklogMaxAge {
+			break
+		}
+
+		hub.published[0] = nil
+		hub.published = hub.published[1:]
+		hub.prunedId = p.event.Id
+
+		for _, email := range p.emails {
+			// The event may already have been dropped for exceeding the backlog size
+			backlog := hub.backlog[email]
+			if len(backlog) != 0 && backlog[0] == p.event {
+				backlog = backlog[1:]
+			}
+
+			if len(backlog) != 0 {
+				hub.backlog[email] = backlog
+			} else {
+				// Any events dropped from the backlog are older than the ones pruned, which clients
+				// can't resume from either way
+				delete(hub.backlog, email)
+				delete(hub.dropped, email)
+			}
+		}
+	}
+}
+
+// Closes all subscriptions. Events published afterwards are discarded
+func (hub *EventHub) Close() {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.closed = true
+	for _, subs := range hub.subs {
+		for sub := range subs {
+			hub.unsubscribe(sub)
+		}
+	}
+}
+
+// Returns the accounts that should be notified about changes to a data store, i.e. its owner and all
+// accepted members of the vault
+func (server *Server) storeEventRecipients(data *DataStore) ([]string, error) {
+	recipients := []string{data.Account.Email}
+
+	if data.Vault != "" {
+		sv := &SharedVault{Owner: data.Account.Email, Vault: data.Vault}
+		if err := server.Storage.Get(sv); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		for _, m := range sv.Members {
+			if m.Accepted {
+				recipients = append(recipients, m.Email)
+			}
+		}
+	}
+
+	return recipients, nil
+}
+
+// Publishes an event for a change to a data store to all accounts with access to it
+func (server *Server) PublishStoreEvent(typ string, data *DataStore, author *AuthToken) error {
+	recipients, err := server.storeEventRecipients(data)
+	if err != nil {
+		return err
+	}
+
+	server.Events.Publish(NewStoreEvent(typ, data, author), recipients...)
+
+	return nil
+}
+
+// Publishes an event for a change to a change log to all accounts with access to the vault. `typ` is
+// either `StoreEventChange` or `StoreEventCompact`
+func (server *Server) PublishChangeEvent(typ string, log *ChangeLog, seq int64, author *AuthToken) error {
+	data := &DataStore{Account: log.Account, Vault: log.Vault}
+
+	recipients, err := server.storeEventRecipients(data)
+	if err != nil {
+		return err
+	}
+
+	event := NewStoreEvent(typ, data, author)
+	event.Seq = seq
+	server.Events.Publish(event, recipients...)
+
+	return nil
+}
+
+type StoreEvents struct {
+	*Server
+}
+
+// Handler function for streaming changes to the data of an account as server-sent events. Clients
+// resuming a lost connection should send the id of the last event they received via the
+// `Last-Event-ID` header
+func (h *StoreEvents) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("Streaming is not supported by the response writer")
+	}
+
+	lastId, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	sub := h.Events.Subscribe(auth.Email, auth.Id, lastId)
+	defer h.Events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetryInterval/time.Millisecond)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return nil
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+		case <-heartbeat.C:
+			// Streams don't outlive the auth token they were opened with
+			if !auth.Expires.IsZero() && auth.Expires.Before(time.Now()) {
+				return nil
+			}
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return nil
+		}
+
+		flusher.Flush()
+	}
+}
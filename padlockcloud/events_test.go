@@ -0,0 +1,127 @@
+package padlockcloud
+
+import "testing"
+import "time"
+
+func TestEventHub(t *testing.T) {
+	hub := NewEventHub()
+
+	sub := hub.Subscribe(testEmail, "", 0)
+	other := hub.Subscribe("other@padlock.io", "", 0)
+
+	hub.Publish(&StoreEvent{Type: StoreEventUpdate, Revision: "1"}, testEmail)
+
+	event := <-sub.Events
+	if event.Type != StoreEventUpdate || event.Revision != "1" || event.Id != hub.prunedId+1 {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+	if len(other.Events) != 0 {
+		t.Fatal("Events should only be delivered to subscribers of the affected accounts")
+	}
+
+	hub.Unsubscribe(sub)
+	if _, ok := <-sub.Events; ok {
+		t.Fatal("Events channel should be closed after unsubscribing")
+	}
+
+	// Events missed while disconnected should be delivered when resuming
+	hub.Publish(&StoreEvent{Type: StoreEventUpdate, Revision: "2"}, testEmail)
+	hub.Publish(&StoreEvent{Type: StoreEventDelete}, testEmail)
+
+	sub = hub.Subscribe(testEmail, "", event.Id)
+	if len(sub.Events) != 2 {
+		t.Fatalf("Expected 2 missed events, got %d", len(sub.Events))
+	}
+	if e := <-sub.Events; e.Revision != "2" {
+		t.Fatalf("Expected missed events in order, got %+v", e)
+	}
+	last := <-sub.Events
+	hub.Unsubscribe(sub)
+
+	// Ids from before a restart can't be resumed
+	sub = hub.Subscribe(testEmail, "", hub.prunedId-100)
+	if e := <-sub.Events; e.Type != StoreEventReset {
+		t.Fatalf("Expected reset event for unknown id, got %+v", e)
+	}
+	hub.Unsubscribe(sub)
+
+	// Neither can events that have been dropped from the backlog
+	for i := 0; i < eventBacklogSize; i++ {
+		hub.Publish(&StoreEvent{Type: StoreEventUpdate}, testEmail)
+	}
+	sub = hub.Subscribe(testEmail, "", last.Id)
+	if len(sub.Events) != 1 {
+		t.Fatalf("Expected a single event, got %d", len(sub.Events))
+	}
+	if e := <-sub.Events; e.Type != StoreEventReset {
+		t.Fatalf("Expected reset event for dropped events, got %+v", e)
+	}
+
+	// Subscribers that fall behind should be disconnected
+	for i := 0; i <= eventBufferSize; i++ {
+		hub.Publish(&StoreEvent{Type: StoreEventUpdate}, testEmail)
+	}
+	for range sub.Events {
+	}
+
+	// Revoking an auth token should only end the subscriptions made with it
+	sub = hub.Subscribe(testEmail, "token1", 0)
+	sub2 := hub.Subscribe(testEmail, "token2", 0)
+	hub.Disconnect(testEmail, "token1")
+	if _, ok := <-sub.Events; ok {
+		t.Fatal("Subscriptions of revoked tokens should be ended")
+	}
+	hub.Disconnect(testEmail, "")
+	if _, ok := <-sub2.Events; ok {
+		t.Fatal("Disconnecting an account should end all of its subscriptions")
+	}
+
+	hub.Close()
+	if _, ok := <-other.Events; ok {
+		t.Fatal("Closing the hub should end all subscriptions")
+	}
+}
+
+func TestEventHubPruning(t *testing.T) {
+	defer func(size uint64, age time.Duration) {
+		eventWindowSize = size
+		eventBacklogMaxAge = age
+	}(eventWindowSize, eventBacklogMaxAge)
+	eventWindowSize = 5
+
+	hub := NewEventHub()
+
+	hub.Publish(&StoreEvent{Type: StoreEventUpdate}, testEmail)
+	first := hub.lastId
+	for i := 0; i < 5; i++ {
+		hub.Publish(&StoreEvent{Type: StoreEventUpdate}, "other@padlock.io")
+	}
+
+	// Events outside of the window should be pruned along with accounts that have no events left
+	if _, ok := hub.backlog[testEmail]; ok {
+		t.Fatal("Expected backlog to be removed once all of its events have been pruned")
+	}
+	if len(hub.backlog["other@padlock.io"]) != 5 || len(hub.published) != 5 {
+		t.Fatalf("Expected 5 events to be kept, got %d", len(hub.published))
+	}
+
+	// Clients that last saw an event from before the pruned one may have missed it
+	sub := hub.Subscribe(testEmail, "", first-1)
+	if e := <-sub.Events; e.Type != StoreEventReset {
+		t.Fatalf("Expected reset event for pruned events, got %+v", e)
+	}
+	hub.Unsubscribe(sub)
+
+	sub = hub.Subscribe(testEmail, "", first)
+	if len(sub.Events) != 0 {
+		t.Fatalf("Expected no missed events, got %d", len(sub.Events))
+	}
+	hub.Unsubscribe(sub)
+
+	// Events should also be pruned once they are too old
+	eventBacklogMaxAge = 0
+	hub.Publish(&StoreEvent{Type: StoreEventUpdate}, testEmail)
+	if len(hub.backlog) != 1 || len(hub.backlog[testEmail]) != 1 || len(hub.published) != 1 {
+		t.Fatalf("Expected only the most recent event to be kept, got %d", len(hub.published))
+	}
+}
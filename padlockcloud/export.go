@@ -0,0 +1,422 @@
+package padlockcloud
+
+import "io"
+import "fmt"
+import "sort"
+import "time"
+import "strings"
+import "io/ioutil"
+import "archive/tar"
+import "compress/gzip"
+import "encoding/json"
+
+// Version of the account export format
+const exportVersion = 1
+
+// Maximum size of an uncompressed account export accepted for importing
+var maxImportSize int64 = 256 << 20
+
+// Describes the contents of an account export. Written to `manifest.json` within the archive
+type ExportManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Email   string    `json:"email"`
+	// Time the account was created
+	AccountCreated time.Time       `json:"accountCreated"`
+	Vaults         []*ExportVault  `json:"vaults"`
+	Shared         []*ExportShared `json:"shared"`
+}
+
+// Vault contained in an account export. Its content is stored in `vaults/{name}.pls`, its history
+// and change log, if any, in `history/{name}.json` and `changes/{name}.json`
+type ExportVault struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Revision string `json:"revision"`
+	// Accounts the vault is shared with. Not restored when importing
+	Members []*VaultMember `json:"members,omitempty"`
+}
+
+// Vault of another account the exported account is a member of. Its content is not exported
+type ExportShared struct {
+	Owner string `json:"owner"`
+	Vault string `json:"vault"`
+	Role  string `json:"role"`
+}
+
+// Metadata of an auth token, leaving out the secret token itself. Written to `tokens.json`
+type ExportToken struct {
+	Id             string    `json:"id"`
+	Type           string    `json:"type"`
+	Description    string    `json:"description"`
+	Created        time.Time `json:"created"`
+	LastUsed       time.Time `json:"lastUsed"`
+	Expires        time.Time `json:"expires"`
+	ClientVersion  string    `json:"clientVersion,omitempty"`
+	ClientPlatform string    `json:"clientPlatform,omitempty"`
+	Device         *Device   `json:"device,omitempty"`
+}
+
+// Event in the activity of an account, reconstructed from its records. Written to `events.json`,
+// oldest event first
+type ExportEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Detail string    `json:"detail"`
+}
+
+// Contents of an account export
+type AccountExport struct {
+	Manifest *ExportManifest
+	// Content of each vault, mapped by name
+	Content map[string][]byte
+	History map[string][]*StoreRevision
+	Changes map[string]*ChangeLog
+	Tokens  []*ExportToken
+	Events  []*ExportEvent
+}
+
+// Collects all data associated with an account for exporting it
+func NewAccountExport(storage Storage, acc *Account) (*AccountExport, error) {
+	export := &AccountExport{
+		Manifest: &ExportManifest{
+			Version:        exportVersion,
+			Created:        time.Now(),
+			Email:          acc.Email,
+			AccountCreated: acc.Created,
+			Vaults:         []*ExportVault{},
+			Shared:         []*ExportShared{},
+		},
+		Content: make(map[string][]byte),
+		History: make(map[string][]*StoreRevision),
+		Changes: make(map[string]*ChangeLog),
+		Tokens:  []*ExportToken{},
+		Events:  []*ExportEvent{},
+	}
+
+	event := func(t time.Time, typ string, detail string, args ...interface{}) {
+		if !t.IsZero() {
+			export.Events = append(export.Events, &ExportEvent{t, typ, fmt.Sprintf(detail, args...)})
+		}
+	}
+
+	event(acc.Created, "account:create", "%s", acc.Email)
+
+	for _, t := range acc.AuthTokens {
+		export.Tokens = append(export.Tokens, &ExportToken{
+			Id:             t.Id,
+			Type:           t.Type,
+			Description:    t.Description(),
+			Created:        t.Created,
+			LastUsed:       t.LastUsed,
+			Expires:        t.Expires,
+			ClientVersion:  t.ClientVersion,
+			ClientPlatform: t.ClientPlatform,
+			Device:         t.Device,
+		})
+		event(t.Created, "auth_token:create", "%s:%s - %s", t.Type, t.Id, t.Description())
+		event(t.LastUsed, "auth_token:use", "%s:%s - %s", t.Type, t.Id, t.Description())
+	}
+
+	vaults, err := GetVaults(storage, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vault := range vaults {
+		data := &DataStore{Account: acc, Vault: vault.Name}
+		if err := storage.Get(data); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+
+		sv := &SharedVault{Owner: acc.Email, Vault: vault.Name}
+		if err := storage.Get(sv); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+
+		export.Manifest.Vaults = append(export.Manifest.Vaults, &ExportVault{
+			Name:     vault.Name,
+			Size:     vault.Size,
+			Revision: vault.Revision,
+			Members:  sv.Members,
+		})
+		export.Content[vault.Name] = data.Content
+
+		history := &StoreHistory{Account: acc, Vault: vault.Name}
+		if err := storage.Get(history); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if len(history.Revisions) != 0 {
+			export.History[vault.Name] = history.Revisions
+		}
+		for _, rev := range history.Revisions {
+			event(rev.Created, "data_store:write", "%s:%s - %s", vault.Name, rev.Id, rev.Device)
+		}
+
+		log := &ChangeLog{Account: acc, Vault: vault.Name}
+		if err := LoadChangeLog(storage, log, 0); err == nil {
+			export.Changes[vault.Name] = log
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+
+		for _, m := range sv.Members {
+			event(m.Invited, "vault:share", "%s:%s - %s", vault.Name, m.Email, m.Role)
+		}
+	}
+
+	shared, err := memberships(storage, acc.Email)
+	if err != nil {
+		return nil, err
+	}
+	for _, sv := range shared {
+		if m := sv.Member(acc.Email); m != nil && m.Accepted {
+			export.Manifest.Shared = append(export.Manifest.Shared, &ExportShared{sv.Owner, sv.Vault, m.Role})
+		}
+	}
+
+	deletions, err := GetPendingDeletions(storage, acc.Email)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deletions {
+		event(d.Requested, "deletion:request", "%s", d.Key())
+	}
+
+	sort.SliceStable(export.Events, func(i, j int) bool {
+		return export.Events[i].Time.Before(export.Events[j].Time)
+	})
+
+	return export, nil
+}
+
+// Writes the export as a gzip-compressed tar archive
+func (export *AccountExport) Write(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	writeFile := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: export.Manifest.Created,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	writeJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeFile(name, data)
+	}
+
+	if err := writeJSON("manifest.json", export.Manifest); err != nil {
+		return err
+	}
+
+	for _, vault := range export.Manifest.Vaults {
+		if err := writeFile("vaults/"+vault.Name+".pls", export.Content[vault.Name]); err != nil {
+			return err
+		}
+		if history, ok := export.History[vault.Name]; ok {
+			if err := writeJSON("history/"+vault.Name+".json", history); err != nil {
+				return err
+			}
+		}
+		if log, ok := export.Changes[vault.Name]; ok {
+			if err := writeJSON("changes/"+vault.Name+".json", log); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeJSON("tokens.json", export.Tokens); err != nil {
+		return err
+	}
+
+	if err := writeJSON("events.json", export.Events); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Reads an account export written by `AccountExport.Write`. Fails if the uncompressed archive
+// exceeds `maxImportSize`
+func ReadAccountExport(r io.Reader) (*AccountExport, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, &BadRequest{"invalid export archive"}
+	}
+	defer gz.Close()
+
+	export := &AccountExport{
+		Content: make(map[string][]byte),
+		History: make(map[string][]*StoreRevision),
+		Changes: make(map[string]*ChangeLog),
+	}
+
+	tr := tar.NewReader(limitReader(gz, maxImportSize))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if _, ok := err.(*StoreQuotaExceeded); ok {
+			return nil, err
+		} else if err != nil {
+			return nil, &BadRequest{"invalid export archive"}
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if _, ok := err.(*StoreQuotaExceeded); ok {
+			return nil, err
+		} else if err != nil {
+			return nil, &BadRequest{"invalid export archive"}
+		}
+
+		name := header.Name
+		switch {
+		case name == "manifest.json":
+			export.Manifest = &ExportManifest{}
+			err = json.Unmarshal(data, export.Manifest)
+		case strings.HasPrefix(name, "vaults/") && strings.HasSuffix(name, ".pls"):
+			export.Content[strings.TrimSuffix(strings.TrimPrefix(name, "vaults/"), ".pls")] = data
+		case strings.HasPrefix(name, "history/") && strings.HasSuffix(name, ".json"):
+			var revs []*StoreRevision
+			err = json.Unmarshal(data, &revs)
+			export.History[strings.TrimSuffix(strings.TrimPrefix(name, "history/"), ".json")] = revs
+		case strings.HasPrefix(name, "changes/") && strings.HasSuffix(name, ".json"):
+			log := &ChangeLog{}
+			err = json.Unmarshal(data, log)
+			log.normalize()
+			export.Changes[strings.TrimSuffix(strings.TrimPrefix(name, "changes/"), ".json")] = log
+		case name == "tokens.json":
+			err = json.Unmarshal(data, &export.Tokens)
+		case name == "events.json":
+			err = json.Unmarshal(data, &export.Events)
+		}
+
+		if err != nil {
+			return nil, &BadRequest{fmt.Sprintf("invalid %s in export archive", name)}
+		}
+	}
+
+	if export.Manifest == nil {
+		return nil, &BadRequest{"export archive has no manifest"}
+	}
+
+	if export.Manifest.Version != exportVersion {
+		return nil, &BadRequest{fmt.Sprintf("unsupported export version: %d", export.Manifest.Version)}
+	}
+
+	for _, vault := range export.Manifest.Vaults {
+		if vault.Name != DefaultVault && !ValidVaultName(vault.Name) {
+			return nil, &BadRequest{fmt.Sprintf("invalid vault name in export archive: %s", vault.Name)}
+		}
+	}
+
+	return export, nil
+}
+
+// Imports the vaults contained in an export into an account, along with their history and change logs.
+// Auth tokens and sharing settings are not imported, so devices have to be paired again and vaults
+// shared again. Fails with a `VaultExists` error if any of the vaults already exists (or, in case of
+// the default vault, isn't empty) or has a non-empty change log, and with a `StoreQuotaExceeded` error if the storage used by the
+// account, including the imported content, history and change logs, would exceed `quota`. Creates the
+// account if it doesn't exist yet
+func ImportAccountExport(storage Storage, acc *Account, export *AccountExport, quota int64) error {
+	vaults, err := vaultNames(storage, acc)
+	if err != nil {
+		return err
+	}
+	for _, vault := range export.Manifest.Vaults {
+		if vault.Name != DefaultVault {
+			vaults = append(vaults, vault.Name)
+		}
+	}
+
+	return storage.Update(func(tx StorageTx) error {
+		if err := tx.Get(acc); err == ErrNotFound {
+			if err := tx.Put(acc); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		for _, vault := range export.Manifest.Vaults {
+			name := vault.Name
+			if name == DefaultVault {
+				name = ""
+			}
+
+			data := &DataStore{Account: acc, Vault: name}
+			if err := tx.Get(data); err == nil && (name != "" || len(data.Content) != 0) {
+				return &VaultExists{vault.Name}
+			} else if err != nil && err != ErrNotFound {
+				return err
+			}
+
+			// Delta mode is independent of the data store, so an empty data store doesn't mean the
+			// vault holds no data
+			log := &ChangeLog{Account: acc, Vault: name}
+			if err := tx.Get(log); err == nil && !log.Empty() {
+				return &VaultExists{vault.Name}
+			} else if err != nil && err != ErrNotFound {
+				return err
+			}
+
+			data.Content = export.Content[vault.Name]
+			if err := tx.Put(data); err != nil {
+				return err
+			}
+
+			if revs, ok := export.History[vault.Name]; ok {
+				if err := tx.Put(&StoreHistory{Account: acc, Vault: name, Revisions: revs}); err != nil {
+					return err
+				}
+			}
+
+			if log, ok := export.Changes[vault.Name]; ok {
+				if err := importChangeLog(tx, acc, name, log); err != nil {
+					return err
+				}
+			}
+		}
+
+		return checkStoreQuota(tx, acc, vaults, quota)
+	})
+}
+
+// Stores a change log read from an export for a vault of `acc`. If the vault had a change log before,
+// the sequence numbers of the imported changes are shifted to continue where it left off
+func importChangeLog(tx StorageTx, acc *Account, vault string, log *ChangeLog) error {
+	existing := &ChangeLog{Account: acc, Vault: vault}
+	if err := clearChangeLog(tx, existing); err != nil {
+		return err
+	}
+	offset := existing.Seq()
+
+	log.Account, log.Vault = acc, vault
+	log.SnapshotSeq += offset
+	log.LastSeq += offset
+	for _, c := range log.Changes {
+		c.Seq += offset
+	}
+
+	if err := log.migrate(tx); err != nil {
+		return err
+	}
+
+	return tx.Put(log)
+}
@@ -2,12 +2,14 @@ package padlockcloud
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -148,6 +150,7 @@ func (h *RequestAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth *
 	// No need to send and activation email if the client is preauthorized
 	if !preauth {
 		if h.emailRateLimiter.RateLimit(IPFromRequest(r), email) {
+			h.Metrics.RecordRateLimitDenial("auth_request")
 			return &RateLimitExceeded{}
 		}
 
@@ -162,7 +165,7 @@ func (h *RequestAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth *
 
 		// Send email with activation link
 		go func() {
-			if err := h.Sender.Send(email, emailSubj, emailBody.String()); err != nil {
+			if err := h.SendEmail(email, emailSubj, emailBody.String()); err != nil {
 				h.LogError(&ServerError{err}, r)
 			}
 		}()
@@ -208,6 +211,24 @@ func (h *ActivateAuthToken) GetAuthRequest(r *http.Request) (*AuthRequest, error
 }
 
 func (h *ActivateAuthToken) Activate(authRequest *AuthRequest) error {
+	var revoked []string
+	if err := h.Storage.Update(func(tx StorageTx) error {
+		var err error
+		revoked, err = h.activate(tx, authRequest)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range revoked {
+		h.Events.Disconnect(authRequest.AuthToken.Email, id)
+	}
+
+	return nil
+}
+
+// Adds the auth token of an auth request to its account. Returns the ids of the tokens replaced by it
+func (h *ActivateAuthToken) activate(tx StorageTx, authRequest *AuthRequest) ([]string, error) {
 	at := authRequest.AuthToken
 
 	// Create account instance with the given email address.
@@ -215,10 +236,12 @@ func (h *ActivateAuthToken) Activate(authRequest *AuthRequest) error {
 
 	// Fetch existing account data. It's fine if no existing data is found. In that case we'll create
 	// a new entry in the database
-	if err := h.Storage.Get(acc); err != nil && err != ErrNotFound {
-		return err
+	if err := tx.Get(acc); err != nil && err != ErrNotFound {
+		return nil, err
 	}
 
+	var revoked []string
+
 	// Revoke existing tokens with the same device UUID
 	if at.Device != nil && at.Device.UUID != "" {
 		t := &AuthToken{
@@ -229,7 +252,9 @@ func (h *ActivateAuthToken) Activate(authRequest *AuthRequest) error {
 		}
 
 		// Do this until no more tokens with the same UUID are found
-		for acc.RemoveAuthToken(t) {
+		for _, old := acc.findAuthToken(t); old != nil; _, old = acc.findAuthToken(t) {
+			revoked = append(revoked, old.Id)
+			acc.RemoveAuthToken(old)
 		}
 	}
 
@@ -237,16 +262,19 @@ func (h *ActivateAuthToken) Activate(authRequest *AuthRequest) error {
 	acc.AddAuthToken(at)
 
 	// Save the changes
-	if err := h.Storage.Put(acc); err != nil {
-		return err
+	if err := tx.Put(acc); err != nil {
+		return nil, err
 	}
 
-	// Delete the authentication request from the database
-	if err := h.Storage.Delete(authRequest); err != nil {
-		return err
+	// Requests sent out as vault invites also grant access to the shared vault
+	if authRequest.SharedVault != "" {
+		if err := acceptVaultInvite(tx, authRequest.SharedVault, at.Email); err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	// Delete the authentication request from the database
+	return revoked, tx.Delete(authRequest)
 }
 
 func (h *ActivateAuthToken) SetAuthCookie(w http.ResponseWriter, at *AuthToken) {
@@ -271,7 +299,16 @@ func (h *ActivateAuthToken) Success(w http.ResponseWriter, r *http.Request, auth
 		redirect = "/dashboard/"
 	}
 
-	if at.Type == "api" && authRequest.Code == "" {
+	acc := &Account{Email: at.Email}
+	if err := h.Storage.Get(acc); err != nil {
+		return err
+	}
+
+	// Pairing a device only logs into the dashboard if this doesn't skip a second factor required for
+	// web logins
+	skipsTOTP := acc.RequiresTOTP("web") && !acc.RequiresTOTP(at.Type)
+
+	if at.Type == "api" && authRequest.Code == "" && !skipsTOTP {
 		// If auth type is "api" also log them in so they can be redirected to dashboard
 		// But only if the activation type is not "code"
 		login, err := NewAuthRequest(at.Email, "web", "", at.Device)
@@ -316,6 +353,24 @@ func (h *ActivateAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth
 		}
 	}
 
+	if authRequest.DeleteAccount {
+		// Deletion codes are entered by the account owner, while links may be opened by mail scanners
+		// or prefetching without the owner noticing. Links therefore only lead to a confirmation page
+		if authRequest.Token != "" {
+			return (&CSRF{h.Server}).Protect(w, r, func(w http.ResponseWriter, r *http.Request) error {
+				if r.Method != "POST" {
+					return h.DeleteAccountPage(w, r, authRequest)
+				}
+				return h.ConfirmAccountDeletion(w, r, authRequest)
+			})
+		}
+		return h.ConfirmAccountDeletion(w, r, authRequest)
+	}
+
+	if ok, err := h.VerifySecondFactor(w, r, authRequest); !ok || err != nil {
+		return err
+	}
+
 	if err := h.Activate(authRequest); err != nil {
 		return err
 	}
@@ -323,212 +378,1408 @@ func (h *ActivateAuthToken) Handle(w http.ResponseWriter, r *http.Request, auth
 	return h.Success(w, r, authRequest)
 }
 
-type ReadStore struct {
-	*Server
-}
+// Checks the TOTP code submitted as `totp` parameter if the account has two-factor authentication enabled
+// for the type of auth token requested. Html clients are shown a page for entering the code instead of an
+// error, in which case false is returned without an error. After too many invalid codes, the account is
+// locked temporarily, see `TOTP.Attempt`
+func (h *ActivateAuthToken) VerifySecondFactor(w http.ResponseWriter, r *http.Request, authRequest *AuthRequest) (bool, error) {
+	acc := &Account{Email: authRequest.AuthToken.Email}
+	if err := h.Storage.Get(acc); err == ErrNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
 
-// Handler function for retrieving the data associated with a given account
-func (h *ReadStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	acc := auth.Account()
+	if !acc.RequiresTOTP(authRequest.AuthToken.Type) {
+		return true, nil
+	}
 
-	// Retrieve data from database. If not database entry is found, the `Content` field simply stays empty.
-	// This is not considered an error. Instead we simply return an empty response body. Clients should
-	// know how to deal with this.
-	data := &DataStore{Account: acc}
-	if err := h.Storage.Get(data); err != nil && err != ErrNotFound {
-		return err
+	code := r.PostFormValue("totp")
+
+	err := VerifyTOTP(h.Storage, acc.Email, code)
+	if err == nil {
+		return true, nil
 	}
 
-	h.Info.Printf("%s - data_store:read - %s\n", FormatRequest(r), acc.Email)
+	if _, ok := err.(*InvalidTOTPCode); ok {
+		h.Info.Printf("%s - auth_token:invalid_totp - %s\n", FormatRequest(r), acc.Email)
+	} else if _, ok := err.(*TOTPRequired); !ok {
+		return false, err
+	}
 
-	// Return raw data in response body
-	w.Write(data.Content)
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false, err
+	}
 
-	return nil
+	var b bytes.Buffer
+	if err := h.Templates.TOTPPage.Execute(&b, map[string]interface{}{
+		"token":   authRequest.Token,
+		"email":   authRequest.AuthToken.Email,
+		"code":    authRequest.Code,
+		"invalid": code != "",
+	}); err != nil {
+		return false, err
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	b.WriteTo(w)
+
+	return false, nil
 }
 
-type WriteStore struct {
-	*Server
+// Renders the page for confirming an account deletion requested through the given auth request. The
+// deletion is only carried out once the form on the page is submitted
+func (h *ActivateAuthToken) DeleteAccountPage(w http.ResponseWriter, r *http.Request, authRequest *AuthRequest) error {
+	var b bytes.Buffer
+	if err := h.Templates.DeleteAccountPage.Execute(&b, map[string]interface{}{
+		"email":         authRequest.AuthToken.Email,
+		"token":         authRequest.Token,
+		"grace_period":  h.Config.DeletionGracePeriod > 0,
+		CSRFTemplateTag: CSRFTemplateField(r),
+	}); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	b.WriteTo(w)
+
+	return nil
 }
 
-// Handler function for updating the data associated with a given account. This does NOT implement a
-// diffing algorith of any kind since Padlock Cloud is completely ignorant of the data structures involved.
-// Instead, clients should retrieve existing data through the `ReadStore` endpoint first, perform any necessary
-// decryption/parsing, consolidate the data with any existing local data and then reupload the full,
-// encrypted data set
-func (h *WriteStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	acc := auth.Account()
+// Carries out the account deletion confirmed through the given auth request. If a deletion grace period
+// is configured, the account is only scheduled for deletion and its owner receives an email with a link
+// for undoing it
+func (h *ActivateAuthToken) ConfirmAccountDeletion(w http.ResponseWriter, r *http.Request, authRequest *AuthRequest) error {
+	email := authRequest.AuthToken.Email
+	grace := h.Config.DeletionGracePeriod
+
+	var d *PendingDeletion
+
+	// The auth request is used up within the same transaction as the deletion, so the link remains valid
+	// if the deletion fails and can't be used twice
+	if err := h.Storage.Update(func(tx StorageTx) error {
+		existing := &AuthRequest{Token: authRequest.Token, Code: authRequest.Code, AuthToken: &AuthToken{Email: email}}
+		if err := tx.Get(existing); err == ErrNotFound {
+			return &BadRequest{"invalid activation token"}
+		} else if err != nil {
+			return err
+		}
 
-	// Read data from request body into `DataStore` instance
-	data := &DataStore{Account: acc}
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+		if err := tx.Delete(authRequest); err != nil {
+			return err
+		}
+
+		if grace == 0 {
+			return removeAccount(h.Storage, tx, email)
+		}
+
+		var err error
+		d, err = scheduleDeletion(tx, email, "", grace)
+		return err
+	}); err != nil {
 		return err
 	}
-	data.Content = content
 
-	// Update database entry
-	if err := h.Storage.Put(data); err != nil {
+	html := strings.Contains(r.Header.Get("Accept"), "text/html")
+
+	if grace == 0 {
+		// None of the accounts auth tokens are valid anymore
+		h.Events.Disconnect(email, "")
+
+		h.Info.Printf("%s - account:delete - %s\n", FormatRequest(r), email)
+
+		if html {
+			http.Redirect(w, r, "/login/", http.StatusFound)
+		}
+		return nil
+	}
+
+	if err := h.SendDeletionEmail(r, d); err != nil {
 		return err
 	}
 
-	h.Info.Printf("%s - data_store:write - %s\n", FormatRequest(r), acc.Email)
+	h.Info.Printf("%s - account:schedule_delete - %s\n", FormatRequest(r), email)
 
-	// Return with NO CONTENT status code
-	w.WriteHeader(http.StatusNoContent)
+	if html {
+		http.Redirect(w, r, "/dashboard/?action=deletion-scheduled", http.StatusFound)
+		return nil
+	}
+
+	res, err := json.Marshal(d.ToMap())
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(res)
 
 	return nil
 }
 
-type DeleteStore struct {
-	*Server
+// Checks whether a list of entity tags as sent in the `If-Match` or `If-None-Match` headers
+// contains the entity tag `etag`. If `weak` is true, weak entity tags are compared by their
+// opaque value; otherwise they never match
+func matchETag(header string, etag string, weak bool) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == etag {
+			return true
+		}
+	}
+	return false
 }
 
-func (h *DeleteStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	acc := auth.Account()
+// Evaluates the `If-Match` and `If-None-Match` headers of a request against the current state of a
+// data store. Returns a `PreconditionFailed` error if any of the conditions is not met
+func checkStorePreconditions(r *http.Request, data *DataStore, exists bool) error {
+	etag := data.ETag()
 
-	if err := h.Storage.Delete(&DataStore{Account: acc}); err != nil {
-		return err
+	if im := r.Header.Get("If-Match"); im != "" {
+		if im == "*" && !exists || im != "*" && !matchETag(im, etag, false) {
+			return &PreconditionFailed{etag}
+		}
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if inm == "*" && exists || inm != "*" && matchETag(inm, etag, true) {
+			return &PreconditionFailed{etag}
+		}
 	}
 
-	http.Redirect(w, r, "/dashboard/?action=reset", http.StatusFound)
 	return nil
 }
 
-type DeleteAccount struct {
-	*Server
+// Returns true if the client accepts gzip-compressed responses, as indicated by the `Accept-Encoding` header
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if name := strings.TrimSpace(parts[0]); name != "gzip" && name != "*" {
+			continue
+		}
+
+		// Encodings with a quality value of 0 are not acceptable
+		for _, param := range parts[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	return false
 }
 
-func (h *DeleteAccount) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	return h.DeleteAccount(auth.Email)
+// Reads the request body, decompressing it according to the `Content-Encoding` header. Fails with a
+// `StoreQuotaExceeded` error as soon as the (decompressed) body exceeds `quota` bytes, unless `quota` is 0
+func readBody(r *http.Request, quota int64) ([]byte, error) {
+	switch enc := strings.TrimSpace(r.Header.Get("Content-Encoding")); enc {
+	case "", "identity":
+		if quota > 0 && r.ContentLength > quota {
+			return nil, &StoreQuotaExceeded{quota}
+		}
+		return ioutil.ReadAll(limitReader(r.Body, quota))
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, &BadRequest{"invalid gzip data"}
+		}
+		defer gz.Close()
+
+		content, err := ioutil.ReadAll(limitReader(gz, quota))
+		if _, ok := err.(*StoreQuotaExceeded); ok {
+			return nil, err
+		} else if err != nil {
+			return nil, &BadRequest{"invalid gzip data"}
+		}
+		return content, nil
+	default:
+		return nil, &UnsupportedContentEncoding{enc}
+	}
 }
 
-type LoginPage struct {
+type ReadStore struct {
 	*Server
 }
 
-func (h *LoginPage) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	var b bytes.Buffer
-	if err := h.Templates.LoginPage.Execute(&b, nil); err != nil {
+// Handler function for retrieving the data associated with a given account. Requests to `/store/` read
+// the default vault while requests to `/store/{name}/` read the vault with the given name. Vaults shared
+// by other accounts can be read via `/store/{owner}/{name}/`
+func (h *ReadStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc, vault, err := authorizeVault(h.Storage, r.URL.Path, "/store/", auth, VaultRoleRead)
+	if err != nil {
 		return err
 	}
 
-	b.WriteTo(w)
+	// Retrieve data from database. If not database entry is found, the `Content` field simply stays empty.
+	// This is not considered an error for the default vault. Instead we simply return an empty response body.
+	// Clients should know how to deal with this. Named vaults on the other hand have to be created first
+	data := &DataStore{Account: acc, Vault: vault}
+	exists := true
+	if err := h.Storage.Get(data); err == ErrNotFound {
+		if vault != "" {
+			return &VaultNotFound{vault}
+		}
+		exists = false
+	} else if err != nil {
+		return err
+	}
+
+	etag := data.ETag()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	// Clients that already have the current revision don't need to download it again
+	if inm := r.Header.Get("If-None-Match"); inm != "" && (exists && inm == "*" || matchETag(inm, etag, true)) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	h.Info.Printf("%s - data_store:read - %s\n", FormatRequest(r), data.Key())
+
+	// Return raw data in response body, compressing it if supported by the client. The entity tag
+	// identifies the revision regardless of the encoding, so it can be used for conditional updates
+	if acceptsGzip(r) && len(data.Content) > 0 {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		if _, err := gz.Write(data.Content); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+
+	w.Write(data.Content)
 
 	return nil
 }
 
-type Dashboard struct {
+type WriteStore struct {
 	*Server
 }
 
-func DashboardParams(r *http.Request, auth *AuthToken) map[string]interface{} {
-	acc := auth.Account()
+// Handler function for updating the data associated with a given account. This does NOT implement a
+// diffing algorith of any kind since Padlock Cloud is completely ignorant of the data structures involved.
+// Instead, clients should retrieve existing data through the `ReadStore` endpoint first, perform any necessary
+// decryption/parsing, consolidate the data with any existing local data and then reupload the full,
+// encrypted data set. To avoid overwriting changes made by other devices in the meantime, clients
+// should send the entity tag of the revision they based their changes on via the `If-Match` header.
+// Like `ReadStore`, this handler writes to the default vault unless a vault name is given in the path
+func (h *WriteStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc, vault, err := authorizeVault(h.Storage, r.URL.Path, "/store/", auth, VaultRoleWrite)
+	if err != nil {
+		return err
+	}
 
-	params := map[string]interface{}{
-		"auth":          auth,
-		"account":       acc.ToMap(),
-		"action":        r.URL.Query().Get("action"),
-		CSRFTemplateTag: CSRFTemplateField(r),
-		"csrfToken":     CSRFToken(r),
+	if err := checkVaultExists(h.Storage, acc, vault); err != nil {
+		return err
 	}
 
-	tokenId := r.URL.Query().Get("token-id")
-	if _, token := acc.findAuthToken(&AuthToken{Id: tokenId}); token != nil {
-		params["token"] = token.ToMap()
+	// Read data from request body
+	quota := acc.StoreQuota(h.Config.MaxStoreSize)
+	content, err := readBody(r, quota)
+	if err != nil {
+		return err
 	}
 
-	return params
-}
+	data := &DataStore{Account: acc, Vault: vault}
+	conditional := r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+
+	// Check the preconditions within the same transaction as the write, so concurrent writes based on
+	// the same revision can't both succeed. The new content and its history revision count towards the
+	// quota along with the accounts other vaults
+	if err := updateWithinQuota(h.Storage, acc, quota, func(tx StorageTx) error {
+		// Only fetch the existing data if the client asked for a conditional update
+		if conditional {
+			exists := true
+			if err := tx.Get(data); err == ErrNotFound {
+				exists = false
+			} else if err != nil {
+				return err
+			}
 
-func (h *Dashboard) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	var b bytes.Buffer
-	if err := h.Templates.Dashboard.Execute(&b, DashboardParams(r, auth)); err != nil {
+			if err := checkStorePreconditions(r, data, exists); err != nil {
+				// Let the client know about the current revision so it can fetch it and try again
+				w.Header().Set("ETag", data.ETag())
+				return err
+			}
+		}
+
+		data.Content = content
+
+		return putDataStore(tx, data, auth, &h.Config.History)
+	}); err != nil {
 		return err
 	}
-	b.WriteTo(w)
+
+	if err := h.PublishStoreEvent(StoreEventUpdate, data, auth); err != nil {
+		h.LogError(&ServerError{err}, r)
+	}
+
+	h.Info.Printf("%s - data_store:write - %s\n", FormatRequest(r), data.Key())
+
+	w.Header().Set("ETag", data.ETag())
+
+	// Return with NO CONTENT status code
+	w.WriteHeader(http.StatusNoContent)
+
 	return nil
 }
 
-type Logout struct {
+type ReadStoreHistory struct {
 	*Server
 }
 
-func (h *Logout) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	acc := auth.Account()
+// Handler function for listing previous revisions of the data associated with a given account,
+// most recent revision first. The vault is selected the same way as in `ReadStore`
+func (h *ReadStoreHistory) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc, vault, err := authorizeVault(h.Storage, r.URL.Path, "/store/history/", auth, VaultRoleRead)
+	if err != nil {
+		return err
+	}
 
-	acc.RemoveAuthToken(auth)
-	if err := h.Storage.Put(acc); err != nil {
+	if err := checkVaultExists(h.Storage, acc, vault); err != nil {
 		return err
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth",
-		Value:    "",
-		MaxAge:   -1,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   h.Secure,
-	})
 
-	if strings.Contains(r.Header.Get("Accept"), "text/html") {
-		http.Redirect(w, r, "/login/", http.StatusFound)
+	history := &StoreHistory{Account: acc, Vault: vault}
+	if err := h.Storage.Get(history); err != nil && err != ErrNotFound {
+		return err
 	}
 
-	h.Info.Printf("%s - data_store:write - %s\n", FormatRequest(r), acc.Email)
+	res, err := json.Marshal(history.ToMap())
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+
 	return nil
 }
 
-type Revoke struct {
+type RestoreStore struct {
 	*Server
 }
 
-func (h *Revoke) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	token := r.PostFormValue("token")
+// Handler function for restoring a previous revision of the data associated with a given account.
+// Expects the `id` of the revision to restore as a form parameter
+func (h *RestoreStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
 	id := r.PostFormValue("id")
-	if token == "" && id == "" {
-		return &BadRequest{"No token or id provided"}
+	if id == "" {
+		return &BadRequest{"no revision id provided"}
 	}
 
-	acc := auth.Account()
-
-	t := &AuthToken{Token: token, Id: id}
-	if _, t = acc.findAuthToken(t); t == nil {
-		return &BadRequest{"No such token"}
+	acc, vault, err := authorizeVault(h.Storage, r.URL.Path, "/store/history/", auth, VaultRoleWrite)
+	if err != nil {
+		return err
 	}
 
-	t.Expires = time.Now().Add(-time.Minute)
-
-	acc.UpdateAuthToken(t)
+	if err := checkVaultExists(h.Storage, acc, vault); err != nil {
+		return err
+	}
 
-	if err := h.Storage.Put(acc); err != nil {
+	data, err := RestoreDataStore(h.Storage, acc, vault, id, auth, &h.Config.History, acc.StoreQuota(h.Config.MaxStoreSize))
+	if err == ErrNotFound {
+		return &BadRequest{"no such revision"}
+	} else if err != nil {
 		return err
 	}
 
+	if err := h.PublishStoreEvent(StoreEventUpdate, data, auth); err != nil {
+		h.LogError(&ServerError{err}, r)
+	}
+
+	h.Info.Printf("%s - data_store:restore - %s:%s\n", FormatRequest(r), data.Key(), id)
+
 	if strings.Contains(r.Header.Get("Accept"), "text/html") {
-		http.Redirect(w, r, fmt.Sprintf("/dashboard/?action=revoked&token-id=%s", t.Id), http.StatusFound)
+		http.Redirect(w, r, "/dashboard/?action=restored", http.StatusFound)
+		return nil
 	}
 
+	w.Header().Set("ETag", data.ETag())
+	w.WriteHeader(http.StatusNoContent)
+
 	return nil
 }
 
-type AccountInfo struct {
+type ReadChanges struct {
 	*Server
 }
 
-func (h *AccountInfo) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
-	acc := auth.Account()
+// Handler function for fetching the changes appended to the change log of a vault after the sequence
+// number given as `since` query parameter. If some of these changes have been compacted, the current
+// snapshot is returned along with them. Vaults are addressed the same way as in `ReadStore`
+func (h *ReadChanges) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc, vault, err := authorizeVault(h.Storage, r.URL.Path, "/changes/", auth, VaultRoleRead)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVaultExists(h.Storage, acc, vault); err != nil {
+		return err
+	}
+
+	var since int64
+	if s := r.URL.Query().Get("since"); s != "" {
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil || since < 0 {
+			return &BadRequest{"invalid sequence number"}
+		}
+	}
 
-	res, err := json.Marshal(acc.ToMap())
+	log := &ChangeLog{Account: acc, Vault: vault}
+	if err := LoadChangeLog(h.Storage, log, since); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	res, err := json.Marshal(log.Since(since))
 	if err != nil {
 		return err
 	}
 
+	h.Info.Printf("%s - change_log:read - %s:%d\n", FormatRequest(r), log.Key(), since)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(res)
 
 	return nil
 }
 
+type WriteChanges struct {
+	*Server
+}
+
+// Handler function for appending the (encrypted) change contained in the request body to the change log
+// of a vault. Responds with the sequence number assigned to the change
+func (h *WriteChanges) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc, vault, err := authorizeVault(h.Storage, r.URL.Path, "/changes/", auth, VaultRoleWrite)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVaultExists(h.Storage, acc, vault); err != nil {
+		return err
+	}
+
+	quota := acc.StoreQuota(h.Config.MaxStoreSize)
+	content, err := readBody(r, quota)
+	if err != nil {
+		return err
+	}
+
+	if len(content) == 0 {
+		return &BadRequest{"empty change"}
+	}
+
+	log := &ChangeLog{Account: acc, Vault: vault}
+	change, err := AppendChange(h.Storage, log, content, auth, quota)
+	if err != nil {
+		return err
+	}
+
+	if err := h.PublishChangeEvent(StoreEventChange, log, change.Seq, auth); err != nil {
+		h.LogError(&ServerError{err}, r)
+	}
+
+	h.Info.Printf("%s - change_log:append - %s:%d\n", FormatRequest(r), log.Key(), change.Seq)
+
+	res, err := json.Marshal(map[string]int64{"seq": change.Seq})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(res)
+
+	return nil
+}
+
+type CompactChanges struct {
+	*Server
+}
+
+// Handler function for compacting the change log of a vault. The request body replaces the current
+// snapshot and all changes up to the sequence number given as `seq` query parameter
+func (h *CompactChanges) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc, vault, err := authorizeVault(h.Storage, r.URL.Path, "/changes/", auth, VaultRoleWrite)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVaultExists(h.Storage, acc, vault); err != nil {
+		return err
+	}
+
+	seq, err := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil || seq < 0 {
+		return &BadRequest{"invalid sequence number"}
+	}
+
+	quota := acc.StoreQuota(h.Config.MaxStoreSize)
+	snapshot, err := readBody(r, quota)
+	if err != nil {
+		return err
+	}
+
+	log := &ChangeLog{Account: acc, Vault: vault}
+	if err := CompactChangeLog(h.Storage, log, seq, snapshot, quota); err != nil {
+		return err
+	}
+
+	// Clients that are behind need to fetch the new snapshot
+	if err := h.PublishChangeEvent(StoreEventCompact, log, seq, auth); err != nil {
+		h.LogError(&ServerError{err}, r)
+	}
+
+	h.Info.Printf("%s - change_log:compact - %s:%d\n", FormatRequest(r), log.Key(), seq)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type DeleteStore struct {
+	*Server
+}
+
+// Handler function for resetting the data of an account from the dashboard. If a `vault` is provided
+// as form parameter, the vault with that name is deleted instead. If a deletion grace period is
+// configured, the deletion is only scheduled
+func (h *DeleteStore) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := auth.Account()
+
+	vault := r.PostFormValue("vault")
+
+	if h.Config.DeletionGracePeriod > 0 {
+		if vault == "" {
+			vault = DefaultVault
+		}
+
+		if err := checkVaultExists(h.Storage, acc, vault); err != nil {
+			return err
+		}
+
+		d, err := ScheduleDeletion(h.Storage, acc.Email, vault, h.Config.DeletionGracePeriod)
+		if err != nil {
+			return err
+		}
+
+		if err := h.SendDeletionEmail(r, d); err != nil {
+			return err
+		}
+
+		h.Info.Printf("%s - data_store:schedule_delete - %s:%s\n", FormatRequest(r), acc.Email, vault)
+
+		http.Redirect(w, r, "/dashboard/?action=deletion-scheduled", http.StatusFound)
+		return nil
+	}
+
+	// Determine who to notify before the sharing settings are removed along with the vault
+	data := &DataStore{Account: acc, Vault: vault}
+	if vault == DefaultVault {
+		data.Vault = ""
+	}
+	recipients, err := h.storeEventRecipients(data)
+	if err != nil {
+		return err
+	}
+
+	if err := DeleteVault(h.Storage, acc, vault); err != nil {
+		return err
+	}
+
+	h.Events.Publish(NewStoreEvent(StoreEventDelete, data, auth), recipients...)
+
+	if vault != "" && vault != DefaultVault {
+		http.Redirect(w, r, "/dashboard/?action=vault-deleted", http.StatusFound)
+	} else {
+		http.Redirect(w, r, "/dashboard/?action=reset", http.StatusFound)
+	}
+	return nil
+}
+
+type ReadVaults struct {
+	*Server
+}
+
+// Handler function for listing the vaults of an account, followed by the vaults shared with it
+func (h *ReadVaults) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	if r.URL.Path != "/vaults/" {
+		return &UnsupportedEndpoint{r.URL.Path}
+	}
+
+	vaults, err := GetVaults(h.Storage, auth.Account())
+	if err != nil {
+		return err
+	}
+
+	shared, err := GetSharedVaults(h.Storage, auth.Account())
+	if err != nil {
+		return err
+	}
+	vaults = append(vaults, shared...)
+
+	list := make([]map[string]interface{}, 0, len(vaults))
+	for _, vault := range vaults {
+		list = append(list, vault.ToMap())
+	}
+
+	res, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+
+	return nil
+}
+
+type AddVault struct {
+	*Server
+}
+
+// Handler function for creating a new vault. Expects the `name` of the vault as a form parameter
+func (h *AddVault) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	name := r.PostFormValue("name")
+	if name == "" {
+		return &BadRequest{"no vault name provided"}
+	}
+
+	if !ValidVaultName(name) {
+		return &BadRequest{"invalid vault name"}
+	}
+
+	acc := auth.Account()
+
+	if err := CreateVault(h.Storage, acc, name, acc.StoreQuota(h.Config.MaxStoreSize), h.Config.MaxVaults); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - vault:create - %s:%s\n", FormatRequest(r), acc.Email, name)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=vault-created", http.StatusFound)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	return nil
+}
+
+type RemoveVault struct {
+	*Server
+}
+
+// Handler function for deleting the vault named in the request path along with its history
+func (h *RemoveVault) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	owner, vault, err := vaultFromPath(r.URL.Path, "/vaults/")
+	if err != nil {
+		return err
+	}
+
+	if vault == "" {
+		return &BadRequest{"the default vault can't be deleted"}
+	}
+
+	// Only owners may delete a vault. Members can leave a vault via the `/unshare/` endpoint instead
+	if owner != "" && owner != auth.Email {
+		return &VaultAccessDenied{vault}
+	}
+
+	acc := auth.Account()
+
+	data := &DataStore{Account: acc, Vault: vault}
+	recipients, err := h.storeEventRecipients(data)
+	if err != nil {
+		return err
+	}
+
+	if err := DeleteVault(h.Storage, acc, vault); err != nil {
+		return err
+	}
+
+	h.Events.Publish(NewStoreEvent(StoreEventDelete, data, auth), recipients...)
+
+	h.Info.Printf("%s - vault:delete - %s:%s\n", FormatRequest(r), acc.Email, vault)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type ReadVaultMembers struct {
+	*Server
+}
+
+// Handler function for listing the members of a vault. Expects the name of the vault as `vault` query
+// parameter. Only available to the owner of the vault
+func (h *ReadVaultMembers) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := auth.Account()
+	vault := r.URL.Query().Get("vault")
+
+	if err := checkVaultExists(h.Storage, acc, vault); err != nil {
+		return err
+	}
+
+	sv := &SharedVault{Owner: acc.Email, Vault: vault}
+	if err := h.Storage.Get(sv); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	res, err := json.Marshal(sv.ToMap())
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+
+	return nil
+}
+
+type ShareVault struct {
+	*Server
+}
+
+// Handler function for sharing a named vault with another account. Expects the `vault`, the `email` of
+// the invitee and optionally a `role` (either "read" or "write", defaults to "read") as form parameters.
+// The invitee receives an email with an activation link which logs them in and accepts the invite. Sharing
+// a vault with an existing member updates the members role
+func (h *ShareVault) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	vault := r.PostFormValue("vault")
+	email := r.PostFormValue("email")
+	role := r.PostFormValue("role")
+
+	if vault == "" || vault == DefaultVault {
+		return &BadRequest{"only named vaults can be shared"}
+	}
+
+	if email == "" {
+		return &BadRequest{"no email provided"}
+	}
+
+	if role == "" {
+		role = VaultRoleRead
+	}
+
+	if role != VaultRoleRead && role != VaultRoleWrite {
+		return &BadRequest{"unsupported role"}
+	}
+
+	acc := auth.Account()
+
+	if email == acc.Email {
+		return &BadRequest{"vaults can't be shared with their owner"}
+	}
+
+	if h.whitelist != nil && h.whitelist.IsWhitelisted(email) == false {
+		return &BadRequest{"invalid email address"}
+	}
+
+	if h.emailRateLimiter.RateLimit(IPFromRequest(r), email) {
+		h.Metrics.RecordRateLimitDenial("vault_invite")
+		return &RateLimitExceeded{}
+	}
+
+	sv, err := InviteVaultMember(h.Storage, acc, vault, email, role)
+	if err != nil {
+		return err
+	}
+
+	// Members that already accepted an earlier invite don't need to be invited again
+	if !sv.Member(email).Accepted {
+		authRequest, err := NewAuthRequest(email, "web", "", nil)
+		if err != nil {
+			return err
+		}
+
+		authRequest.SharedVault = string(sv.Key())
+
+		if err := h.Storage.Put(authRequest); err != nil {
+			return err
+		}
+
+		var emailBody bytes.Buffer
+		if err := h.Templates.VaultInviteEmail.Execute(&emailBody, map[string]interface{}{
+			"activation_link": fmt.Sprintf("%s/a/?t=%s", h.BaseUrl(r), authRequest.Token),
+			"owner":           acc.Email,
+			"vault":           vault,
+			"role":            role,
+		}); err != nil {
+			return err
+		}
+
+		go func() {
+			if err := h.SendEmail(email, fmt.Sprintf("%s shared a vault with you", acc.Email), emailBody.String()); err != nil {
+				h.LogError(&ServerError{err}, r)
+			}
+		}()
+	}
+
+	h.Info.Printf("%s - vault:share - %s:%s:%s:%s\n", FormatRequest(r), acc.Email, vault, email, role)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=vault-shared", http.StatusFound)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+
+	return nil
+}
+
+type UnshareVault struct {
+	*Server
+}
+
+// Handler function for removing a member from a shared vault. Expects the `vault` and the `email` of the
+// member as form parameters. Owners can remove any member, while members can leave a vault by providing
+// their own email along with the `owner` of the vault
+func (h *UnshareVault) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	vault := r.PostFormValue("vault")
+	email := r.PostFormValue("email")
+	owner := r.PostFormValue("owner")
+
+	if vault == "" || email == "" {
+		return &BadRequest{"no vault or email provided"}
+	}
+
+	if owner == "" {
+		owner = auth.Email
+	}
+
+	if owner != auth.Email && email != auth.Email {
+		return &VaultAccessDenied{vault}
+	}
+
+	if err := RemoveVaultMember(h.Storage, owner, vault, email); err == ErrNotFound {
+		return &BadRequest{"no such member"}
+	} else if err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - vault:unshare - %s:%s:%s\n", FormatRequest(r), owner, vault, email)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=vault-unshared", http.StatusFound)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type DeleteAccount struct {
+	*Server
+}
+
+// Handler function for requesting the deletion of an account. Since the auth token of a lost or stolen
+// device would otherwise suffice for wiping an account, the deletion has to be confirmed through a link
+// or code (if `actType` is "code") sent to the account owner first. See `ActivateAuthToken`
+func (h *DeleteAccount) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	actType := r.PostFormValue("actType")
+
+	authRequest, err := NewAuthRequest(auth.Email, "web", actType, nil)
+	if err != nil {
+		return err
+	}
+
+	authRequest.DeleteAccount = true
+
+	if err := h.Storage.Put(authRequest); err != nil {
+		return err
+	}
+
+	var emailBody bytes.Buffer
+	if err := h.Templates.DeleteAccountEmail.Execute(&emailBody, map[string]interface{}{
+		"email":        auth.Email,
+		"device":       auth.Description(),
+		"confirm_link": fmt.Sprintf("%s/a/?t=%s", h.BaseUrl(r), authRequest.Token),
+		"code":         authRequest.Code,
+	}); err != nil {
+		return err
+	}
+
+	emailSubj := "Confirm the deletion of your Padlock Cloud account"
+	if actType == "code" {
+		emailSubj = fmt.Sprintf("Your Padlock Account Deletion Code: %s", authRequest.Code)
+	}
+
+	go func() {
+		if err := h.SendEmail(auth.Email, emailSubj, emailBody.String()); err != nil {
+			h.LogError(&ServerError{err}, r)
+		}
+	}()
+
+	h.Info.Printf("%s - account:request_delete - %s:%s\n", FormatRequest(r), auth.Email, auth.Id)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=deletion-requested", http.StatusFound)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+
+	return nil
+}
+
+type UndoDeletion struct {
+	*Server
+}
+
+// Handler function for cancelling a pending deletion, either through the link sent to the account
+// owner or from the dashboard. Expects the undo token of the deletion as `t` parameter
+func (h *UndoDeletion) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	d, err := CancelDeletion(h.Storage, r.FormValue("t"))
+	if err == ErrNotFound {
+		return &BadRequest{"no such pending deletion"}
+	} else if err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - deletion:undo - %s\n", FormatRequest(r), d.Key())
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=deletion-undone", http.StatusFound)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type LoginPage struct {
+	*Server
+}
+
+func (h *LoginPage) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	var b bytes.Buffer
+	if err := h.Templates.LoginPage.Execute(&b, nil); err != nil {
+		return err
+	}
+
+	b.WriteTo(w)
+
+	return nil
+}
+
+type Dashboard struct {
+	*Server
+}
+
+func DashboardParams(r *http.Request, auth *AuthToken) map[string]interface{} {
+	acc := auth.Account()
+
+	params := map[string]interface{}{
+		"auth":          auth,
+		"account":       acc.ToMap(),
+		"action":        r.URL.Query().Get("action"),
+		CSRFTemplateTag: CSRFTemplateField(r),
+		"csrfToken":     CSRFToken(r),
+	}
+
+	tokenId := r.URL.Query().Get("token-id")
+	if _, token := acc.findAuthToken(&AuthToken{Id: tokenId}); token != nil {
+		params["token"] = token.ToMap()
+	}
+
+	return params
+}
+
+func (h *Dashboard) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	return h.Render(w, r, auth, DashboardParams(r, auth))
+}
+
+// Renders the dashboard, adding data like vaults, usage and pending deletions to `params`
+func (h *Dashboard) Render(w http.ResponseWriter, r *http.Request, auth *AuthToken, params map[string]interface{}) error {
+
+	history := &StoreHistory{Account: auth.Account()}
+	if err := h.Storage.Get(history); err != nil && err != ErrNotFound {
+		return err
+	}
+	params["account"].(map[string]interface{})["history"] = history.ToMap()
+
+	usage, err := GetStoreUsage(h.Storage, auth.Account(), h.Config.MaxStoreSize)
+	if err != nil {
+		return err
+	}
+	params["account"].(map[string]interface{})["usage"] = usage.ToMap()
+
+	vaults, err := GetVaults(h.Storage, auth.Account())
+	if err != nil {
+		return err
+	}
+	vaultList := make([]map[string]interface{}, 0, len(vaults))
+	for _, vault := range vaults {
+		vaultList = append(vaultList, vault.ToMap())
+	}
+	params["account"].(map[string]interface{})["vaults"] = vaultList
+
+	deletions, err := GetPendingDeletions(h.Storage, auth.Email)
+	if err != nil {
+		return err
+	}
+	deletionList := make([]map[string]interface{}, 0, len(deletions))
+	for _, d := range deletions {
+		deletionList = append(deletionList, d.ToMap())
+	}
+	params["account"].(map[string]interface{})["deletions"] = deletionList
+
+	// Show the secret while enrollment in two-factor authentication is pending
+	if totp := auth.Account().TOTP; totp != nil && !totp.Enabled {
+		params["account"].(map[string]interface{})["totp"] = map[string]interface{}{
+			"enabled": false,
+			"secret":  totp.Secret,
+			"uri":     totp.ProvisioningURI(auth.Email),
+		}
+	}
+
+	var b bytes.Buffer
+	if err := h.Templates.Dashboard.Execute(&b, params); err != nil {
+		return err
+	}
+	b.WriteTo(w)
+	return nil
+}
+
+type EnrollTOTP struct {
+	*Server
+}
+
+// Handler function for starting the enrollment in two-factor authentication. Generates a new secret
+// which has to be confirmed with a code from the authenticator app through `EnableTOTP`
+func (h *EnrollTOTP) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := &Account{Email: auth.Email}
+
+	totp, err := NewTOTP()
+	if err != nil {
+		return err
+	}
+
+	if err := h.Storage.Update(func(tx StorageTx) error {
+		if err := tx.Get(acc); err != nil {
+			return err
+		}
+
+		if acc.TOTP != nil && acc.TOTP.Enabled {
+			return &BadRequest{"two-factor authentication already enabled"}
+		}
+
+		acc.TOTP = totp
+		return tx.Put(acc)
+	}); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - totp:enroll - %s\n", FormatRequest(r), acc.Email)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=totp-enroll", http.StatusFound)
+		return nil
+	}
+
+	res, err := json.Marshal(map[string]string{
+		"secret": totp.Secret,
+		"uri":    totp.ProvisioningURI(acc.Email),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+
+	return nil
+}
+
+type EnableTOTP struct {
+	*Server
+}
+
+// Handler function for confirming the enrollment in two-factor authentication with the `code` from the
+// authenticator app. If `requireForApi` is set, codes are also required for pairing devices. Responds with
+// the recovery codes, which are only shown this once
+func (h *EnableTOTP) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := &Account{Email: auth.Email}
+	requireForApi := r.PostFormValue("requireForApi")
+
+	var codes []string
+
+	if err := h.Storage.Update(func(tx StorageTx) error {
+		if err := tx.Get(acc); err != nil {
+			return err
+		}
+
+		if acc.TOTP == nil || acc.TOTP.Enabled {
+			return &BadRequest{"no pending two-factor enrollment"}
+		}
+
+		var err error
+		if codes, err = acc.TOTP.Enable(r.PostFormValue("code"), requireForApi == "true" || requireForApi == "on"); err != nil {
+			return err
+		}
+
+		return tx.Put(acc)
+	}); err != nil {
+		return err
+	}
+
+	h.Info.Printf("%s - totp:enable - %s\n", FormatRequest(r), acc.Email)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		// Render the dashboard with the updated account
+		auth.account = acc
+		params := DashboardParams(r, auth)
+		params["action"] = "totp-enabled"
+		params["account"].(map[string]interface{})["recoveryCodes"] = codes
+		return (&Dashboard{h.Server}).Render(w, r, auth, params)
+	}
+
+	res, err := json.Marshal(map[string]interface{}{
+		"recoveryCodes": codes,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+
+	return nil
+}
+
+type DisableTOTP struct {
+	*Server
+}
+
+// Handler function for turning off two-factor authentication or cancelling a pending enrollment. Once
+// enabled, turning it off requires a valid `code`, which may also be a recovery code
+func (h *DisableTOTP) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := &Account{Email: auth.Email}
+
+	var result error
+
+	if err := h.Storage.Update(func(tx StorageTx) error {
+		if err := tx.Get(acc); err != nil {
+			return err
+		}
+
+		if acc.TOTP == nil {
+			return &BadRequest{"two-factor authentication not enabled"}
+		}
+
+		// Invalid codes count towards the same limit as when logging in
+		if acc.TOTP.Enabled {
+			result = acc.TOTP.Attempt(r.PostFormValue("code"), time.Now())
+			if _, ok := result.(*TOTPLocked); ok {
+				return nil
+			} else if result != nil {
+				return tx.Put(acc)
+			}
+		}
+
+		acc.TOTP = nil
+		return tx.Put(acc)
+	}); err != nil {
+		return err
+	}
+
+	if result != nil {
+		return result
+	}
+
+	h.Info.Printf("%s - totp:disable - %s\n", FormatRequest(r), acc.Email)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=totp-disabled", http.StatusFound)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type Logout struct {
+	*Server
+}
+
+func (h *Logout) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := &Account{Email: auth.Email}
+
+	if err := h.Storage.Update(func(tx StorageTx) error {
+		if err := tx.Get(acc); err != nil {
+			return err
+		}
+		acc.RemoveAuthToken(auth)
+		return tx.Put(acc)
+	}); err != nil {
+		return err
+	}
+	h.Events.Disconnect(acc.Email, auth.Id)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth",
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   h.Secure,
+	})
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login/", http.StatusFound)
+	}
+
+	h.Info.Printf("%s - data_store:write - %s\n", FormatRequest(r), acc.Email)
+	return nil
+}
+
+type Revoke struct {
+	*Server
+}
+
+func (h *Revoke) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	token := r.PostFormValue("token")
+	id := r.PostFormValue("id")
+	if token == "" && id == "" {
+		return &BadRequest{"No token or id provided"}
+	}
+
+	acc := &Account{Email: auth.Email}
+	t := &AuthToken{Token: token, Id: id}
+
+	if err := h.Storage.Update(func(tx StorageTx) error {
+		if err := tx.Get(acc); err != nil {
+			return err
+		}
+
+		if _, t = acc.findAuthToken(t); t == nil {
+			return &BadRequest{"No such token"}
+		}
+
+		t.Expires = time.Now().Add(-time.Minute)
+
+		acc.UpdateAuthToken(t)
+
+		return tx.Put(acc)
+	}); err != nil {
+		return err
+	}
+
+	// Revoked tokens can't be used for streaming events either
+	h.Events.Disconnect(acc.Email, t.Id)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, fmt.Sprintf("/dashboard/?action=revoked&token-id=%s", t.Id), http.StatusFound)
+	}
+
+	return nil
+}
+
+type AccountInfo struct {
+	*Server
+}
+
+func (h *AccountInfo) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := auth.Account()
+
+	usage, err := GetStoreUsage(h.Storage, acc, h.Config.MaxStoreSize)
+	if err != nil {
+		return err
+	}
+
+	info := acc.ToMap()
+	info["usage"] = usage.ToMap()
+
+	res, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+
+	return nil
+}
+
+type ExportAccount struct {
+	*Server
+}
+
+// Handler function for downloading all data associated with an account as a single archive, e.g. for
+// moving it to another instance. See `AccountExport` for the contents
+func (h *ExportAccount) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := auth.Account()
+
+	export, err := NewAccountExport(h.Storage, acc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"padlock-export.tar.gz\"")
+
+	if err := export.Write(w); err != nil {
+		// The response has already been started, so the client can only tell from the truncated archive
+		h.LogError(&ServerError{err}, r)
+		return nil
+	}
+
+	h.Info.Printf("%s - account:export - %s\n", FormatRequest(r), acc.Email)
+
+	return nil
+}
+
+type ImportAccount struct {
+	*Server
+}
+
+// Handler function for importing the vaults contained in an archive created through `ExportAccount`
+// into the authenticated account. Fails with a `VaultExists` error if any of the vaults already exists
+func (h *ImportAccount) Handle(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
+	acc := auth.Account()
+
+	export, err := ReadAccountExport(r.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := ImportAccountExport(h.Storage, acc, export, acc.StoreQuota(h.Config.MaxStoreSize)); err != nil {
+		return err
+	}
+
+	for _, vault := range export.Manifest.Vaults {
+		data := &DataStore{Account: acc, Vault: vault.Name, Content: export.Content[vault.Name]}
+		if vault.Name == DefaultVault {
+			data.Vault = ""
+		}
+		if err := h.PublishStoreEvent(StoreEventUpdate, data, auth); err != nil {
+			h.LogError(&ServerError{err}, r)
+		}
+	}
+
+	h.Info.Printf("%s - account:import - %s:%d\n", FormatRequest(r), acc.Email, len(export.Manifest.Vaults))
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/dashboard/?action=imported", http.StatusFound)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
 type StaticHandler struct {
 	fh http.Handler
 }
@@ -567,6 +1818,8 @@ type Endpoint struct {
 	Handlers map[string]Handler
 	Version  int
 	AuthType string
+	// Whether responses are streamed to the client over a long-lived connection
+	Streaming bool
 }
 
 func (endpoint *Endpoint) Handle(w http.ResponseWriter, r *http.Request, a *AuthToken) error {
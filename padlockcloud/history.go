@@ -0,0 +1,170 @@
+package padlockcloud
+
+import "encoding/json"
+import "time"
+
+// Configuration for keeping track of previous revisions of data stores
+type HistoryConfig struct {
+	// Number of revisions to keep per account. A value of 0 disables the revision history
+	Size int `yaml:"size"`
+	// Maximum age of revisions to keep. A value of 0 means revisions are kept regardless of their age
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// StoreRevision represents a single revision of a data store
+type StoreRevision struct {
+	// Identifier of the revision, derived from its content
+	Id string
+	// Time the revision was written
+	Created time.Time
+	// Id of the auth token used to write this revision
+	TokenId string
+	// Description of the device used to write this revision
+	Device  string
+	Content []byte
+}
+
+func (rev *StoreRevision) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":      rev.Id,
+		"created": rev.Created,
+		"size":    len(rev.Content),
+		"tokenId": rev.TokenId,
+		"device":  rev.Device,
+	}
+}
+
+// StoreHistory holds the most recent revisions of the data store associated with an account,
+// oldest revision first
+type StoreHistory struct {
+	Account *Account
+	// Name of the vault the history belongs to. Empty for the default vault
+	Vault     string
+	Revisions []*StoreRevision
+}
+
+// Implementation of the `Storable.Key` interface method
+func (h *StoreHistory) Key() []byte {
+	return vaultKey(h.Account.Email, h.Vault)
+}
+
+// Implementation of the `Storable.Deserialize` interface method
+func (h *StoreHistory) Deserialize(data []byte) error {
+	return json.Unmarshal(data, &h.Revisions)
+}
+
+// Implementation of the `Storable.Serialize` interface method
+func (h *StoreHistory) Serialize() ([]byte, error) {
+	return json.Marshal(h.Revisions)
+}
+
+// Returns the most recent revision with the given id or nil if no such revision exists
+func (h *StoreHistory) Find(id string) *StoreRevision {
+	for i := len(h.Revisions) - 1; i >= 0; i-- {
+		if h.Revisions[i].Id == id {
+			return h.Revisions[i]
+		}
+	}
+	return nil
+}
+
+// Adds a new revision, removing any revisions exceeding the limits specified in `config`
+func (h *StoreHistory) Add(rev *StoreRevision, config *HistoryConfig) {
+	h.Revisions = append(h.Revisions, rev)
+	h.Prune(config)
+}
+
+// Removes revisions exceeding the maximum number or age of revisions specified in `config`. The most
+// recent revision is always kept since it reflects the current state of the data store
+func (h *StoreHistory) Prune(config *HistoryConfig) {
+	if config.Size > 0 && len(h.Revisions) > config.Size {
+		h.Revisions = h.Revisions[len(h.Revisions)-config.Size:]
+	}
+
+	if config.MaxAge != 0 {
+		for len(h.Revisions) > 1 && h.Revisions[0].Created.Before(time.Now().Add(-config.MaxAge)) {
+			h.Revisions = h.Revisions[1:]
+		}
+	}
+}
+
+func (h *StoreHistory) ToMap() []map[string]interface{} {
+	revs := make([]map[string]interface{}, 0)
+	// List most recent revisions first
+	for i := len(h.Revisions) - 1; i >= 0; i-- {
+		revs = append(revs, h.Revisions[i].ToMap())
+	}
+	return revs
+}
+
+// Creates a new revision for the current content of a data store. `author` may be nil if the
+// revision was not written through an authenticated request
+func NewStoreRevision(data *DataStore, author *AuthToken) *StoreRevision {
+	rev := &StoreRevision{
+		Id:      data.Revision(),
+		Created: time.Now(),
+		Content: data.Content,
+	}
+
+	if author != nil {
+		rev.TokenId = author.Id
+		rev.Device = author.Description()
+	}
+
+	return rev
+}
+
+// Updates a data store and records the new content in the accounts store history
+func PutDataStore(storage Storage, data *DataStore, author *AuthToken, config *HistoryConfig) error {
+	return storage.Update(func(tx StorageTx) error {
+		return putDataStore(tx, data, author, config)
+	})
+}
+
+func putDataStore(tx StorageTx, data *DataStore, author *AuthToken, config *HistoryConfig) error {
+	if err := tx.Put(data); err != nil {
+		return err
+	}
+
+	if config.Size == 0 {
+		return nil
+	}
+
+	history := &StoreHistory{Account: data.Account, Vault: data.Vault}
+	if err := tx.Get(history); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	history.Add(NewStoreRevision(data, author), config)
+
+	return tx.Put(history)
+}
+
+// Restores the revision with the given `id` from the store history of one of the vaults of an account.
+// Fails with a `StoreQuotaExceeded` error if the storage used by the account would exceed `quota`
+func RestoreDataStore(storage Storage, acc *Account, vault string, id string, author *AuthToken, config *HistoryConfig, quota int64) (*DataStore, error) {
+	data := &DataStore{Account: acc, Vault: vault}
+
+	if err := updateWithinQuota(storage, acc, quota, func(tx StorageTx) error {
+		history := &StoreHistory{Account: acc, Vault: vault}
+		if err := tx.Get(history); err != nil && err != ErrNotFound {
+			return err
+		}
+
+		rev := history.Find(id)
+		if rev == nil {
+			return ErrNotFound
+		}
+
+		data.Content = rev.Content
+		return putDataStore(tx, data, author, config)
+	}); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func init() {
+	RegisterStorable(&StoreHistory{}, "data-store-history")
+}
@@ -0,0 +1,35 @@
+package padlockcloud
+
+import "testing"
+import "time"
+
+func TestStoreHistoryPrune(t *testing.T) {
+	history := &StoreHistory{}
+	config := &HistoryConfig{Size: 3, MaxAge: time.Hour}
+
+	for i := 0; i < 5; i++ {
+		history.Add(&StoreRevision{Id: string(rune('a' + i)), Created: time.Now()}, config)
+	}
+
+	if len(history.Revisions) != 3 || history.Revisions[0].Id != "c" {
+		t.Fatalf("Expected the 3 most recent revisions to be kept, got %d", len(history.Revisions))
+	}
+
+	if rev := history.Find("d"); rev == nil || rev.Id != "d" {
+		t.Fatal("Should find revision by id")
+	}
+
+	if rev := history.Find("a"); rev != nil {
+		t.Fatal("Should not find pruned revision")
+	}
+
+	// Revisions exceeding the maximum age should be removed, except for the most recent one
+	for _, rev := range history.Revisions {
+		rev.Created = time.Now().Add(-2 * time.Hour)
+	}
+	history.Prune(config)
+
+	if len(history.Revisions) != 1 || history.Revisions[0].Id != "e" {
+		t.Fatalf("Expected only the most recent revision to be kept, got %d", len(history.Revisions))
+	}
+}
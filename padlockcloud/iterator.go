@@ -0,0 +1,129 @@
+package padlockcloud
+
+import "bytes"
+import "errors"
+import "encoding/base64"
+
+// Returned when a page token could not be decoded
+var ErrInvalidPageToken = errors.New("padlock: invalid page token")
+
+// Wraps a `StorageIterator`, only returning records with keys starting with a given prefix
+type PrefixIterator struct {
+	StorageIterator
+	prefix []byte
+	done   bool
+}
+
+// Returns an iterator over all records of `iter` with keys starting with `prefix`
+func NewPrefixIterator(iter StorageIterator, prefix []byte) *PrefixIterator {
+	iter.Seek(prefix)
+	return &PrefixIterator{StorageIterator: iter, prefix: prefix}
+}
+
+func (iter *PrefixIterator) Next() bool {
+	if iter.done {
+		return false
+	}
+
+	if !iter.StorageIterator.Next() || !bytes.HasPrefix(iter.Key(), iter.prefix) {
+		// Keys are ordered so there can't be any more matching records
+		iter.done = true
+		return false
+	}
+
+	return true
+}
+
+func (iter *PrefixIterator) Seek(key []byte) {
+	if bytes.Compare(key, iter.prefix) < 0 {
+		key = iter.prefix
+	}
+	iter.StorageIterator.Seek(key)
+	iter.done = false
+}
+
+// Options for retrieving a single page of records
+type PageOptions struct {
+	// Only include records with keys starting with this prefix
+	Prefix []byte
+	// Token returned by the previous call to `IteratePage`. An empty token starts at the first record
+	Token string
+	// Maximum number of records per page. A value of 0 means no limit
+	Limit int
+}
+
+// Encodes a page token for continuing after a given key
+func encodePageToken(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+func decodePageToken(token string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	return key, nil
+}
+
+// Iterates over a single page of records of the type of `t`. For each record, `t` is populated and `fn`
+// is called with the key of the record. Returns a token for retrieving the next page, which is empty
+// if there are no more records
+func IteratePage(storage Storage, t Storable, opts *PageOptions, fn func(key []byte) error) (string, error) {
+	var after []byte
+	if opts.Token != "" {
+		key, err := decodePageToken(opts.Token)
+		if err != nil {
+			return "", err
+		}
+		after = key
+	}
+
+	i, err := storage.Iterator(t)
+	if err != nil {
+		return "", err
+	}
+	defer i.Release()
+
+	iter := StorageIterator(i)
+	if opts.Prefix != nil {
+		iter = NewPrefixIterator(iter, opts.Prefix)
+	}
+
+	if after != nil {
+		iter.Seek(after)
+	}
+
+	count := 0
+	var last []byte
+
+	for iter.Next() {
+		key := iter.Key()
+
+		// Seeking positions the iterator at the last key of the previous page
+		if after != nil && bytes.Equal(key, after) {
+			continue
+		}
+
+		if opts.Limit > 0 && count == opts.Limit {
+			return encodePageToken(last), nil
+		}
+
+		if err := iter.Get(t); err != nil {
+			return "", err
+		}
+
+		last = append([]byte{}, key...)
+		count++
+
+		if err := fn(last); err != nil {
+			return "", err
+		}
+	}
+
+	// Otherwise, a failed listing would look like the last page
+	if err := iter.Error(); err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
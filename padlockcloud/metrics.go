@@ -0,0 +1,298 @@
+package padlockcloud
+
+import "io"
+import "time"
+import "strconv"
+import "net/http"
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/prometheus/client_golang/prometheus/promhttp"
+import "github.com/prometheus/common/expfmt"
+
+type MetricsConfig struct {
+	// Collect and export metrics
+	Enabled bool `yaml:"enabled"`
+	// Address to serve metrics on separately from the main server, e.g. "127.0.0.1:9090". If empty,
+	// metrics are only served under /metrics by the admin interface, if enabled
+	Addr string `yaml:"addr"`
+}
+
+// Metrics collected by the server, exported in the Prometheus text format. The `Record*` and `Instrument`
+// methods are safe to call on a nil `*Metrics`, in which case nothing is recorded
+type Metrics struct {
+	Requests         *prometheus.CounterVec
+	RequestDuration  *prometheus.HistogramVec
+	Errors           *prometheus.CounterVec
+	StorageDuration  *prometheus.HistogramVec
+	Emails           *prometheus.CounterVec
+	RateLimitDenials *prometheus.CounterVec
+	Accounts         prometheus.Gauge
+	Devices          prometheus.Gauge
+	JobDuration      *prometheus.HistogramVec
+	// Storage cache to export hit and miss counts for, if any
+	Cache    *CachedStorage
+	registry *prometheus.Registry
+	handler  http.Handler
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "padlock_http_requests_total",
+			Help: "Number of HTTP requests by endpoint, method and status code",
+		}, []string{"path", "method", "code"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "padlock_http_request_duration_seconds",
+			Help: "Latency of HTTP requests by endpoint and method",
+		}, []string{"path", "method"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "padlock_errors_total",
+			Help: "Number of error responses by error code",
+		}, []string{"code"}),
+		StorageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "padlock_storage_operation_duration_seconds",
+			Help: "Latency of storage operations by operation and storable type",
+		}, []string{"operation", "type"}),
+		Emails: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "padlock_emails_total",
+			Help: "Number of emails by delivery status",
+		}, []string{"status"}),
+		RateLimitDenials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "padlock_rate_limit_denials_total",
+			Help: "Number of requests denied due to rate limiting",
+		}, []string{"limiter"}),
+		Accounts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "padlock_accounts",
+			Help: "Number of accounts",
+		}),
+		Devices: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "padlock_devices",
+			Help: "Number of active api auth tokens across all accounts",
+		}),
+		JobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "padlock_job_duration_seconds",
+			Help: "Duration of background job runs",
+		}, []string{"job"}),
+		registry: prometheus.NewRegistry(),
+	}
+
+	m.registry.MustRegister(
+		m.Requests,
+		m.RequestDuration,
+		m.Errors,
+		m.StorageDuration,
+		m.Emails,
+		m.RateLimitDenials,
+		m.Accounts,
+		m.Devices,
+		m.JobDuration,
+		&cacheCollector{m},
+	)
+
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+
+	return m
+}
+
+var (
+	cacheHitsDesc = prometheus.NewDesc("padlock_cache_hits_total",
+		"Number of storage cache hits by storable type", []string{"type"}, nil)
+	cacheMissesDesc = prometheus.NewDesc("padlock_cache_misses_total",
+		"Number of storage cache misses by storable type", []string{"type"}, nil)
+)
+
+// Collects the hit and miss counts of the storage cache, if any, at the time metrics are exported
+type cacheCollector struct {
+	metrics *Metrics
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.metrics.Cache == nil {
+		return
+	}
+
+	for typ, stats := range c.metrics.Cache.Stats() {
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits), typ)
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses), typ)
+	}
+}
+
+// Writes all metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) error {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, f := range families {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Implements the `http.Handler` interface for exporting metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// Records response status codes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Passes flushes on to the underlying response writer, e.g. for streaming responses
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Wraps a http handler, recording request counts and latencies for a given endpoint path
+func (m *Metrics) Instrument(path string, h http.Handler) http.Handler {
+	if m == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		h.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		m.Requests.WithLabelValues(path, r.Method, strconv.Itoa(rec.status)).Inc()
+		m.RequestDuration.WithLabelValues(path, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Implementation of the `Storage` interface that records latencies of storage operations
+type MeteredStorage struct {
+	Storage
+	Metrics *Metrics
+}
+
+// Returns the identifier string of the type of a storable for use as a label
+func storableLabel(t Storable) string {
+	if t == nil {
+		return ""
+	}
+	return StorableTypes[typeFromStorable(t)]
+}
+
+func (s *MeteredStorage) backend() Storage {
+	return s.Storage
+}
+
+// Records the latency of a storage operation started at `start`
+func (m *Metrics) observeStorage(start time.Time, operation string, typ string) {
+	m.StorageDuration.WithLabelValues(operation, typ).Observe(time.Since(start).Seconds())
+}
+
+func (s *MeteredStorage) Get(t Storable) error {
+	defer s.Metrics.observeStorage(time.Now(), "get", storableLabel(t))
+	return s.Storage.Get(t)
+}
+
+func (s *MeteredStorage) Put(t Storable) error {
+	defer s.Metrics.observeStorage(time.Now(), "put", storableLabel(t))
+	return s.Storage.Put(t)
+}
+
+func (s *MeteredStorage) Delete(t Storable) error {
+	defer s.Metrics.observeStorage(time.Now(), "delete", storableLabel(t))
+	return s.Storage.Delete(t)
+}
+
+func (s *MeteredStorage) Update(fn func(StorageTx) error) error {
+	defer s.Metrics.observeStorage(time.Now(), "update", "")
+	return s.Storage.Update(fn)
+}
+
+// Counts accounts and active devices
+func (m *Metrics) UpdateAccountStats(storage Storage) error {
+	if m == nil {
+		return nil
+	}
+
+	acc := &Account{}
+	iter, err := storage.Iterator(acc)
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	accounts, devices := 0, 0
+	for iter.Next() {
+		*acc = Account{}
+		if err := iter.Get(acc); err != nil {
+			return err
+		}
+
+		accounts++
+		for _, t := range acc.AuthTokens {
+			if t.Type == "api" && !t.Expired() {
+				devices++
+			}
+		}
+	}
+
+	m.Accounts.Set(float64(accounts))
+	m.Devices.Set(float64(devices))
+
+	return nil
+}
+
+func (m *Metrics) RecordError(code string) {
+	if m != nil {
+		m.Errors.WithLabelValues(code).Inc()
+	}
+}
+
+func (m *Metrics) RecordEmail(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.Emails.WithLabelValues("failed").Inc()
+	} else {
+		m.Emails.WithLabelValues("sent").Inc()
+	}
+}
+
+func (m *Metrics) RecordRateLimitDenial(limiter string) {
+	if m != nil {
+		m.RateLimitDenials.WithLabelValues(limiter).Inc()
+	}
+}
+
+func (m *Metrics) RecordJob(name string, start time.Time) {
+	if m != nil {
+		m.JobDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
+}
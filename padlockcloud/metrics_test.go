@@ -0,0 +1,45 @@
+package padlockcloud
+
+import "testing"
+import "bytes"
+import "errors"
+import "strings"
+import "time"
+
+func TestMetricsFormat(t *testing.T) {
+	m := NewMetrics()
+
+	m.RecordEmail(nil)
+	m.RecordEmail(errors.New("failed"))
+	m.RecordEmail(nil)
+	m.RecordRateLimitDenial("auth_request")
+	m.JobDuration.WithLabelValues("backup").Observe(0.02)
+	m.JobDuration.WithLabelValues("backup").Observe(3)
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+
+	for _, line := range []string{
+		"# TYPE padlock_emails_total counter",
+		`padlock_emails_total{status="failed"} 1`,
+		`padlock_emails_total{status="sent"} 2`,
+		`padlock_rate_limit_denials_total{limiter="auth_request"} 1`,
+		"# TYPE padlock_job_duration_seconds histogram",
+		`padlock_job_duration_seconds_bucket{job="backup",le="0.01"} 0`,
+		`padlock_job_duration_seconds_bucket{job="backup",le="0.025"} 1`,
+		`padlock_job_duration_seconds_bucket{job="backup",le="5"} 2`,
+		`padlock_job_duration_seconds_bucket{job="backup",le="+Inf"} 2`,
+		`padlock_job_duration_seconds_sum{job="backup"} 3.02`,
+		`padlock_job_duration_seconds_count{job="backup"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected output to contain '%s', got:\n%s", line, buf.String())
+		}
+	}
+
+	// Recording on nil metrics should be a no-op
+	var nilMetrics *Metrics
+	nilMetrics.RecordEmail(nil)
+	nilMetrics.RecordError("some_error")
+	nilMetrics.RecordJob("job", time.Now())
+}
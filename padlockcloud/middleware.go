@@ -40,12 +40,25 @@ func (m *CheckEndpointVersion) Wrap(h Handler) Handler {
 type Authenticate struct {
 	*Server
 	Type string
+	// Lock the account while authenticating. Used for endpoints that aren't wrapped in `LockAccount`
+	Lock bool
+}
+
+func (m *Authenticate) authenticate(r *http.Request) (*AuthToken, error) {
+	if m.Lock {
+		if t, _ := AuthTokenFromRequest(r); t != nil {
+			m.LockAccount(t.Email)
+			defer m.UnlockAccount(t.Email)
+		}
+	}
+
+	return m.Authenticate(r)
 }
 
 func (m *Authenticate) Wrap(h Handler) Handler {
 	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, _ *AuthToken) error {
 		// Get auth token from request
-		auth, err := m.Authenticate(r)
+		auth, err := m.authenticate(r)
 
 		// Endpoint requires authentation but no auth token could be aquired
 		if m.Type != "" && err != nil {
@@ -90,31 +103,39 @@ type CSRF struct {
 func (m *CSRF) Wrap(h Handler) Handler {
 	return HandlerFunc(func(w http.ResponseWriter, r *http.Request, auth *AuthToken) error {
 		if auth != nil && auth.Type == "web" {
-			// Wrap the handler function in a http.Handler; Capture error in `e` variable for
-			// later use. We need to do this because the csrf middleware only works with a http.Handler
-			var err error
-			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				err = h.Handle(w, r, auth)
+			return m.Protect(w, r, func(w http.ResponseWriter, r *http.Request) error {
+				return h.Handle(w, r, auth)
 			})
-
-			handler = csrf.Protect(
-				m.secret,
-				csrf.Path("/"),
-				csrf.Secure(m.Secure),
-				csrf.ErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					m.HandleError(&InvalidCsrfToken{csrf.FailureReason(r)}, w, r)
-				})),
-			)(handler)
-
-			handler.ServeHTTP(w, r)
-
-			return err
 		} else {
 			return h.Handle(w, r, auth)
 		}
 	})
 }
 
+// Runs `h` behind the csrf protection, regardless of how the request is authenticated. Requests
+// with unsafe methods are rejected unless they carry a valid csrf token
+func (m *CSRF) Protect(w http.ResponseWriter, r *http.Request, h func(http.ResponseWriter, *http.Request) error) error {
+	// Wrap the handler function in a http.Handler; Capture error in `e` variable for
+	// later use. We need to do this because the csrf middleware only works with a http.Handler
+	var err error
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err = h(w, r)
+	})
+
+	handler = csrf.Protect(
+		m.secret,
+		csrf.Path("/"),
+		csrf.Secure(m.Secure),
+		csrf.ErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.HandleError(&InvalidCsrfToken{csrf.FailureReason(r)}, w, r)
+		})),
+	)(handler)
+
+	handler.ServeHTTP(w, r)
+
+	return err
+}
+
 type HandleError struct {
 	*Server
 }
@@ -0,0 +1,183 @@
+package padlockcloud
+
+import "fmt"
+import "io"
+import "io/ioutil"
+import "bytes"
+import "sort"
+import "reflect"
+import "crypto/sha256"
+import "encoding/binary"
+
+// Number of records after which progress is reported during a migration
+const migrationProgressInterval = 1000
+
+// Counts for a single `Storable` type collected during a migration
+type MigrationStats struct {
+	// Number of records found in the source storage
+	Total int
+	// Number of records written to the target storage
+	Copied int
+	// Number of records already present in the target storage
+	Skipped int
+}
+
+// StorageMigration copies all records of all registered `Storable` types from one storage to another.
+// Records are copied as is, without deserializing them. Records already present in the target storage
+// with identical content are skipped, so an interrupted migration can simply be run again to resume it
+type StorageMigration struct {
+	From Storage
+	To   Storage
+	// If true, records are only counted and compared but not written
+	DryRun bool
+	// Progress reports are written here, if provided
+	Progress io.Writer
+	// Stats for each type, mapped by their identifier strings
+	Stats map[string]*MigrationStats
+}
+
+// Returns all registered `Storable` types, sorted by their identifier strings
+func sortedStorableTypes() []reflect.Type {
+	var types []reflect.Type
+	for typ := range StorableTypes {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return StorableTypes[types[i]] < StorableTypes[types[j]]
+	})
+	return types
+}
+
+func (m *StorageMigration) progress() io.Writer {
+	if m.Progress == nil {
+		return ioutil.Discard
+	}
+	return m.Progress
+}
+
+// Copies all records. Both storages need to be opened beforehand
+func (m *StorageMigration) Run() error {
+	m.Stats = make(map[string]*MigrationStats)
+
+	for _, typ := range sortedStorableTypes() {
+		loc := StorableTypes[typ]
+		stats := &MigrationStats{}
+		m.Stats[loc] = stats
+
+		if err := m.migrateType(typ, stats); err != nil {
+			return fmt.Errorf("Failed to migrate %s: %v", loc, err)
+		}
+
+		verb := "copied"
+		if m.DryRun {
+			verb = "to be copied"
+		}
+		fmt.Fprintf(m.progress(), "%s: %d records, %d %s, %d already present\n",
+			loc, stats.Total, stats.Copied, verb, stats.Skipped)
+	}
+
+	return nil
+}
+
+func (m *StorageMigration) migrateType(typ reflect.Type, stats *MigrationStats) error {
+	iter, err := m.From.Iterator(&rawStorable{typ: typ})
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		raw := &rawStorable{typ: typ, key: append([]byte{}, iter.Key()...)}
+		if err := iter.Get(raw); err != nil {
+			return err
+		}
+
+		stats.Total++
+
+		existing := &rawStorable{typ: typ, key: raw.key}
+		err := m.To.Get(existing)
+		if err == nil && bytes.Equal(existing.data, raw.data) {
+			stats.Skipped++
+		} else if err != nil && err != ErrNotFound {
+			return err
+		} else {
+			if !m.DryRun {
+				if err := m.To.Put(raw); err != nil {
+					return err
+				}
+			}
+			stats.Copied++
+		}
+
+		if stats.Total%migrationProgressInterval == 0 {
+			fmt.Fprintf(m.progress(), "%s: %d records processed\n", StorableTypes[typ], stats.Total)
+		}
+	}
+
+	return iter.Error()
+}
+
+// Compares record counts and checksums of both storages, returning an error if they differ
+func (m *StorageMigration) Verify() error {
+	for _, typ := range sortedStorableTypes() {
+		loc := StorableTypes[typ]
+
+		fromCount, fromSum, err := storageChecksum(m.From, typ)
+		if err != nil {
+			return err
+		}
+
+		toCount, toSum, err := storageChecksum(m.To, typ)
+		if err != nil {
+			return err
+		}
+
+		if fromCount != toCount {
+			return fmt.Errorf("Verification failed for %s: %d records in source, %d in target", loc, fromCount, toCount)
+		}
+
+		if !bytes.Equal(fromSum, toSum) {
+			return fmt.Errorf("Verification failed for %s: checksums do not match", loc)
+		}
+
+		fmt.Fprintf(m.progress(), "%s: %d records verified (checksum %x)\n", loc, toCount, toSum[:8])
+	}
+
+	return nil
+}
+
+// Counts all records of a given type and calculates a checksum over their keys and contents. Since
+// iterators return records in ascending key order, records are hashed one after another in that order
+func storageChecksum(s Storage, typ reflect.Type) (int, []byte, error) {
+	iter, err := s.Iterator(&rawStorable{typ: typ})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer iter.Release()
+
+	count := 0
+	h := sha256.New()
+	size := make([]byte, 8)
+
+	for iter.Next() {
+		raw := &rawStorable{typ: typ}
+		if err := iter.Get(raw); err != nil {
+			return 0, nil, err
+		}
+
+		// Prefix keys and contents with their lengths so record boundaries can't be shifted
+		for _, b := range [][]byte{iter.Key(), raw.data} {
+			binary.BigEndian.PutUint64(size, uint64(len(b)))
+			h.Write(size)
+			h.Write(b)
+		}
+
+		count++
+	}
+
+	if err := iter.Error(); err != nil {
+		return 0, nil, err
+	}
+
+	return count, h.Sum(nil), nil
+}
@@ -0,0 +1,131 @@
+package padlockcloud
+
+import "testing"
+import "io/ioutil"
+import "os"
+import "fmt"
+import "path/filepath"
+
+func TestStorageMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "db")}}
+	to := &BoltStorage{Config: &BoltConfig{Path: filepath.Join(dir, "padlock.db")}}
+
+	if err := from.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+	if err := to.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	acc := &Account{Email: "martin@padlock.io"}
+	if err := from.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Put(&DataStore{Account: acc, Content: []byte("some data")}); err != nil {
+		t.Fatal(err)
+	}
+	n := 20
+	for i := 0; i < n; i++ {
+		if err := from.Put(&testKeyedStrbl{fmt.Sprintf("key%03d", i), "value"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dry run should not write anything
+	migration := &StorageMigration{From: from, To: to, DryRun: true}
+	if err := migration.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := migration.Stats["mykeyedstrbl"]; stats.Total != n || stats.Copied != n {
+		t.Fatalf("Expected %d records to be copied, got %+v", n, stats)
+	}
+	if err := to.Get(&Account{Email: acc.Email}); err != ErrNotFound {
+		t.Fatalf("Dry run should not write any records, got %v", err)
+	}
+	if err := migration.Verify(); err == nil {
+		t.Fatal("Verification should fail before records are copied")
+	}
+
+	// Simulate an interrupted migration by copying some of the records beforehand
+	for i := 0; i < n/2; i++ {
+		if err := to.Put(&testKeyedStrbl{fmt.Sprintf("key%03d", i), "value"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migration = &StorageMigration{From: from, To: to}
+	if err := migration.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := migration.Stats["mykeyedstrbl"]; stats.Total != n || stats.Copied != n/2 || stats.Skipped != n/2 {
+		t.Fatalf("Expected %d records to be copied and %d to be skipped, got %+v", n/2, n/2, stats)
+	}
+	if err := migration.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := &DataStore{Account: acc}
+	if err := to.Get(data); err != nil || string(data.Content) != "some data" {
+		t.Fatalf("Expected data store to be migrated, got '%s' (%v)", data.Content, err)
+	}
+
+	// Verification should detect differing records
+	if err := to.Put(&testKeyedStrbl{"key000", "other value"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := migration.Verify(); err == nil {
+		t.Fatal("Verification should fail for differing records")
+	}
+}
+
+func TestCliMigrateStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := &LevelDBStorage{Config: &LevelDBConfig{Path: filepath.Join(dir, "db")}}
+	if err := from.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Put(&Account{Email: "martin@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+	from.Close()
+
+	app := NewCliApp()
+	app.Writer = ioutil.Discard
+
+	if err := app.Run([]string{"padlock-cloud", "storage", "migrate",
+		"--from", "leveldb:" + from.Config.Path,
+		"--to", "unknown:" + filepath.Join(dir, "padlock.db"),
+	}); err == nil {
+		t.Fatal("Expected error for unsupported backend")
+	}
+
+	if err := app.Run([]string{"padlock-cloud", "storage", "migrate",
+		"--from", "leveldb:" + from.Config.Path,
+		"--to", "bolt:" + filepath.Join(dir, "padlock.db"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	to := &BoltStorage{Config: &BoltConfig{Path: filepath.Join(dir, "padlock.db")}}
+	if err := to.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	if err := to.Get(&Account{Email: "martin@padlock.io"}); err != nil {
+		t.Fatal(err)
+	}
+}
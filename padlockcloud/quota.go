@@ -0,0 +1,263 @@
+package padlockcloud
+
+import "io"
+
+// Storage used by an account along with its quota
+type StoreUsage struct {
+	// Combined size of the current data stores of all vaults in bytes
+	Store int64 `yaml:"store"`
+	// Combined size of all revisions kept in the store histories of all vaults in bytes, not counting the
+	// revisions reflecting the current data stores
+	History int64 `yaml:"history"`
+	// Combined size of the change logs of all vaults in bytes
+	Changes int64 `yaml:"changes"`
+	// Maximum combined size of all data counting towards the quota in bytes, see `Total`. A value of 0
+	// means there is no limit
+	Quota int64 `yaml:"quota"`
+}
+
+// Returns the combined size of all data counting towards the quota, i.e. the current data stores along
+// with their histories and change logs
+func (u *StoreUsage) Total() int64 {
+	return u.Store + u.History + u.Changes
+}
+
+func (u *StoreUsage) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"store":   u.Store,
+		"history": u.History,
+		"changes": u.Changes,
+		"total":   u.Total(),
+		"quota":   u.Quota,
+	}
+}
+
+// Returns the maximum storage used by an account in bytes, taking into account per-account overrides.
+// A value of 0 means there is no limit
+func (acc *Account) StoreQuota(defaultQuota int64) int64 {
+	switch {
+	case acc.MaxStoreSize < 0:
+		return 0
+	case acc.MaxStoreSize > 0:
+		return acc.MaxStoreSize
+	default:
+		return defaultQuota
+	}
+}
+
+// Determines the storage used by an account across all of its vaults
+func GetStoreUsage(storage Storage, acc *Account, defaultQuota int64) (*StoreUsage, error) {
+	vaults, err := vaultNames(storage, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading from the storage directly, outside of a transaction
+	return storeUsage(storage, acc, vaults, acc.StoreQuota(defaultQuota))
+}
+
+// Returns the names of all vaults of an account, including the default vault
+func vaultNames(storage Storage, acc *Account) ([]string, error) {
+	vaults, err := GetVaults(storage, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(vaults))
+	for _, vault := range vaults {
+		names = append(names, vault.Name)
+	}
+
+	return names, nil
+}
+
+// Determines the storage used by the given vaults of an account. Records are read through `tx`, so changes
+// made within the same transaction are taken into account
+func storeUsage(tx StorageTx, acc *Account, vaults []string, quota int64) (*StoreUsage, error) {
+	usage := &StoreUsage{Quota: quota}
+
+	for _, name := range vaults {
+		data := &DataStore{Account: acc, Vault: name}
+		if err := tx.Get(data); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		usage.Store += int64(len(data.Content))
+
+		history := &StoreHistory{Account: acc, Vault: name}
+		if err := tx.Get(history); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		current := currentRevision(history, data)
+		for _, rev := range history.Revisions {
+			if rev != current {
+				usage.History += int64(len(rev.Content))
+			}
+		}
+
+		log := &ChangeLog{Account: acc, Vault: name}
+		if err := tx.Get(log); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		usage.Changes += log.Size
+	}
+
+	return usage, nil
+}
+
+// Returns the most recent revision of `history` if it reflects the current content of `data`. Since it
+// duplicates the data store, it doesn't count towards the quota
+func currentRevision(history *StoreHistory, data *DataStore) *StoreRevision {
+	if len(history.Revisions) == 0 {
+		return nil
+	}
+
+	if rev := history.Revisions[len(history.Revisions)-1]; rev.Id == data.Revision() {
+		return rev
+	}
+
+	return nil
+}
+
+// Fails with a `StoreQuotaExceeded` error if the storage used by the given vaults of an account, including
+// any changes made within `tx`, exceeds `quota`. A quota of 0 means there is no limit
+func checkStoreQuota(tx StorageTx, acc *Account, vaults []string, quota int64) error {
+	if quota <= 0 {
+		return nil
+	}
+
+	usage, err := storeUsage(tx, acc, vaults, quota)
+	if err != nil {
+		return err
+	}
+
+	if usage.Total() > quota {
+		return &StoreQuotaExceeded{quota}
+	}
+
+	return nil
+}
+
+// Like `checkStoreQuota`, but drops the oldest revisions from the store histories of the given vaults
+// until the storage used by the account fits within `quota`, so the history never keeps an account from
+// writing. Only fails if the current data stores and change logs alone exceed the quota
+func fitStoreQuota(tx StorageTx, acc *Account, vaults []string, quota int64) error {
+	if quota <= 0 {
+		return nil
+	}
+
+	usage, err := storeUsage(tx, acc, vaults, quota)
+	if err != nil {
+		return err
+	}
+
+	excess := usage.Total() - quota
+	if excess <= 0 {
+		return nil
+	}
+
+	var histories []*StoreHistory
+	current := make(map[*StoreHistory]*StoreRevision)
+
+	for _, name := range vaults {
+		data := &DataStore{Account: acc, Vault: name}
+		if err := tx.Get(data); err != nil && err != ErrNotFound {
+			return err
+		}
+
+		history := &StoreHistory{Account: acc, Vault: name}
+		if err := tx.Get(history); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		histories = append(histories, history)
+		current[history] = currentRevision(history, data)
+	}
+
+	pruned := make(map[*StoreHistory]bool)
+
+	for excess > 0 {
+		// Find the oldest revision across all vaults
+		var oldest *StoreHistory
+		for _, h := range histories {
+			if len(h.Revisions) == 0 || h.Revisions[0] == current[h] {
+				continue
+			}
+			if oldest == nil || h.Revisions[0].Created.Before(oldest.Revisions[0].Created) {
+				oldest = h
+			}
+		}
+
+		if oldest == nil {
+			return &StoreQuotaExceeded{quota}
+		}
+
+		excess -= int64(len(oldest.Revisions[0].Content))
+		oldest.Revisions = oldest.Revisions[1:]
+		pruned[oldest] = true
+	}
+
+	for _, h := range histories {
+		if pruned[h] {
+			if err := tx.Put(h); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Runs `fn` within a transaction, dropping old revisions from the store histories if the storage used
+// by the account would exceed `quota` afterwards, see `fitStoreQuota`. If that isn't enough, the changes
+// are discarded and a `StoreQuotaExceeded` error is returned. The vaults of the account are listed before
+// the transaction, so vaults created by `fn` need to be checked separately
+func updateWithinQuota(storage Storage, acc *Account, quota int64, fn func(StorageTx) error) error {
+	if quota <= 0 {
+		return storage.Update(fn)
+	}
+
+	vaults, err := vaultNames(storage, acc)
+	if err != nil {
+		return err
+	}
+
+	return storage.Update(func(tx StorageTx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return fitStoreQuota(tx, acc, vaults, quota)
+	})
+}
+
+// Reader that fails with a `StoreQuotaExceeded` error once more than `quota` bytes have been read
+type quotaReader struct {
+	r     io.Reader
+	quota int64
+	n     int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	// Read at most one byte more than allowed so we can tell whether the quota has been exceeded
+	if max := q.quota - q.n + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	n, err := q.r.Read(p)
+	q.n += int64(n)
+
+	if q.n > q.quota {
+		return n, &StoreQuotaExceeded{q.quota}
+	}
+
+	return n, err
+}
+
+// Limits the number of bytes that can be read from `r`. A quota of 0 means there is no limit
+func limitReader(r io.Reader, quota int64) io.Reader {
+	if quota <= 0 {
+		return r
+	}
+	return &quotaReader{r: r, quota: quota}
+}
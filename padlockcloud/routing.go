@@ -0,0 +1,206 @@
+package padlockcloud
+
+import "fmt"
+import "sort"
+import "reflect"
+
+// Implementation of the `Storage` interface that routes each registered `Storable` type to one of
+// several storages, e.g. for keeping accounts in a local database while putting data stores in an
+// object storage. Types without a route are handled by the default storage
+type RoutedStorage struct {
+	// Storage used for all types without a route
+	Default Storage
+	// Storages for individual types, keyed by type identifier (see `StorableTypes`). The same
+	// storage may be used for several types
+	Routes map[string]Storage
+	routes map[reflect.Type]Storage
+}
+
+// Returns all distinct storages, starting with the default storage
+func (s *RoutedStorage) children() []Storage {
+	names := make([]string, 0, len(s.Routes))
+	for name := range s.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	children := []Storage{s.Default}
+	seen := map[Storage]bool{s.Default: true}
+	for _, name := range names {
+		if child := s.Routes[name]; !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+
+	return children
+}
+
+// Returns the storage responsible for the type of a given `Storable`
+func (s *RoutedStorage) route(t Storable) Storage {
+	if t == nil {
+		return s.Default
+	}
+	if child, ok := s.routes[typeFromStorable(t)]; ok {
+		return child
+	}
+	return s.Default
+}
+
+// Implementation of the `Storage.Open` interface method. Opens all storages, closing the ones
+// already opened if one of them fails to open
+func (s *RoutedStorage) Open() error {
+	known := make(map[string]reflect.Type)
+	for typ, loc := range StorableTypes {
+		known[loc] = typ
+	}
+
+	routes := make(map[reflect.Type]Storage)
+	for name, child := range s.Routes {
+		typ, ok := known[name]
+		if !ok {
+			return fmt.Errorf("Unknown record type in storage routes: %s", name)
+		}
+		routes[typ] = child
+	}
+	s.routes = routes
+
+	children := s.children()
+	for i, child := range children {
+		if err := child.Open(); err != nil {
+			for _, opened := range children[:i] {
+				opened.Close()
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Implementation of the `Storage.Close` interface method. Closes all storages, returning the first
+// error encountered
+func (s *RoutedStorage) Close() error {
+	var err error
+	for _, child := range s.children() {
+		if e := child.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Implementation of the `Storage.Ready` interface method. The storage is ready once all storages are
+func (s *RoutedStorage) Ready() bool {
+	for _, child := range s.children() {
+		if !child.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// Implementation of the `Storage.CanStore` interface method
+func (s *RoutedStorage) CanStore(t Storable) bool {
+	return s.route(t).CanStore(t)
+}
+
+// Implementation of the `Storage.Get` interface method
+func (s *RoutedStorage) Get(t Storable) error {
+	return s.route(t).Get(t)
+}
+
+// Implementation of the `Storage.Put` interface method
+func (s *RoutedStorage) Put(t Storable) error {
+	return s.route(t).Put(t)
+}
+
+// Implementation of the `Storage.Delete` interface method
+func (s *RoutedStorage) Delete(t Storable) error {
+	return s.route(t).Delete(t)
+}
+
+// Implementation of the `Storage.Iterator` interface method
+func (s *RoutedStorage) Iterator(t Storable) (StorageIterator, error) {
+	return s.route(t).Iterator(t)
+}
+
+// Implementation of the `SnapshotStorage.Snapshot` interface method. Takes a snapshot of each of the
+// storages, returning `ErrSnapshotUnsupported` if one of them doesn't support snapshots. Since the
+// snapshots are taken one after the other, they are only consistent across storages if no
+// transaction spanning several of them is committed in the meantime
+func (s *RoutedStorage) Snapshot() (StorageSnapshot, error) {
+	children := s.children()
+	for _, child := range children {
+		if _, ok := child.(SnapshotStorage); !ok {
+			return nil, ErrSnapshotUnsupported
+		}
+	}
+
+	snapshot := &routedSnapshot{s, make(map[Storage]StorageSnapshot)}
+	for _, child := range children {
+		snap, err := child.(SnapshotStorage).Snapshot()
+		if err != nil {
+			snapshot.Release()
+			return nil, err
+		}
+		snapshot.snapshots[child] = snap
+	}
+
+	return snapshot, nil
+}
+
+type routedSnapshot struct {
+	storage   *RoutedStorage
+	snapshots map[Storage]StorageSnapshot
+}
+
+func (s *routedSnapshot) Iterator(t Storable) (StorageIterator, error) {
+	return s.snapshots[s.storage.route(t)].Iterator(t)
+}
+
+func (s *routedSnapshot) Release() {
+	for _, snap := range s.snapshots {
+		snap.Release()
+	}
+}
+
+// Implementation of the `Storage.Update` interface method. Runs the function within a transaction
+// on each of the storages, so changes are discarded on all of them if the function fails. Since the
+// transactions are committed one after the other, changes spanning several storages may still be
+// applied partially if committing one of them fails
+func (s *RoutedStorage) Update(fn func(StorageTx) error) error {
+	children := s.children()
+	txs := make(map[Storage]StorageTx)
+
+	var update func(i int) error
+	update = func(i int) error {
+		if i == len(children) {
+			return fn(&routedTx{s, txs})
+		}
+		return children[i].Update(func(tx StorageTx) error {
+			txs[children[i]] = tx
+			return update(i + 1)
+		})
+	}
+
+	return update(0)
+}
+
+// Implementation of the `StorageTx` interface for `RoutedStorage`
+type routedTx struct {
+	storage *RoutedStorage
+	txs     map[Storage]StorageTx
+}
+
+func (tx *routedTx) Get(t Storable) error {
+	return tx.txs[tx.storage.route(t)].Get(t)
+}
+
+func (tx *routedTx) Put(t Storable) error {
+	return tx.txs[tx.storage.route(t)].Put(t)
+}
+
+func (tx *routedTx) Delete(t Storable) error {
+	return tx.txs[tx.storage.route(t)].Delete(t)
+}
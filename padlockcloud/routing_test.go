@@ -0,0 +1,134 @@
+package padlockcloud
+
+import "os"
+import "testing"
+import "io/ioutil"
+
+func TestRoutedStorage(t *testing.T) {
+	testStorage(t, &RoutedStorage{
+		Default: &MemoryStorage{},
+		Routes:  map[string]Storage{"mykeyedstrbl": &MemoryStorage{}},
+	})
+}
+
+func TestRoutedStorageRoutes(t *testing.T) {
+	def := &MemoryStorage{}
+	keyed := &MemoryStorage{}
+	storage := &RoutedStorage{
+		Default: def,
+		Routes: map[string]Storage{
+			"mykeyedstrbl":     keyed,
+			"myversionedstrbl": keyed,
+		},
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	var storable testStrbl = "value"
+	if err := storage.Put(&storable); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&testKeyedStrbl{"key", "value"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := def.Get(new(testStrbl)); err != nil {
+		t.Fatalf("Expected record to be written to default storage, got %v", err)
+	}
+	if err := keyed.Get(new(testStrbl)); err != ErrNotFound {
+		t.Fatalf("Expected record not to be written to routed storage, got %v", err)
+	}
+	if err := keyed.Get(&testKeyedStrbl{Name: "key"}); err != nil {
+		t.Fatalf("Expected record to be written to routed storage, got %v", err)
+	}
+	if err := def.Get(&testKeyedStrbl{Name: "key"}); err != ErrNotFound {
+		t.Fatalf("Expected record not to be written to default storage, got %v", err)
+	}
+
+	// Storages used for several types should only be opened and closed once
+	if children := storage.children(); len(children) != 2 {
+		t.Fatalf("Expected 2 distinct storages, got %d", len(children))
+	}
+
+	invalid := &RoutedStorage{
+		Default: &MemoryStorage{},
+		Routes:  map[string]Storage{"unknown": &MemoryStorage{}},
+	}
+	if err := invalid.Open(); err == nil {
+		t.Fatal("Expected error for unknown record type")
+	}
+}
+
+func TestRoutedStorageReady(t *testing.T) {
+	s3, _, cleanup := newTestS3Storage(t)
+	defer cleanup()
+
+	storage := &RoutedStorage{
+		Default: &MemoryStorage{},
+		Routes:  map[string]Storage{"mykeyedstrbl": s3},
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !storage.Ready() {
+		t.Fatal("Storage should be ready once all storages are open")
+	}
+
+	s3.Close()
+	if storage.Ready() {
+		t.Fatal("Storage should not be ready if one of the storages is closed")
+	}
+
+	// Failing to open one storage should close the others
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s3.Config.Bucket = "unknown"
+	def := &LevelDBStorage{Config: &LevelDBConfig{Path: dir}}
+	storage.Default = def
+	if err := storage.Open(); err == nil {
+		t.Fatal("Expected error for inaccessible bucket")
+	}
+	if def.Ready() {
+		t.Fatal("Expected default storage to be closed after failing to open")
+	}
+}
+
+func TestRoutedStorageSnapshot(t *testing.T) {
+	testSnapshot(t, &RoutedStorage{
+		Default: &MemoryStorage{},
+		Routes:  map[string]Storage{"mykeyedstrbl": &MemoryStorage{}},
+	})
+
+	s3, _, cleanup := newTestS3Storage(t)
+	defer cleanup()
+
+	storage := &RoutedStorage{
+		Default: &MemoryStorage{},
+		Routes:  map[string]Storage{"mykeyedstrbl": s3},
+	}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if _, err := storage.Snapshot(); err != ErrSnapshotUnsupported {
+		t.Fatalf("Expected ErrSnapshotUnsupported, got %v", err)
+	}
+
+	// Backups should still be possible without a snapshot
+	if err := storage.Put(&testKeyedStrbl{"key", "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := WriteBackup(ioutil.Discard, storage); err != nil || count != 1 {
+		t.Fatalf("Expected 1 record to be backed up, got %d, %v", count, err)
+	}
+}
@@ -0,0 +1,580 @@
+package padlockcloud
+
+import "io"
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+import "bytes"
+import "strings"
+import "strconv"
+import "net/url"
+import "net/http"
+import "io/ioutil"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/xml"
+
+// Maximum number of keys requested per list request
+var s3ListBatchSize = 1000
+
+// Timeout for requests to the S3 API if none is configured
+var defaultS3Timeout = 30 * time.Second
+
+type S3Config struct {
+	// Url of the S3 API endpoint, e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Endpoint string `yaml:"endpoint"`
+	// Region used for signing requests
+	Region string `yaml:"region"`
+	// Name of the bucket to store records in
+	Bucket string `yaml:"bucket"`
+	// Prefix prepended to all object names, e.g. "padlock/"
+	Prefix string `yaml:"prefix"`
+	// Credentials used for signing requests
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// Time limit for each request to the S3 API, including reading the response body. Defaults to 30
+	// seconds
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Error returned by the S3 API
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s - %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Implementation of the `Storage` interface using an S3-compatible object storage. Each record is stored
+// as a separate object named `<prefix><type>/<hex-encoded key>`. Hex-encoding keys preserves their order,
+// so records can be iterated in ascending key order. Since object storages don't support transactions,
+// changes made within `Update` are buffered and applied one by one once the function returns, so a
+// failing request may leave a transaction partially applied
+type S3Storage struct {
+	Config *S3Config
+	// Client used for requests to the S3 API. If nil, a client using the configured timeout is created
+	// when opening the storage
+	Client *http.Client
+	open   bool
+	// Held while applying transactions so that concurrent transactions don't interleave
+	txMutex sync.Mutex
+}
+
+// Implementation of the `Storage.Open` interface method. Checks that the bucket is accessible
+func (s *S3Storage) Open() error {
+	if s.Config.Endpoint == "" || s.Config.Bucket == "" {
+		return fmt.Errorf("Please provide an S3 endpoint and bucket")
+	}
+
+	if s.Client == nil {
+		timeout := s.Config.Timeout
+		if timeout <= 0 {
+			timeout = defaultS3Timeout
+		}
+		s.Client = &http.Client{Timeout: timeout}
+	}
+
+	res, err := s.request("HEAD", "", nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	s.open = true
+
+	return nil
+}
+
+// Implementation of the `Storage.Close` interface method
+func (s *S3Storage) Close() error {
+	s.open = false
+	return nil
+}
+
+func (s *S3Storage) Ready() bool {
+	return s.open
+}
+
+func (s *S3Storage) CanStore(t Storable) bool {
+	_, err := s.typePrefix(t)
+	return err == nil
+}
+
+// Returns the prefix of all objects of the type of a given `Storable`
+func (s *S3Storage) typePrefix(t Storable) (string, error) {
+	if t == nil {
+		return "", ErrUnregisteredStorable
+	}
+
+	loc, ok := StorableTypes[typeFromStorable(t)]
+	if !ok {
+		return "", ErrUnregisteredStorable
+	}
+
+	return s.Config.Prefix + loc + "/", nil
+}
+
+// Returns the object name for a given `Storable`
+func (s *S3Storage) objectName(t Storable) (string, error) {
+	prefix, err := s.typePrefix(t)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(t.Key()), nil
+}
+
+// Sends a signed request for the given object (or the bucket itself if `name` is empty). Responses
+// with a status code other than 2xx are turned into errors, with 404 responses resulting in `ErrNotFound`
+func (s *S3Storage) request(method string, name string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path += "/" + s.Config.Bucket
+	if name != "" {
+		u.Path += "/" + name
+	}
+	// Make sure the path is sent exactly as it is encoded for signing
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3EncodeQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	region := s.Config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	signS3Request(req, body, s.Config.AccessKey, s.Config.SecretKey, region, time.Now())
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound && name != "" {
+		return nil, ErrNotFound
+	}
+
+	s3Err := &S3Error{StatusCode: res.StatusCode}
+	if data, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16)); err == nil {
+		xml.Unmarshal(data, s3Err)
+	}
+
+	return nil, s3Err
+}
+
+func (s *S3Storage) getObject(name string) ([]byte, error) {
+	res, err := s.request("GET", name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (s *S3Storage) putObject(name string, data []byte) error {
+	res, err := s.request("PUT", name, nil, data)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *S3Storage) deleteObject(name string) error {
+	res, err := s.request("DELETE", name, nil, nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Implementation of the `Storage.Get` interface method
+func (s *S3Storage) Get(t Storable) error {
+	if !s.open {
+		return ErrStorageClosed
+	}
+
+	name, err := s.objectName(t)
+	if err != nil {
+		return err
+	}
+
+	data, err := s.getObject(name)
+	if err != nil {
+		return err
+	}
+
+	return t.Deserialize(data)
+}
+
+// Implementation of the `Storage.Put` interface method
+func (s *S3Storage) Put(t Storable) error {
+	if !s.open {
+		return ErrStorageClosed
+	}
+
+	name, err := s.objectName(t)
+	if err != nil {
+		return err
+	}
+
+	data, err := t.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(name, data)
+}
+
+// Implementation of the `Storage.Delete` interface method
+func (s *S3Storage) Delete(t Storable) error {
+	if !s.open {
+		return ErrStorageClosed
+	}
+
+	name, err := s.objectName(t)
+	if err != nil {
+		return err
+	}
+
+	return s.deleteObject(name)
+}
+
+// Implementation of the `Storage.Iterator` interface method. Object names are listed in batches while
+// the contents of each object are only fetched when calling `Get`
+func (s *S3Storage) Iterator(t Storable) (StorageIterator, error) {
+	if !s.open {
+		return nil, ErrStorageClosed
+	}
+
+	prefix, err := s.typePrefix(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Iterator{storage: s, prefix: prefix, i: -1}, nil
+}
+
+// Implementation of the `Storage.Update` interface method
+func (s *S3Storage) Update(fn func(StorageTx) error) error {
+	if !s.open {
+		return ErrStorageClosed
+	}
+
+	s.txMutex.Lock()
+	defer s.txMutex.Unlock()
+
+	tx := &s3Tx{storage: s, pending: make(map[string]*txEntry)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	// Apply changes in a stable order
+	names := make([]string, 0, len(tx.pending))
+	for name := range tx.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var err error
+		if entry := tx.pending[name]; entry.deleted {
+			err = s.deleteObject(name)
+		} else {
+			err = s.putObject(name, entry.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Implementation of the `StorageTx` interface for `S3Storage`. Reads reflect pending changes
+type s3Tx struct {
+	storage *S3Storage
+	pending map[string]*txEntry
+}
+
+func (tx *s3Tx) Get(t Storable) error {
+	name, err := tx.storage.objectName(t)
+	if err != nil {
+		return err
+	}
+
+	if entry := tx.pending[name]; entry != nil {
+		if entry.deleted {
+			return ErrNotFound
+		}
+		return t.Deserialize(append([]byte{}, entry.data...))
+	}
+
+	return tx.storage.Get(t)
+}
+
+func (tx *s3Tx) Put(t Storable) error {
+	name, err := tx.storage.objectName(t)
+	if err != nil {
+		return err
+	}
+
+	data, err := t.Serialize()
+	if err != nil {
+		return err
+	}
+
+	tx.pending[name] = &txEntry{append([]byte{}, data...), false}
+	return nil
+}
+
+func (tx *s3Tx) Delete(t Storable) error {
+	name, err := tx.storage.objectName(t)
+	if err != nil {
+		return err
+	}
+
+	tx.pending[name] = &txEntry{nil, true}
+	return nil
+}
+
+// Result of a `ListObjectsV2` request
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Iterator over all objects with a given prefix
+type S3Iterator struct {
+	storage *S3Storage
+	prefix  string
+	keys    [][]byte
+	i       int
+	// Token for requesting the next batch of object names
+	token string
+	// Only return keys greater than or equal to this key, set after seeking
+	seek      []byte
+	started   bool
+	truncated bool
+	done      bool
+	// Error that occurred while listing object names
+	err error
+}
+
+// Lists the next batch of object names
+func (iter *S3Iterator) loadBatch() error {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {iter.prefix},
+		"max-keys":  {strconv.Itoa(s3ListBatchSize)},
+	}
+
+	if iter.token != "" {
+		query.Set("continuation-token", iter.token)
+	} else if iter.seek != nil {
+		// `start-after` is exclusive, so start listing right before any object names starting with the
+		// first hex digits of the seek key and filter out keys less than the seek key below
+		if name := hex.EncodeToString(iter.seek); len(name) > 1 {
+			query.Set("start-after", iter.prefix+name[:len(name)-1])
+		}
+	}
+
+	res, err := iter.storage.request("GET", "", query, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	result := &s3ListResult{}
+	if err := xml.NewDecoder(res.Body).Decode(result); err != nil {
+		return err
+	}
+
+	iter.keys = nil
+	iter.i = 0
+	iter.started = true
+	iter.truncated = result.IsTruncated
+	iter.token = result.NextContinuationToken
+
+	for _, obj := range result.Contents {
+		key, err := hex.DecodeString(strings.TrimPrefix(obj.Key, iter.prefix))
+		if err != nil {
+			// Not created by us
+			continue
+		}
+		if iter.seek != nil && bytes.Compare(key, iter.seek) < 0 {
+			continue
+		}
+		iter.keys = append(iter.keys, key)
+	}
+
+	return nil
+}
+
+func (iter *S3Iterator) Next() bool {
+	if iter.done {
+		return false
+	}
+
+	if iter.i+1 < len(iter.keys) {
+		iter.i = iter.i + 1
+		return true
+	}
+
+	// Keep loading batches until we find one with keys, since filtering may leave batches empty
+	for !iter.started || iter.truncated {
+		if err := iter.loadBatch(); err != nil {
+			iter.err = err
+			break
+		}
+		if len(iter.keys) > 0 {
+			return true
+		}
+	}
+
+	iter.done = true
+	return false
+}
+
+func (iter *S3Iterator) Seek(key []byte) {
+	iter.seek = append([]byte{}, key...)
+	iter.keys = nil
+	iter.i = -1
+	iter.token = ""
+	iter.started = false
+	iter.truncated = false
+	iter.done = false
+	iter.err = nil
+}
+
+func (iter *S3Iterator) Key() []byte {
+	return iter.keys[iter.i]
+}
+
+func (iter *S3Iterator) Get(t Storable) error {
+	data, err := iter.storage.getObject(iter.prefix + hex.EncodeToString(iter.Key()))
+	if err != nil {
+		return err
+	}
+	return t.Deserialize(data)
+}
+
+func (iter *S3Iterator) Release() {
+	iter.keys = nil
+	iter.done = true
+}
+
+func (iter *S3Iterator) Error() error {
+	return iter.err
+}
+
+// Percent-encodes a string as required for signing requests. Slashes are kept as is if `path` is true
+func s3Escape(s string, path bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || path && b == '/' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+// Encodes query parameters in their canonical form, sorted by name
+func s3EncodeQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, val := range values {
+			params = append(params, s3Escape(key, false)+"="+s3Escape(val, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Signs a request using AWS Signature Version 4, covering the host and all headers set on the request
+func signS3Request(req *http.Request, body []byte, accessKey string, secretKey string, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(path, true),
+		s3EncodeQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign)),
+	))
+}
@@ -0,0 +1,172 @@
+package padlockcloud
+
+import "fmt"
+import "bytes"
+import "errors"
+import "reflect"
+import "encoding/json"
+
+// Name of the field holding the schema version of a serialized record
+const schemaVersionField = "SchemaVersion"
+
+// Returned when a record was written with a newer schema than the current one, e.g. by a newer
+// version of the server
+var ErrUnsupportedSchemaVersion = errors.New("padlock: unsupported schema version")
+
+// Migrates a record, decoded into a generic map, from the previous schema version to the next one
+type SchemaMigration func(rec map[string]interface{}) error
+
+// Migrations for each versioned `Storable` type. Records that were written before versioning was
+// introduced or don't carry a version are considered to be of version 1. The migration at index `i`
+// migrates records from version `i+1` to `i+2`
+var schemaMigrations = map[reflect.Type][]SchemaMigration{}
+
+// Registers a `Storable` type as versioned, along with a list of migrations, one for each schema
+// version after the first. Subsequent calls append to the list of migrations
+func RegisterSchema(t Storable, migrations ...SchemaMigration) {
+	typ := typeFromStorable(t)
+	schemaMigrations[typ] = append(schemaMigrations[typ], migrations...)
+}
+
+// Returns the current schema version for the type of the given `Storable`
+func CurrentSchemaVersion(t Storable) int {
+	return schemaVersion(typeFromStorable(t))
+}
+
+func schemaVersion(typ reflect.Type) int {
+	return len(schemaMigrations[typ]) + 1
+}
+
+// Returns the schema version a serialized record was written with or 0 if it doesn't carry a version
+func recordSchemaVersion(data []byte) (int, error) {
+	rec := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return 0, err
+	}
+
+	raw, ok := rec[schemaVersionField]
+	if !ok {
+		return 0, nil
+	}
+
+	var version int
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Serializes `v` as a JSON object, adding the current schema version for the type of `t`
+func marshalVersioned(t Storable, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 2 || data[0] != '{' {
+		return nil, fmt.Errorf("Versioned records must serialize to JSON objects")
+	}
+
+	out := []byte(fmt.Sprintf("{%q:%d", schemaVersionField, CurrentSchemaVersion(t)))
+	if !bytes.Equal(data, []byte("{}")) {
+		out = append(out, ',')
+	}
+
+	return append(out, data[1:]...), nil
+}
+
+// Deserializes a JSON object written by `marshalVersioned` into `v`, first applying all migrations
+// required for bringing the record up to the current schema version for the type of `t`
+func unmarshalVersioned(t Storable, data []byte, v interface{}) error {
+	version, err := recordSchemaVersion(data)
+	if err != nil {
+		return err
+	}
+
+	// Records written before versioning was introduced are of the first version
+	if version == 0 {
+		version = 1
+	}
+
+	current := CurrentSchemaVersion(t)
+	if version > current || version < 1 {
+		return ErrUnsupportedSchemaVersion
+	}
+
+	if version < current {
+		rec := make(map[string]interface{})
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+
+		for _, migrate := range schemaMigrations[typeFromStorable(t)][version-1:] {
+			if err := migrate(rec); err != nil {
+				return err
+			}
+		}
+
+		delete(rec, schemaVersionField)
+		if data, err = json.Marshal(rec); err != nil {
+			return err
+		}
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Rewrites all records of versioned types that are not of the current schema version or don't carry a
+// version yet, returning the number of upgraded records per type identifier
+func UpgradeSchema(storage Storage) (map[string]int, error) {
+	counts := make(map[string]int)
+
+	for _, typ := range sortedStorableTypes() {
+		if _, ok := schemaMigrations[typ]; !ok {
+			continue
+		}
+
+		current := schemaVersion(typ)
+
+		iter, err := storage.Iterator(&rawStorable{typ: typ})
+		if err != nil {
+			return counts, err
+		}
+
+		for iter.Next() {
+			raw := &rawStorable{typ: typ, key: append([]byte{}, iter.Key()...)}
+			if err := iter.Get(raw); err != nil {
+				iter.Release()
+				return counts, err
+			}
+
+			version, err := recordSchemaVersion(raw.data)
+			if err == nil && version >= current {
+				continue
+			}
+
+			t := reflect.New(typ).Interface().(Storable)
+			if err == nil {
+				err = t.Deserialize(raw.data)
+			}
+			if err == nil {
+				raw.data, err = t.Serialize()
+			}
+			if err == nil {
+				err = storage.Put(raw)
+			}
+			if err != nil {
+				iter.Release()
+				return counts, fmt.Errorf("Failed to upgrade %s record %s: %v", StorableTypes[typ], raw.key, err)
+			}
+
+			counts[StorableTypes[typ]]++
+		}
+
+		err = iter.Error()
+		iter.Release()
+		if err != nil {
+			return counts, err
+		}
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,123 @@
+package padlockcloud
+
+import "testing"
+import "strings"
+import "encoding/json"
+
+// Versioned storable type. Version 1 only had a `Name`, which was renamed to `Title` in
+// version 2. Version 3 introduced `Tags`
+type testVersionedStrbl struct {
+	Id    string
+	Title string
+	Tags  []string
+}
+
+func (m *testVersionedStrbl) Key() []byte {
+	return []byte(m.Id)
+}
+
+func (m *testVersionedStrbl) Serialize() ([]byte, error) {
+	return marshalVersioned(m, m)
+}
+
+func (m *testVersionedStrbl) Deserialize(data []byte) error {
+	return unmarshalVersioned(m, data, m)
+}
+
+func init() {
+	RegisterStorable(&testVersionedStrbl{}, "myversionedstrbl")
+	RegisterSchema(&testVersionedStrbl{}, func(rec map[string]interface{}) error {
+		rec["Title"] = rec["Name"]
+		delete(rec, "Name")
+		return nil
+	}, func(rec map[string]interface{}) error {
+		rec["Tags"] = []string{"migrated"}
+		return nil
+	})
+}
+
+func TestSchemaMigration(t *testing.T) {
+	if v := CurrentSchemaVersion(&testVersionedStrbl{}); v != 3 {
+		t.Fatalf("Expected current schema version to be 3, got %d", v)
+	}
+
+	for _, data := range []string{
+		`{"Id":"a","Name":"Title"}`,
+		`{"SchemaVersion":1,"Id":"a","Name":"Title"}`,
+		`{"SchemaVersion":2,"Id":"a","Title":"Title","Tags":["migrated"]}`,
+		`{"SchemaVersion":3,"Id":"a","Title":"Title","Tags":["migrated"]}`,
+	} {
+		s := &testVersionedStrbl{}
+		if err := s.Deserialize([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if s.Title != "Title" || len(s.Tags) != 1 || s.Tags[0] != "migrated" {
+			t.Errorf("Record %s not migrated correctly, got %+v", data, s)
+		}
+	}
+
+	if err := (&testVersionedStrbl{}).Deserialize([]byte(`{"SchemaVersion":4,"Id":"a"}`)); err != ErrUnsupportedSchemaVersion {
+		t.Fatalf("Expected ErrUnsupportedSchemaVersion, got %v", err)
+	}
+
+	data, err := (&testVersionedStrbl{Id: "a", Title: "Title"}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := recordSchemaVersion(data); err != nil || v != 3 {
+		t.Fatalf("Expected serialized record to have version 3, got %d (%v)", v, err)
+	}
+
+	acc := &Account{}
+	if data, err := acc.Serialize(); err != nil || !strings.HasPrefix(string(data), `{"SchemaVersion":1,"Email":""`) {
+		t.Fatalf("Expected versioned account record, got %s (%v)", data, err)
+	}
+}
+
+func TestUpgradeSchema(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	typ := typeFromStorable(&testVersionedStrbl{})
+	for _, rec := range []*rawStorable{
+		{typ, []byte("a"), []byte(`{"Id":"a","Name":"A"}`)},
+		{typ, []byte("b"), []byte(`{"SchemaVersion":2,"Id":"b","Title":"B"}`)},
+		{typ, []byte("c"), []byte(`{"SchemaVersion":3,"Id":"c","Title":"C"}`)},
+		{typeFromStorable(&Account{}), []byte("martin@padlock.io"), []byte(`{"Email":"martin@padlock.io"}`)},
+	} {
+		if err := storage.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := UpgradeSchema(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["myversionedstrbl"] != 2 || counts["auth-accounts"] != 1 {
+		t.Fatalf("Unexpected upgrade counts: %v", counts)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		raw := &rawStorable{typ: typ, key: []byte(key)}
+		if err := storage.Get(raw); err != nil {
+			t.Fatal(err)
+		}
+
+		rec := make(map[string]interface{})
+		if err := json.Unmarshal(raw.data, &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec["SchemaVersion"] != float64(3) || rec["Title"] != strings.ToUpper(key) || rec["Name"] != nil {
+			t.Errorf("Record %s not upgraded correctly, got %s", key, raw.data)
+		}
+	}
+
+	// Running the upgrade again should be a no-op
+	if counts, err := UpgradeSchema(storage); err != nil || len(counts) != 0 {
+		t.Fatalf("Expected no records to be upgraded, got %v (%v)", counts, err)
+	}
+}
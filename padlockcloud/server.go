@@ -2,6 +2,7 @@ package padlockcloud
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"github.com/rs/cors"
@@ -59,12 +60,14 @@ func formatRequestVerbose(r *http.Request) string {
 // DataStore represents the data associated to a given account
 type DataStore struct {
 	Account *Account
+	// Name of the vault the data belongs to. Empty for the default vault
+	Vault   string
 	Content []byte
 }
 
 // Implementation of the `Storable.Key` interface method
 func (d *DataStore) Key() []byte {
-	return []byte(d.Account.Email)
+	return vaultKey(d.Account.Email, d.Vault)
 }
 
 // Implementation of the `Storable.Deserialize` interface method
@@ -78,6 +81,18 @@ func (d *DataStore) Serialize() ([]byte, error) {
 	return d.Content, nil
 }
 
+// Returns an identifier for the current revision of the data store, derived from its content
+func (d *DataStore) Revision() string {
+	sum := sha256.Sum256(d.Content)
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+// Returns a strong entity tag for the current revision of the data store. A store that
+// does not exist yet has the same entity tag as an empty one
+func (d *DataStore) ETag() string {
+	return fmt.Sprintf("\"%s\"", d.Revision())
+}
+
 // Server configuration
 type ServerConfig struct {
 	// Path to assets directory; used for loading templates and such
@@ -102,6 +117,22 @@ type ServerConfig struct {
 	SkeletonKey string `yaml:"skeleton_key"`
 	// IP address allowed to use skeleton key
 	SkeletonIP string `yaml:"skeleton_ip"`
+	// Settings for keeping previous revisions of data stores
+	History HistoryConfig `yaml:"history"`
+	// Default maximum storage used by each account in bytes, covering the data stores, history and change
+	// logs of all of its vaults. A value of 0 means there is no limit
+	MaxStoreSize int64 `yaml:"max_store_size"`
+	// Maximum number of vaults per account, including the default vault. A value of 0 means there is no limit
+	MaxVaults int `yaml:"max_vaults"`
+	// Settings for scheduled backups
+	Backup BackupConfig `yaml:"backup"`
+	// Settings for exporting metrics
+	Metrics MetricsConfig `yaml:"metrics"`
+	// Settings for the admin interface
+	Admin AdminConfig `yaml:"admin"`
+	// Time between requesting the deletion of an account or vault and actually deleting it, during
+	// which the deletion can be undone. A value of 0 means data is deleted immediately
+	DeletionGracePeriod time.Duration `yaml:"deletion_grace_period"`
 }
 
 // The Server type holds all the contextual data and logic used for running a Padlock Cloud instances
@@ -115,9 +146,16 @@ type Server struct {
 	Config            *ServerConfig
 	Secure            bool
 	Endpoints         map[string]*Endpoint
+	Metrics           *Metrics
+	Events            *EventHub
 	secret            []byte
 	emailRateLimiter  *EmailRateLimiter
 	cleanAuthRequests *Job
+	backup            *Job
+	purgeDeletions    *Job
+	accountStats      *Job
+	metricsServer     *http.Server
+	adminServer       *http.Server
 	whitelist         *Whitelist
 	accountMutexes    map[string]*sync.Mutex
 }
@@ -152,18 +190,77 @@ func (server *Server) UnlockAccount(email string) {
 	server.GetAccountMutex(email).Unlock()
 }
 
+// Deletes an account along with all of its data and disconnects its event streams, see `RemoveAccount`
 func (server *Server) DeleteAccount(email string) error {
+	if err := RemoveAccount(server.Storage, email); err != nil {
+		return err
+	}
+
+	// None of the accounts auth tokens are valid anymore
+	server.Events.Disconnect(email, "")
+
+	return nil
+}
+
+// Deletes an account along with all of its vaults, their histories, change logs and sharing settings,
+// and removes it from all vaults shared with it
+func RemoveAccount(storage Storage, email string) error {
+	return storage.Update(func(tx StorageTx) error {
+		return removeAccount(storage, tx, email)
+	})
+}
+
+// Deletes an account within `tx`. The vaults and memberships are listed from `storage` within the
+// transaction, so vaults created or shared concurrently can't survive the deletion. This only sees the
+// records committed so far, so it has to happen before any vault records are changed through `tx`
+func removeAccount(storage Storage, tx StorageTx, email string) error {
 	acc := &Account{Email: email}
 
-	if err := server.Storage.Delete(&DataStore{Account: acc}); err != nil {
+	vaults, err := vaultNames(storage, acc)
+	if err != nil {
 		return err
 	}
 
-	if err := server.Storage.Delete(acc); err != nil {
+	shared, err := memberships(storage, email)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	for _, vault := range vaults {
+		if err := tx.Delete(&DataStore{Account: acc, Vault: vault}); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&StoreHistory{Account: acc, Vault: vault}); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&SharedVault{Owner: email, Vault: vault}); err != nil {
+			return err
+		}
+
+		if err := deleteChangeLog(tx, &ChangeLog{Account: acc, Vault: vault}); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&PendingDeletion{Email: email, Vault: vault}); err != nil {
+			return err
+		}
+	}
+
+	// Remove the account from all vaults shared with it, so a new account with the same email
+	// doesn't inherit access to them
+	for _, sv := range shared {
+		if err := removeVaultMember(tx, sv.Owner, sv.Vault, email); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	if err := tx.Delete(&PendingDeletion{Email: email}); err != nil {
+		return err
+	}
+
+	return tx.Delete(acc)
 }
 
 // Retreives Account object from a http.Request object by evaluating the Authorization header and
@@ -176,16 +273,31 @@ func (server *Server) Authenticate(r *http.Request) (*AuthToken, error) {
 		return nil, &InvalidAuthToken{}
 	}
 
+	// The account is updated within a transaction so concurrent requests don't overwrite changes made
+	// elsewhere, e.g. to the two-factor authentication settings
+	if err := server.Storage.Update(func(tx StorageTx) error {
+		return server.authenticate(tx, r, authToken)
+	}); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("returning auth token")
+
+	return authToken, nil
+}
+
+// Validates `authToken` against the account read through `tx` and records its use
+func (server *Server) authenticate(tx StorageTx, r *http.Request, authToken *AuthToken) error {
 	invalidErr := &InvalidAuthToken{authToken.Email, authToken.Token}
 
 	acc := &Account{Email: authToken.Email}
 
 	// Fetch account for the given email address
-	if err := server.Storage.Get(acc); err != nil {
+	if err := tx.Get(acc); err != nil {
 		if err == ErrNotFound {
-			return nil, invalidErr
+			return invalidErr
 		} else {
-			return nil, err
+			return err
 		}
 	}
 
@@ -199,16 +311,16 @@ func (server *Server) Authenticate(r *http.Request) (*AuthToken, error) {
 		ip := server.Config.SkeletonIP
 
 		if key == "" || (ip != "" && ip != IPFromRequest(r)) || key != authToken.Token {
-			return nil, invalidErr
+			return invalidErr
 		}
 		authToken.account = acc
 	} else if !authToken.Validate(acc) {
-		return nil, invalidErr
+		return invalidErr
 	}
 
 	// Check if the token is expired
 	if authToken.Expired() {
-		return nil, &ExpiredAuthToken{authToken.Email, authToken.Token}
+		return &ExpiredAuthToken{authToken.Email, authToken.Token}
 	}
 
 	// If everything checks out, update the `LastUsed` field with the current time
@@ -224,13 +336,7 @@ func (server *Server) Authenticate(r *http.Request) (*AuthToken, error) {
 	acc.UpdateAuthToken(authToken)
 
 	// Save account info to persist last used data for auth tokens
-	if err := server.Storage.Put(acc); err != nil {
-		return nil, err
-	}
-
-	fmt.Println("returning auth token")
-
-	return authToken, nil
+	return tx.Put(acc)
 }
 
 func (server *Server) LogError(err error, r *http.Request) {
@@ -252,6 +358,7 @@ func (server *Server) HandleError(e error, w http.ResponseWriter, r *http.Reques
 	}
 
 	server.LogError(err, r)
+	server.Metrics.RecordError(err.Code())
 
 	var response []byte
 	accept := r.Header.Get("Accept")
@@ -291,11 +398,16 @@ func (server *Server) WrapEndpoint(endpoint *Endpoint) Handler {
 	// Check for correct endpoint version
 	h = (&CheckEndpointVersion{server, endpoint.Version}).Wrap(h)
 
-	// Wrap handler in auth middleware
-	h = (&Authenticate{server, endpoint.AuthType}).Wrap(h)
+	if endpoint.Streaming {
+		// Streaming responses stay open indefinitely, so only lock the account while authenticating
+		h = (&Authenticate{server, endpoint.AuthType, true}).Wrap(h)
+	} else {
+		// Wrap handler in auth middleware
+		h = (&Authenticate{server, endpoint.AuthType, false}).Wrap(h)
 
-	// Wrap handler in auth middleware
-	h = (&LockAccount{server}).Wrap(h)
+		// Wrap handler in auth middleware
+		h = (&LockAccount{server}).Wrap(h)
+	}
 
 	// Check if Method is supported
 	h = (&CheckMethod{endpoint.Handlers}).Wrap(h)
@@ -346,7 +458,8 @@ func (server *Server) InitEndpoints() {
 		},
 	}
 
-	// Endpoint for reading / writing and deleting a store
+	// Endpoint for reading / writing a store. `/store/` refers to the default vault while
+	// `/store/{name}/` refers to the vault with the given name
 	server.Endpoints["/store/"] = &Endpoint{
 		Handlers: map[string]Handler{
 			"GET":  &ReadStore{server},
@@ -358,6 +471,61 @@ func (server *Server) InitEndpoints() {
 		AuthType: "universal",
 	}
 
+	// Endpoint for listing and restoring previous revisions of a store
+	server.Endpoints["/store/history/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET":  &ReadStoreHistory{server},
+			"POST": &RestoreStore{server},
+		},
+		AuthType: "universal",
+	}
+
+	// Endpoint for synchronizing vaults via their change logs, addressed like in `/store/`
+	server.Endpoints["/changes/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET":  &ReadChanges{server},
+			"POST": &WriteChanges{server},
+			"PUT":  &CompactChanges{server},
+		},
+		AuthType: "universal",
+	}
+
+	// Endpoint for streaming changes to the data of an account
+	server.Endpoints["/events/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": &StoreEvents{server},
+		},
+		AuthType:  "universal",
+		Streaming: true,
+	}
+
+	// Endpoint for listing and creating vaults as well as deleting them via `/vaults/{name}/`
+	server.Endpoints["/vaults/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET":    &ReadVaults{server},
+			"POST":   &AddVault{server},
+			"DELETE": &RemoveVault{server},
+		},
+		AuthType: "universal",
+	}
+
+	// Endpoint for listing members of a vault and inviting new ones
+	server.Endpoints["/share/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET":  &ReadVaultMembers{server},
+			"POST": &ShareVault{server},
+		},
+		AuthType: "universal",
+	}
+
+	// Endpoint for removing members from a vault
+	server.Endpoints["/unshare/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"POST": &UnshareVault{server},
+		},
+		AuthType: "universal",
+	}
+
 	server.Endpoints["/deletestore/"] = &Endpoint{
 		Handlers: map[string]Handler{
 			"POST": &DeleteStore{server},
@@ -372,6 +540,14 @@ func (server *Server) InitEndpoints() {
 		AuthType: "universal",
 	}
 
+	// Endpoint for undoing pending deletions. Authenticated through the token of the deletion
+	server.Endpoints["/undelete/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET":  &UndoDeletion{server},
+			"POST": &UndoDeletion{server},
+		},
+	}
+
 	// Dashboard for managing data, auth tokens etc.
 	server.Endpoints["/dashboard/"] = &Endpoint{
 		Handlers: map[string]Handler{
@@ -380,6 +556,28 @@ func (server *Server) InitEndpoints() {
 		AuthType: "web",
 	}
 
+	// Endpoints for enrolling in and turning off two-factor authentication
+	server.Endpoints["/totp/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"POST": &EnrollTOTP{server},
+		},
+		AuthType: "web",
+	}
+
+	server.Endpoints["/totp/enable/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"POST": &EnableTOTP{server},
+		},
+		AuthType: "web",
+	}
+
+	server.Endpoints["/totp/disable/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"POST": &DisableTOTP{server},
+		},
+		AuthType: "web",
+	}
+
 	// Endpoint for logging out
 	server.Endpoints["/logout/"] = &Endpoint{
 		Handlers: map[string]Handler{
@@ -404,6 +602,22 @@ func (server *Server) InitEndpoints() {
 		AuthType: "universal",
 	}
 
+	// Endpoint for exporting all data of an account
+	server.Endpoints["/export/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"GET": &ExportAccount{server},
+		},
+		AuthType: "universal",
+	}
+
+	// Endpoint for importing an export created on this or another instance
+	server.Endpoints["/import/"] = &Endpoint{
+		Handlers: map[string]Handler{
+			"POST": &ImportAccount{server},
+		},
+		AuthType: "universal",
+	}
+
 	server.Endpoints["/static/"] = &Endpoint{
 		Handlers: map[string]Handler{
 			"GET": NewStaticHandler(
@@ -428,11 +642,11 @@ func (server *Server) InitHandler() {
 	mux := http.NewServeMux()
 
 	for key, endpoint := range server.Endpoints {
-		mux.Handle(key, HttpHandler(server.WrapEndpoint(endpoint)))
+		mux.Handle(key, server.Metrics.Instrument(key, HttpHandler(server.WrapEndpoint(endpoint))))
 	}
 
 	if server.Config.Cors {
-		exposedHeaders := []string{"X-Sub-Required", "X-Sub-Status", "X-Sub-Trial-End", "X-Stripe-Pub-Key"}
+		exposedHeaders := []string{"X-Sub-Required", "X-Sub-Status", "X-Sub-Trial-End", "X-Stripe-Pub-Key", "ETag"}
 		if server.Config.Test {
 			exposedHeaders = append(exposedHeaders, "X-Test-Act-Url")
 		}
@@ -441,6 +655,10 @@ func (server *Server) InitHandler() {
 			AllowedMethods: []string{"HEAD", "GET", "POST", "PUT", "DELETE"},
 			AllowedHeaders: []string{
 				"Authorization", "Accept", "Content-Type", "X-Client-Version", "X-Client-Platform",
+				"If-Match",
+				"If-None-Match",
+				"Content-Encoding",
+				"Last-Event-ID",
 				"X-Device-App-Version",
 				"X-Device-Platform",
 				"X-Device-UUID",
@@ -474,27 +692,61 @@ func (server *Server) SendDeprecatedVersionEmail(r *http.Request) error {
 		email = r.PostFormValue("email")
 	}
 
-	if email != "" && !server.emailRateLimiter.RateLimit(IPFromRequest(r), email) {
-		var buff bytes.Buffer
-		if err := server.Templates.DeprecatedVersionEmail.Execute(&buff, nil); err != nil {
-			return err
-		}
-		body := buff.String()
+	if email == "" {
+		return nil
+	}
 
-		// Send email about deprecated api version
-		go func() {
-			if err := server.Sender.Send(email, "Please update your version of Padlock", body); err != nil {
-				server.LogError(&ServerError{err}, r)
-			}
-		}()
+	if server.emailRateLimiter.RateLimit(IPFromRequest(r), email) {
+		server.Metrics.RecordRateLimitDenial("deprecated_version_email")
+		return nil
 	}
 
+	var buff bytes.Buffer
+	if err := server.Templates.DeprecatedVersionEmail.Execute(&buff, nil); err != nil {
+		return err
+	}
+	body := buff.String()
+
+	// Send email about deprecated api version
+	go func() {
+		if err := server.SendEmail(email, "Please update your version of Padlock", body); err != nil {
+			server.LogError(&ServerError{err}, r)
+		}
+	}()
+
 	return nil
 }
 
+// Sends an email through the servers `Sender`, recording the result
+func (server *Server) SendEmail(rec string, subject string, body string) error {
+	err := server.Sender.Send(rec, subject, body)
+	server.Metrics.RecordEmail(err)
+	return err
+}
+
+// Creates a new job, recording the duration of each run
+func (server *Server) NewJob(name string, action func()) *Job {
+	return &Job{
+		Action: func() {
+			defer server.Metrics.RecordJob(name, time.Now())
+			action()
+		},
+	}
+}
+
 func (server *Server) Init() error {
 	var err error
 
+	if server.Config.Admin.Addr != "" && server.Config.Admin.Token == "" {
+		return fmt.Errorf("An admin token is required for serving the admin interface on %s", server.Config.Admin.Addr)
+	}
+
+	if server.Config.Metrics.Enabled && server.Metrics == nil {
+		server.Metrics = NewMetrics()
+		server.Metrics.Cache = findCachedStorage(server.Storage)
+		server.Storage = &MeteredStorage{server.Storage, server.Metrics}
+	}
+
 	if err := server.Log.Init(); err != nil {
 		return err
 	}
@@ -537,36 +789,72 @@ func (server *Server) Init() error {
 		server.emailRateLimiter = rl
 	}
 
-	server.cleanAuthRequests = &Job{
-		Action: func() {
-			ar := &AuthRequest{}
-			iter, err := server.Storage.Iterator(ar)
-			if err != nil {
+	server.cleanAuthRequests = server.NewJob("clean_auth_requests", func() {
+		ar := &AuthRequest{}
+		iter, err := server.Storage.Iterator(ar)
+		if err != nil {
+			server.Log.Error.Println("Error while cleaning auth requests:", err)
+			return
+		}
+		defer iter.Release()
+
+		n := 0
+		for iter.Next() {
+			if err := iter.Get(ar); err != nil {
 				server.Log.Error.Println("Error while cleaning auth requests:", err)
-				return
 			}
-			defer iter.Release()
-
-			n := 0
-			for iter.Next() {
-				if err := iter.Get(ar); err != nil {
+			if ar.Created.Before(time.Now().Add(-24 * time.Hour)) {
+				if err := server.Storage.Delete(ar); err != nil {
 					server.Log.Error.Println("Error while cleaning auth requests:", err)
 				}
-				if ar.Created.Before(time.Now().Add(-24 * time.Hour)) {
-					if err := server.Storage.Delete(ar); err != nil {
-						server.Log.Error.Println("Error while cleaning auth requests:", err)
-					}
-					n = n + 1
-				}
+				n = n + 1
 			}
+		}
 
+		if n > 0 {
+			server.Log.Info.Printf("Deleted %d auth requests older than 24 hrs", n)
+		}
+	})
+
+	server.cleanAuthRequests.Start(24 * time.Hour)
+
+	if server.Config.Backup.Dir != "" && server.Config.Backup.Interval > 0 {
+		server.backup = server.NewJob("backup", func() {
+			path, n, err := RunScheduledBackup(server.Storage, &server.Config.Backup)
+			if err != nil {
+				server.Log.Error.Println("Error while creating backup:", err)
+				return
+			}
+			server.Log.Info.Printf("Backed up %d records to %s", n, path)
+		})
+
+		server.backup.Start(server.Config.Backup.Interval)
+	}
+
+	if server.Config.DeletionGracePeriod > 0 {
+		server.purgeDeletions = server.NewJob("purge_deletions", func() {
+			n, err := server.PurgeDeletions()
+			if err != nil {
+				server.Log.Error.Println("Error while purging deletions:", err)
+			}
 			if n > 0 {
-				server.Log.Info.Printf("Deleted %d auth requests older than 24 hrs", n)
+				server.Log.Info.Printf("Carried out %d pending deletions", n)
 			}
-		},
+		})
+
+		server.purgeDeletions.Start(time.Hour)
 	}
 
-	server.cleanAuthRequests.Start(24 * time.Hour)
+	if server.Metrics != nil {
+		server.accountStats = server.NewJob("account_stats", func() {
+			if err := server.Metrics.UpdateAccountStats(server.Storage); err != nil {
+				server.Log.Error.Println("Error while collecting account stats:", err)
+			}
+		})
+
+		go server.accountStats.Action()
+		server.accountStats.Start(10 * time.Minute)
+	}
 
 	if server.Config.WhitelistPath != "" {
 		whitelist, err := NewWhitelist(server.Config.WhitelistPath)
@@ -586,6 +874,21 @@ func (server *Server) CleanUp() error {
 	if server.cleanAuthRequests != nil {
 		server.cleanAuthRequests.Stop()
 	}
+	if server.backup != nil {
+		server.backup.Stop()
+	}
+	if server.purgeDeletions != nil {
+		server.purgeDeletions.Stop()
+	}
+	if server.accountStats != nil {
+		server.accountStats.Stop()
+	}
+	if server.metricsServer != nil {
+		server.metricsServer.Close()
+	}
+	if server.adminServer != nil {
+		server.adminServer.Close()
+	}
 	return server.Storage.Close()
 }
 
@@ -600,6 +903,36 @@ func (server *Server) Start() error {
 
 	server.Addr = fmt.Sprintf(":%d", port)
 
+	if server.Metrics != nil && server.Config.Metrics.Addr != "" {
+		server.metricsServer = &http.Server{
+			Addr:    server.Config.Metrics.Addr,
+			Handler: server.Metrics,
+		}
+		go func() {
+			server.Info.Printf("Serving metrics on %s", server.Config.Metrics.Addr)
+			if err := server.metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				server.Error.Println("Error while serving metrics:", err)
+			}
+		}()
+	}
+
+	if server.Metrics != nil && server.Config.Metrics.Addr == "" && server.Config.Admin.Addr == "" {
+		server.Info.Println("Metrics are collected but not served. Use --metrics-addr or --admin-addr to export them")
+	}
+
+	if server.Config.Admin.Addr != "" {
+		server.adminServer = &http.Server{
+			Addr:    server.Config.Admin.Addr,
+			Handler: server.AdminHandler(),
+		}
+		go func() {
+			server.Info.Printf("Serving admin interface on %s", server.Config.Admin.Addr)
+			if err := server.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				server.Error.Println("Error while serving admin interface:", err)
+			}
+		}()
+	}
+
 	// Start server
 	if tlsCert != "" && tlsKey != "" {
 		server.Info.Printf("Starting server with TLS on port %v", port)
@@ -622,12 +955,15 @@ func NewServer(log *Log, storage Storage, sender Sender, config *ServerConfig) *
 		Storage: storage,
 		Sender:  sender,
 		Config:  config,
+		Events:  NewEventHub(),
 	}
 
 	// Hook up logger for http.Server
 	server.ErrorLog = server.Error
 	// Hook up logger for graceful.Server
 	server.Logger = server.Error
+	// End open event streams so they don't hold up the shutdown
+	server.ShutdownInitiated = server.Events.Close
 
 	return server
 }
@@ -1,7 +1,9 @@
 package padlockcloud
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -18,6 +20,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -31,7 +34,7 @@ func init() {
 	authMaxAge = func(authType string) time.Duration {
 		switch authType {
 		case "web":
-			return time.Millisecond * 10
+			return time.Millisecond * 100
 		default:
 			return time.Duration(0)
 		}
@@ -78,11 +81,20 @@ func (ctx *serverTestContext) followRedirects(follow bool) {
 
 // Helper function for creating (optionally authenticated) requests
 func (ctx *serverTestContext) request(method string, url string, body string, version int) (*http.Response, error) {
+	return ctx.requestWithHeaders(method, url, body, version, nil)
+}
+
+// Same as `request` but allows setting additional request headers
+func (ctx *serverTestContext) requestWithHeaders(method string, url string, body string, version int, headers map[string]string) (*http.Response, error) {
 	req, err := http.NewRequest(method, url, bytes.NewBuffer([]byte(body)))
 	if err != nil {
 		return nil, err
 	}
 
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+
 	if method == "POST" || method == "PUT" {
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
@@ -233,6 +245,11 @@ func newServerTestContextWithConfig(serverConfig *ServerConfig) *serverTestConte
 		template.Must(template.New("").Parse("<html>{{ .message }}</html>")),
 		template.Must(template.New("").Parse("login,{{ .email }},{{ .submitted }}")),
 		template.Must(template.New("").Parse("dashboard")),
+		template.Must(template.New("").Parse("{{ .owner }}, {{ .vault }}, {{ .activation_link }}")),
+		template.Must(template.New("").Parse("{{ .email }}, {{ .vault }}, {{ .undo_link }}")),
+		template.Must(template.New("").Parse("{{ .email }}, {{ .confirm_link }}, {{ .code }}")),
+		template.Must(template.New("").Parse("totp,{{ .email }},{{ .invalid }}")),
+		template.Must(template.New("").Parse("delete-account,{{ .email }},{{ .token }}")),
 	}
 
 	logger := &Log{Config: &LogConfig{}}
@@ -425,7 +442,7 @@ func TestAuthentication(t *testing.T) {
 			t.Error("No auth token passed to handler")
 		} else {
 			if at.Type != "api" {
-				t.Error("Wrong token type. Expected %s, got %s", "api", at.Type)
+				t.Errorf("Wrong token type. Expected %s, got %s", "api", at.Type)
 			}
 
 			if at.Email != testEmail {
@@ -472,7 +489,7 @@ func TestAuthentication(t *testing.T) {
 			t.Error("No auth token passed to handler")
 		} else {
 			if at.Type != "web" {
-				t.Error("Wrong token type. Expected %s, got %s", "web", at.Type)
+				t.Errorf("Wrong token type. Expected %s, got %s", "web", at.Type)
 			}
 
 			if at.Email != testEmail {
@@ -628,6 +645,132 @@ func TestStore(t *testing.T) {
 		testResponse(t, res, http.StatusOK, fmt.Sprintf("^%s$", testData))
 	})
 
+	t.Run("conditional write", func(t *testing.T) {
+		if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusOK, "")
+		etag := res.Header.Get("ETag")
+		if etag == "" {
+			t.Fatal("Expected ETag header to be set")
+		}
+
+		// Fetching the same revision again should not transfer any data
+		if res, err = ctx.requestWithHeaders("GET", ctx.host+"/store/", "", ApiVersion, map[string]string{
+			"If-None-Match": etag,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusNotModified, "^$")
+
+		// Creating the store should fail since it already exists
+		if res, err = ctx.requestWithHeaders("PUT", ctx.host+"/store/", "Conflict", ApiVersion, map[string]string{
+			"If-None-Match": "*",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &PreconditionFailed{})
+
+		// Writing based on the current revision should go through and yield a new entity tag
+		if res, err = ctx.requestWithHeaders("PUT", ctx.host+"/store/", "Update", ApiVersion, map[string]string{
+			"If-Match": etag,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusNoContent, "")
+		newEtag := res.Header.Get("ETag")
+		if newEtag == "" || newEtag == etag {
+			t.Fatalf("Expected new ETag after write, got %s", newEtag)
+		}
+
+		// Writing based on a stale revision should fail and report the current one
+		if res, err = ctx.requestWithHeaders("PUT", ctx.host+"/store/", "Stale", ApiVersion, map[string]string{
+			"If-Match": etag,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if res.Header.Get("ETag") != newEtag {
+			t.Errorf("Expected current ETag %s to be reported, got %s", newEtag, res.Header.Get("ETag"))
+		}
+		testError(t, res, &PreconditionFailed{})
+
+		// Data should not have been overwritten by the stale write
+		if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusOK, "^Update$")
+
+		// Of two concurrent writes based on the same revision, only one should go through
+		statuses := make(chan int, 2)
+		for _, content := range []string{"Concurrent1", "Concurrent2"} {
+			go func(content string) {
+				res, err := ctx.requestWithHeaders("PUT", ctx.host+"/store/", content, ApiVersion, map[string]string{
+					"If-Match": newEtag,
+				})
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				res.Body.Close()
+				statuses <- res.StatusCode
+			}(content)
+		}
+
+		counts := map[int]int{}
+		for i := 0; i < 2; i++ {
+			counts[<-statuses]++
+		}
+		if counts[http.StatusNoContent] != 1 || counts[http.StatusPreconditionFailed] != 1 {
+			t.Fatalf("Expected exactly one concurrent write to fail with 412, got %v", counts)
+		}
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte("Compressed"))
+		gz.Close()
+
+		if res, err = ctx.requestWithHeaders("PUT", ctx.host+"/store/", buf.String(), ApiVersion, map[string]string{
+			"Content-Encoding": "gzip",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusNoContent, "")
+
+		if res, err = ctx.requestWithHeaders("PUT", ctx.host+"/store/", "Data", ApiVersion, map[string]string{
+			"Content-Encoding": "br",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &UnsupportedContentEncoding{})
+
+		// Setting the header explicitly prevents the client from decompressing the response transparently
+		if res, err = ctx.requestWithHeaders("GET", ctx.host+"/store/", "", ApiVersion, map[string]string{
+			"Accept-Encoding": "gzip",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if res.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Expected gzip-encoded response, got '%s'", res.Header.Get("Content-Encoding"))
+		}
+		body, err := gunzip(res.Body)
+		res.Body.Close()
+		if err != nil || string(body) != "Compressed" {
+			t.Fatalf("Expected 'Compressed', got '%s' (%v)", body, err)
+		}
+
+		if res, err = ctx.requestWithHeaders("GET", ctx.host+"/store/", "", ApiVersion, map[string]string{
+			"Accept-Encoding": "gzip;q=0, identity",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if res.Header.Get("Content-Encoding") != "" {
+			t.Fatalf("Expected uncompressed response, got '%s'", res.Header.Get("Content-Encoding"))
+		}
+		testResponse(t, res, http.StatusOK, "^Compressed$")
+	})
+
 	t.Run("reset data", func(t *testing.T) {
 		ctx.loginWeb(testEmail, "")
 
@@ -648,200 +791,1568 @@ func TestStore(t *testing.T) {
 	})
 }
 
-func TestDashboard(t *testing.T) {
-	ctx := newServerTestContext()
-	ctx.followRedirects(true)
+func TestStoreHistory(t *testing.T) {
+	var res *http.Response
+	var err error
 
-	// If not logged in, should redirect to login page
-	res, _ := ctx.request("GET", ctx.host+"/dashboard/", "", 0)
-	testResponse(t, res, http.StatusOK, "^login,,$")
+	ctx := newServerTestContextWithConfig(&ServerConfig{History: HistoryConfig{Size: 2}})
 
-	if _, err := ctx.loginWeb(testEmail, ""); err != nil {
+	if _, err := ctx.loginApi(testEmail); err != nil {
 		t.Fatal(err)
 	}
 
-	// We should be logged in now, so dashboard should render
-	res, _ = ctx.request("GET", ctx.host+"/dashboard/", "", 0)
-	testResponse(t, res, http.StatusOK, "^dashboard$")
-}
+	for _, content := range []string{"rev1", "rev2", "rev3"} {
+		if res, err = ctx.request("PUT", ctx.host+"/store/", content, ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusNoContent, "")
+	}
 
-func TestLogout(t *testing.T) {
-	var res *http.Response
-	var err error
+	readHistory := func() []map[string]interface{} {
+		if res, err = ctx.request("GET", ctx.host+"/store/history/", "", ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		body, err := validateResponse(res, http.StatusOK, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var revs []map[string]interface{}
+		if err := json.Unmarshal(body, &revs); err != nil {
+			t.Fatal(err)
+		}
+		return revs
+	}
 
-	ctx := newServerTestContext()
+	// Only the two most recent revisions should be kept, most recent first
+	revs := readHistory()
+	if len(revs) != 2 {
+		t.Fatalf("Expected 2 revisions, got %d", len(revs))
+	}
+	if revs[0]["size"] != float64(4) || revs[0]["tokenId"] != ctx.authToken.Id {
+		t.Errorf("Unexpected revision data: %v", revs[0])
+	}
 
-	if _, err = ctx.loginWeb(testEmail, ""); err != nil {
+	// Restore the previous revision
+	restoredId := revs[1]["id"].(string)
+	if res, err = ctx.request("POST", ctx.host+"/store/history/", url.Values{
+		"id": {restoredId},
+	}.Encode(), ApiVersion); err != nil {
 		t.Fatal(err)
 	}
+	testResponse(t, res, http.StatusNoContent, "")
 
-	// Log out
-	if res, err = ctx.request("GET", ctx.host+"/logout/", "", 0); err != nil {
+	if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
 		t.Fatal(err)
 	}
-	testResponse(t, res, http.StatusOK, "")
+	testResponse(t, res, http.StatusOK, "^rev2$")
 
-	// If not logged in, should redirect to login page
-	if res, err = ctx.request("GET", ctx.host+"/dashboard/", "", 0); err != nil {
+	// Restoring a revision should itself be recorded as a new revision
+	if revs = readHistory(); len(revs) != 2 || revs[0]["id"] != restoredId {
+		t.Errorf("Expected restored revision to be recorded, got %v", revs)
+	}
+
+	if res, err = ctx.request("POST", ctx.host+"/store/history/", url.Values{
+		"id": {"asdf"},
+	}.Encode(), ApiVersion); err != nil {
 		t.Fatal(err)
 	}
-	testResponse(t, res, http.StatusOK, "^login,,$")
+	testError(t, res, &BadRequest{"no such revision"})
+
+	// Previous revisions count towards the storage used by the account, except for the one reflecting
+	// the current content
+	usage, err := GetStoreUsage(ctx.storage, &Account{Email: testEmail}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.History != 4 || usage.Total() != 8 {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
+
+	// Resetting the default vault should remove its history as well, so deleted data can't be restored
+	if err := DeleteVault(ctx.storage, &Account{Email: testEmail}, DefaultVault); err != nil {
+		t.Fatal(err)
+	}
+	if revs = readHistory(); len(revs) != 0 {
+		t.Fatalf("Expected history to be deleted along with the data, got %v", revs)
+	}
 }
 
-func TestRevokeAuthToken(t *testing.T) {
+func TestVaults(t *testing.T) {
 	var res *http.Response
 	var err error
 
-	ctx := newServerTestContext()
-	ctx.followRedirects(true)
+	ctx := newServerTestContextWithConfig(&ServerConfig{History: HistoryConfig{Size: 2}})
 
-	t.Run("unautenticated", func(t *testing.T) {
-		// If not logged in, should redirect to login page
-		if res, err = ctx.request("POST", ctx.host+"/revoke/", "", ApiVersion); err != nil {
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	readVaults := func() []map[string]interface{} {
+		if res, err = ctx.request("GET", ctx.host+"/vaults/", "", ApiVersion); err != nil {
 			t.Fatal(err)
 		}
-		testResponse(t, res, http.StatusOK, "login,,")
-	})
+		body, err := validateResponse(res, http.StatusOK, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var vaults []map[string]interface{}
+		if err := json.Unmarshal(body, &vaults); err != nil {
+			t.Fatal(err)
+		}
+		return vaults
+	}
 
-	// Login in
-	if res, err = ctx.loginWeb(testEmail, ""); err != nil {
+	// The default vault should always be listed
+	if vaults := readVaults(); len(vaults) != 1 || vaults[0]["name"] != DefaultVault {
+		t.Fatalf("Expected only the default vault, got %v", vaults)
+	}
+
+	// Named vaults have to be created before they can be used
+	if res, err = ctx.request("PUT", ctx.host+"/store/work/", "work", ApiVersion); err != nil {
 		t.Fatal(err)
 	}
+	testError(t, res, &VaultNotFound{})
 
-	t.Run("revoke by token", func(t *testing.T) {
-		// Create and activate new auth token
-		if res, err = ctx.loginApi(testEmail); err != nil {
-			t.Fatal(err)
-		}
-		at := ctx.authToken
-		ctx.authToken = nil
+	if res, err = ctx.request("GET", ctx.host+"/store/work/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &VaultNotFound{})
 
-		// Revoke auth token by token
-		if res, err = ctx.request("POST", ctx.host+"/revoke/", url.Values{
-			"gorilla.csrf.Token": {ctx.getCsrfToken()},
-			"token":              {at.Token},
-		}.Encode(), 0); err != nil {
+	for _, name := range []string{"work", "personal"} {
+		if res, err = ctx.request("POST", ctx.host+"/vaults/", url.Values{
+			"name": {name},
+		}.Encode(), ApiVersion); err != nil {
 			t.Fatal(err)
 		}
-		testResponse(t, res, http.StatusOK, "")
+		testResponse(t, res, http.StatusCreated, "")
+	}
 
-		ctx.authToken = at
-		if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+	for _, name := range []string{"work", "default"} {
+		if res, err = ctx.request("POST", ctx.host+"/vaults/", url.Values{
+			"name": {name},
+		}.Encode(), ApiVersion); err != nil {
 			t.Fatal(err)
 		}
-		testError(t, res, &ExpiredAuthToken{})
-	})
+		testError(t, res, &VaultExists{})
+	}
 
-	t.Run("revoke by id", func(t *testing.T) {
-		// Create and activate new auth token
-		if res, err = ctx.loginApi(testEmail); err != nil {
+	for _, name := range []string{"", "Work", "history", "a/b"} {
+		if res, err = ctx.request("POST", ctx.host+"/vaults/", url.Values{
+			"name": {name},
+		}.Encode(), ApiVersion); err != nil {
 			t.Fatal(err)
 		}
-		at := ctx.authToken
-		ctx.authToken = nil
-
-		// Get id
-		acc := &Account{Email: at.Email}
-		ctx.storage.Get(acc)
-		at.Validate(acc)
+		testResponse(t, res, http.StatusBadRequest, "")
+	}
 
-		// Revoke auth token by id
-		if res, err = ctx.request("POST", ctx.host+"/revoke/", url.Values{
-			"gorilla.csrf.Token": {ctx.getCsrfToken()},
-			"id":                 {at.Id},
-		}.Encode(), 0); err != nil {
+	// Vaults should be independent of each other
+	for path, content := range map[string]string{"/store/": "default", "/store/work/": "work"} {
+		if res, err = ctx.request("PUT", ctx.host+path, content, ApiVersion); err != nil {
 			t.Fatal(err)
 		}
-		testResponse(t, res, http.StatusOK, "")
+		testResponse(t, res, http.StatusNoContent, "")
+	}
 
-		ctx.authToken = at
-		if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+	for path, content := range map[string]string{
+		"/store/":          "^default$",
+		"/store/default/":  "^default$",
+		"/store/work/":     "^work$",
+		"/store/personal/": "^$",
+	} {
+		if res, err = ctx.request("GET", ctx.host+path, "", ApiVersion); err != nil {
 			t.Fatal(err)
 		}
-		testError(t, res, &ExpiredAuthToken{})
-	})
-}
+		testResponse(t, res, http.StatusOK, content)
+	}
 
-func TestMethodNotAllowed(t *testing.T) {
-	ctx := newServerTestContext()
-	// Requests with unsupported HTTP methods should return with 405 - method not allowed
-	if res, err := ctx.request("GET", ctx.host+"/auth/", "", ApiVersion); err != nil {
+	if res, err = ctx.request("GET", ctx.host+"/store/work/nested/", "", ApiVersion); err != nil {
 		t.Fatal(err)
-	} else {
-		testError(t, res, &MethodNotAllowed{})
 	}
-}
+	testError(t, res, &UnsupportedEndpoint{})
+
+	vaults := readVaults()
+	if len(vaults) != 3 ||
+		vaults[0]["name"] != "default" || vaults[0]["size"] != float64(7) ||
+		vaults[1]["name"] != "personal" || vaults[1]["size"] != float64(0) ||
+		vaults[2]["name"] != "work" || vaults[2]["size"] != float64(4) {
+		t.Fatalf("Unexpected vaults: %v", vaults)
+	}
 
-func TestUnsupportedEndpoint(t *testing.T) {
-	ctx := newServerTestContext()
-	// Requests to unsupported paths should return with 404 - not found
-	if res, err := ctx.request("GET", ctx.host+"/invalidpath", "", ApiVersion); err != nil {
+	// Each vault should have its own history
+	if res, err = ctx.request("GET", ctx.host+"/store/history/work/", "", ApiVersion); err != nil {
 		t.Fatal(err)
-	} else {
-		testError(t, res, &UnsupportedEndpoint{})
 	}
-}
+	body, err := validateResponse(res, http.StatusOK, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var revs []map[string]interface{}
+	if err := json.Unmarshal(body, &revs); err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 || revs[0]["size"] != float64(4) {
+		t.Fatalf("Unexpected history for vault: %v", revs)
+	}
 
-func TestOutdatedVersion(t *testing.T) {
-	ctx := newServerTestContext()
+	// Usage should be summed up across all vaults. Histories only hold the current revisions, which
+	// don't count twice
+	usage, err := GetStoreUsage(ctx.storage, &Account{Email: testEmail}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *usage != (StoreUsage{Store: 11, History: 0}) {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
 
-	// The root path is a special case in that the only way to figure out if the client is using
-	// and older api version is if the Authorization header is using the 'ApiKey' authentication scheme
-	token, _ := token()
-	req, _ := http.NewRequest("GET", ctx.host+"/", nil)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s:%s", testEmail, token))
-	res, _ := ctx.client.Do(req)
-	testError(t, res, &UnsupportedApiVersion{})
-	if ctx.sender.Recipient != testEmail {
-		t.Errorf("Expected outdated message to be sent to %s, instead got %s", testEmail, ctx.sender.Recipient)
+	// Deleting a vault should remove it along with its history
+	if res, err = ctx.request("DELETE", ctx.host+"/vaults/work/", "", ApiVersion); err != nil {
+		t.Fatal(err)
 	}
+	testResponse(t, res, http.StatusNoContent, "")
 
-	ctx.resetAll()
+	if err := ctx.storage.Get(&StoreHistory{Account: &Account{Email: testEmail}, Vault: "work"}); err != ErrNotFound {
+		t.Fatalf("Expected history of deleted vault to be removed, got %v", err)
+	}
 
-	// When doing an auth request, the email form field should be used for sending the notification since
-	// the user is not authenticated
-	res, _ = ctx.request("POST", ctx.host+"/auth/", url.Values{
-		"email": {testEmail},
-	}.Encode(), 0)
-	testError(t, res, &UnsupportedApiVersion{0, ApiVersion})
-	if ctx.sender.Recipient != testEmail {
-		t.Errorf("Expected outdated message to be sent to %s, instead got %s", testEmail, ctx.sender.Recipient)
+	if res, err = ctx.request("DELETE", ctx.host+"/vaults/work/", "", ApiVersion); err != nil {
+		t.Fatal(err)
 	}
+	testError(t, res, &VaultNotFound{})
 
-	ctx.resetAll()
+	if res, err = ctx.request("DELETE", ctx.host+"/vaults/default/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusBadRequest, "")
 
-	ctx.loginApi(testEmail)
+	if vaults := readVaults(); len(vaults) != 2 || vaults[1]["name"] != "personal" {
+		t.Fatalf("Expected deleted vault to be gone, got %v", vaults)
+	}
 
-	// When doing an auth request, the email form field should be used for sending the notification since
-	// the user is not authenticated
-	res, _ = ctx.request("GET", ctx.host+"/store/", url.Values{
-		"email": {testEmail},
-	}.Encode(), 0)
-	testError(t, res, &UnsupportedApiVersion{0, ApiVersion})
-	if ctx.sender.Recipient != testEmail {
-		t.Errorf("Expected outdated message to be sent to %s, instead got %s", testEmail, ctx.sender.Recipient)
+	// Deleting the account should remove all of its vaults
+	if err := ctx.server.DeleteAccount(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.storage.Get(&DataStore{Account: &Account{Email: testEmail}, Vault: "personal"}); err != ErrNotFound {
+		t.Fatalf("Expected vaults to be removed along with the account, got %v", err)
 	}
 }
 
-func TestPanicRecovery(t *testing.T) {
-	ctx := newServerTestContext()
-	res, _ := ctx.request("GET", ctx.host+"/panic/", "", 0)
-	testError(t, res, &ServerError{})
-	res, _ = ctx.request("POST", ctx.host+"/panic/", "", 0)
-	testError(t, res, &ServerError{})
-}
+func TestSharedVaults(t *testing.T) {
+	var res *http.Response
+	var err error
 
-func TestErrorFormat(t *testing.T) {
 	ctx := newServerTestContext()
+	member := "member@padlock.io"
 
-	e := &UnsupportedEndpoint{}
-	testErr := func(format string, expected []byte) {
-		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/invalidpath/?v=%d", ctx.host, ApiVersion), nil)
-		if format != "" {
-			req.Header.Add("Accept", format)
-		}
-		res, _ := ctx.client.Do(req)
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	ownerToken := ctx.authToken
+
+	if res, err = ctx.request("POST", ctx.host+"/vaults/", url.Values{"name": {"team"}}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusCreated, "")
+
+	if res, err = ctx.request("PUT", ctx.host+"/store/team/", "shared", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	// Only named vaults can be shared
+	if res, err = ctx.request("POST", ctx.host+"/share/", url.Values{
+		"vault": {"default"},
+		"email": {member},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusBadRequest, "")
+
+	ctx.sender.Reset()
+	if res, err = ctx.request("POST", ctx.host+"/share/", url.Values{
+		"vault": {"team"},
+		"email": {member},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+
+	// The invite is sent asynchronously
+	for i := 0; i < 100 && ctx.sender.Recipient == ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if ctx.sender.Recipient != member {
+		t.Fatalf("Expected invite to be sent to %s, got %s", member, ctx.sender.Recipient)
+	}
+	linkPattern := fmt.Sprintf("%s/a/\\?t=%s", ctx.host, tokenPattern)
+	if match, _ := regexp.MatchString(fmt.Sprintf("^%s, team, %s$", testEmail, linkPattern), ctx.sender.Message); !match {
+		t.Fatalf("Unexpected invite message: %s", ctx.sender.Message)
+	}
+	link := regexp.MustCompile(linkPattern).FindString(ctx.sender.Message)
+
+	memberToken, err := NewAuthToken(member, "api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memberAcc := &Account{Email: member}
+	memberAcc.AddAuthToken(memberToken)
+	if err := ctx.storage.Put(memberAcc); err != nil {
+		t.Fatal(err)
+	}
+	ctx.authToken = memberToken
+
+	// Members have no access until they accept the invite
+	sharedPath := ctx.host + "/store/" + testEmail + "/team/"
+	if res, err = ctx.request("GET", sharedPath, "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &VaultNotFound{})
+
+	if res, err = ctx.request("GET", link, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	if res, err = ctx.request("GET", sharedPath, "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^shared$")
+
+	if res, err = ctx.request("GET", ctx.host+"/store/history/"+testEmail+"/team/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	// Read-only members can't write to the vault
+	if res, err = ctx.request("PUT", sharedPath, "changed", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &VaultAccessDenied{})
+
+	// Shared vaults should be listed along with the members own vaults
+	if res, err = ctx.request("GET", ctx.host+"/vaults/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, fmt.Sprintf(`"name":"team","owner":"%s","revision":"[0-9a-f]+","role":"read"`, testEmail))
+
+	// Members can neither delete nor share the vault
+	if res, err = ctx.request("DELETE", ctx.host+"/vaults/"+testEmail+"/team/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &VaultAccessDenied{})
+
+	// Upgrade the member to write access
+	ctx.authToken = ownerToken
+	ctx.sender.Reset()
+	if res, err = ctx.request("POST", ctx.host+"/share/", url.Values{
+		"vault": {"team"},
+		"email": {member},
+		"role":  {"write"},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+
+	if res, err = ctx.request("GET", ctx.host+"/share/?vault=team", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, fmt.Sprintf(`^\[\{"accepted":true,"email":"%s","invited":"[^"]+","role":"write"\}\]$`, member))
+
+	ctx.authToken = memberToken
+	if res, err = ctx.request("PUT", sharedPath, "changed", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	ctx.authToken = ownerToken
+	if res, err = ctx.request("GET", ctx.host+"/store/team/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^changed$")
+
+	// Members can leave a vault, after which they lose access
+	ctx.authToken = memberToken
+	if res, err = ctx.request("POST", ctx.host+"/unshare/", url.Values{
+		"vault": {"team"},
+		"email": {member},
+		"owner": {testEmail},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if res, err = ctx.request("GET", sharedPath, "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &VaultNotFound{})
+
+	// Deleting the vault should remove its sharing settings as well
+	ctx.authToken = ownerToken
+	if _, err := InviteVaultMember(ctx.storage, &Account{Email: testEmail}, "team", member, VaultRoleRead); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = ctx.request("DELETE", ctx.host+"/vaults/team/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if err := ctx.storage.Get(&SharedVault{Owner: testEmail, Vault: "team"}); err != ErrNotFound {
+		t.Fatalf("Expected shared vault to be removed along with the vault, got %v", err)
+	}
+}
+
+func TestStoreEvents(t *testing.T) {
+	defer func(interval time.Duration) {
+		eventHeartbeatInterval = interval
+	}(eventHeartbeatInterval)
+	eventHeartbeatInterval = time.Millisecond * 50
+
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ctx.request("GET", ctx.host+"/events/", "", ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected event stream, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	// Reads lines from the stream until one starts with the given prefix
+	readLine := func(prefix string) string {
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("Stream ended while waiting for '%s'", prefix)
+				}
+				if strings.HasPrefix(line, prefix) {
+					return line
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for '%s'", prefix)
+			}
+		}
+	}
+
+	readLine("retry: ")
+	readLine(": heartbeat")
+
+	if res, err := ctx.request("PUT", ctx.host+"/store/", testData, ApiVersion); err != nil {
+		t.Fatal(err)
+	} else {
+		testResponse(t, res, http.StatusNoContent, "")
+	}
+
+	id := strings.TrimPrefix(readLine("id: "), "id: ")
+	if line := readLine("event: "); line != "event: update" {
+		t.Fatalf("Expected update event, got %s", line)
+	}
+
+	event := &StoreEvent{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(readLine("data: "), "data: ")), event); err != nil {
+		t.Fatal(err)
+	}
+	data := &DataStore{Account: &Account{Email: testEmail}, Content: []byte(testData)}
+	if event.Owner != testEmail || event.Vault != DefaultVault ||
+		event.Revision != data.Revision() || event.TokenId != ctx.authToken.Id || event.Time.IsZero() {
+		t.Fatalf("Unexpected event data: %+v", event)
+	}
+
+	// Clients resuming with the id of the last event they received shouldn't receive it again
+	ctx.server.Events.Publish(&StoreEvent{Type: StoreEventDelete}, testEmail)
+	res2, err := ctx.requestWithHeaders("GET", ctx.host+"/events/", "", ApiVersion, map[string]string{
+		"Last-Event-ID": id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res2.Body.Close()
+
+	scanner := bufio.NewScanner(res2.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "event: ") {
+			if scanner.Text() != "event: delete" {
+				t.Fatalf("Expected only missed events to be delivered, got %s", scanner.Text())
+			}
+			break
+		}
+	}
+
+	// Revoking the auth token should end open streams
+	if res, err := ctx.request("POST", ctx.host+"/revoke/", url.Values{
+		"id": {ctx.authToken.Id},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	} else {
+		testResponse(t, res, http.StatusOK, "")
+	}
+	for range lines {
+	}
+	if _, err := ioutil.ReadAll(res2.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	type changes struct {
+		Seq      int64
+		Snapshot *struct {
+			Seq     int64
+			Content []byte
+		}
+		Changes []struct {
+			Seq     int64
+			Content []byte
+		}
+	}
+
+	readChanges := func(since string) *changes {
+		if res, err = ctx.request("GET", ctx.host+"/changes/?since="+since, "", ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		body, err := validateResponse(res, http.StatusOK, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &changes{}
+		if err := json.Unmarshal(body, c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	if c := readChanges("0"); c.Seq != 0 || len(c.Changes) != 0 {
+		t.Fatalf("Expected empty change log, got %+v", c)
+	}
+
+	sub := ctx.server.Events.Subscribe(testEmail, "", 0)
+	defer ctx.server.Events.Unsubscribe(sub)
+
+	// Changes should be assigned increasing sequence numbers
+	for i, content := range []string{"change1", "change2", "change3"} {
+		if res, err = ctx.request("POST", ctx.host+"/changes/", content, ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusCreated, fmt.Sprintf(`^{"seq":%d}$`, i+1))
+	}
+
+	if c := readChanges("1"); c.Seq != 3 || c.Snapshot != nil || len(c.Changes) != 2 ||
+		c.Changes[0].Seq != 2 || string(c.Changes[0].Content) != "change2" {
+		t.Fatalf("Unexpected changes: %+v", c)
+	}
+
+	// Compacting beyond the most recent change should fail
+	if res, err = ctx.request("PUT", ctx.host+"/changes/?seq=4", "snapshot", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &BadRequest{"invalid sequence number"})
+
+	if res, err = ctx.request("PUT", ctx.host+"/changes/?seq=2", "snapshot", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	// Subscribers should be notified about appended changes and compactions
+	for i, expected := range []*StoreEvent{
+		{Type: StoreEventChange, Seq: 1},
+		{Type: StoreEventChange, Seq: 2},
+		{Type: StoreEventChange, Seq: 3},
+		{Type: StoreEventCompact, Seq: 2},
+	} {
+		if len(sub.Events) == 0 {
+			t.Fatalf("Expected %d events, got %d", 4, i)
+		}
+		if e := <-sub.Events; e.Type != expected.Type || e.Seq != expected.Seq || e.Vault != DefaultVault {
+			t.Fatalf("Expected %s event for %d, got %+v", expected.Type, expected.Seq, e)
+		}
+	}
+
+	// Clients that missed compacted changes should receive the snapshot
+	if c := readChanges("1"); c.Snapshot == nil || c.Snapshot.Seq != 2 || string(c.Snapshot.Content) != "snapshot" ||
+		len(c.Changes) != 1 || c.Changes[0].Seq != 3 {
+		t.Fatalf("Expected snapshot and remaining change, got %+v", c)
+	}
+
+	// Clients that are up to date shouldn't
+	if c := readChanges("3"); c.Snapshot != nil || len(c.Changes) != 0 {
+		t.Fatalf("Expected no changes, got %+v", c)
+	}
+
+	// Compacting into an earlier snapshot is not allowed
+	if res, err = ctx.request("PUT", ctx.host+"/changes/?seq=1", "snapshot", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &BadRequest{"invalid sequence number"})
+
+	// Named vaults have to exist
+	if res, err = ctx.request("POST", ctx.host+"/changes/work/", "change", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &VaultNotFound{})
+
+	// Changes and the snapshot should be stored as separate records
+	countRecords := func() int {
+		iter, err := ctx.storage.Iterator(&ChangeRecord{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Release()
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		return n
+	}
+	if n := countRecords(); n != 2 {
+		t.Fatalf("Expected snapshot and one change to be stored, got %d records", n)
+	}
+
+	// Resetting the data of the account should remove the snapshot and all changes, but keep the
+	// sequence number
+	if err := DeleteVault(ctx.storage, &Account{Email: testEmail}, DefaultVault); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRecords(); n != 0 {
+		t.Fatalf("Expected change records to be deleted, got %d", n)
+	}
+	if c := readChanges("3"); c.Seq != 3 || c.Snapshot != nil || len(c.Changes) != 0 {
+		t.Fatalf("Expected empty change log, got %+v", c)
+	}
+
+	if res, err = ctx.request("POST", ctx.host+"/changes/", "change4", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusCreated, `^{"seq":4}$`)
+
+	usage, err := GetStoreUsage(ctx.storage, &Account{Email: testEmail}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Changes != int64(len("change4")) {
+		t.Fatalf("Expected only the new change to count towards the quota, got %d", usage.Changes)
+	}
+}
+
+func TestLegacyChangeLog(t *testing.T) {
+	storage := &MemoryStorage{}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	acc := &Account{Email: testEmail}
+
+	// Change logs used to hold the snapshot and all changes in a single record
+	data, err := json.Marshal(map[string]interface{}{
+		"SnapshotSeq": 1,
+		"Snapshot":    []byte("snapshot"),
+		"Changes":     []*ChangeRecord{{Seq: 2, Content: []byte("change2")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&rawStorable{reflect.TypeOf(ChangeLog{}), []byte(acc.Email), data}); err != nil {
+		t.Fatal(err)
+	}
+
+	change, err := AppendChange(storage, &ChangeLog{Account: acc}, []byte("change3"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Seq != 3 {
+		t.Fatalf("Expected sequence number 3, got %d", change.Seq)
+	}
+
+	log := &ChangeLog{Account: acc}
+	if err := LoadChangeLog(storage, log, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(log.Snapshot) != "snapshot" || len(log.Changes) != 2 || log.Changes[1].Seq != 3 ||
+		log.Size != int64(len("snapshotchange2change3")) {
+		t.Fatalf("Expected existing changes to be kept, got %+v", log)
+	}
+}
+
+// Storage that runs `interrupt` the first time records are listed, e.g. for simulating concurrent writes
+type interruptedStorage struct {
+	Storage
+	interrupt func()
+}
+
+func (s *interruptedStorage) Iterator(t Storable) (StorageIterator, error) {
+	if fn := s.interrupt; fn != nil {
+		s.interrupt = nil
+		fn()
+	}
+	return s.Storage.Iterator(t)
+}
+
+func TestLoadChangeLogDuringCompaction(t *testing.T) {
+	backend := &MemoryStorage{}
+	if err := backend.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	acc := &Account{Email: testEmail}
+
+	for _, content := range []string{"change1", "change2", "change3"} {
+		if _, err := AppendChange(backend, &ChangeLog{Account: acc}, []byte(content), nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Compact the log after it has been read but before its records are listed
+	storage := &interruptedStorage{Storage: backend, interrupt: func() {
+		if err := CompactChangeLog(backend, &ChangeLog{Account: acc}, 2, []byte("snapshot"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}}
+
+	log := &ChangeLog{Account: acc}
+	if err := LoadChangeLog(storage, log, 0); err != nil {
+		t.Fatal(err)
+	}
+	if log.SnapshotSeq != 2 || string(log.Snapshot) != "snapshot" || len(log.Changes) != 1 || log.Changes[0].Seq != 3 {
+		t.Fatalf("Expected compacted log, got %+v", log)
+	}
+}
+
+func TestAccountExport(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContextWithConfig(&ServerConfig{History: HistoryConfig{Size: 5}})
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err = ctx.request("PUT", ctx.host+"/store/", testData, ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if res, err = ctx.request("POST", ctx.host+"/vaults/", url.Values{
+		"name": {"work"},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusCreated, "")
+
+	if res, err = ctx.request("PUT", ctx.host+"/store/work/", "work data", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if res, err = ctx.request("POST", ctx.host+"/changes/work/", "change1", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusCreated, "")
+
+	if res, err = ctx.request("GET", ctx.host+"/export/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := validateResponse(res, http.StatusOK, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := ReadAccountExport(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := export.Manifest; m.Email != testEmail || len(m.Vaults) != 2 || m.Vaults[1].Name != "work" {
+		t.Fatalf("Unexpected manifest: %+v", m)
+	}
+
+	if string(export.Content[DefaultVault]) != testData || string(export.Content["work"]) != "work data" {
+		t.Fatalf("Unexpected vault content: %v", export.Content)
+	}
+
+	if log := export.Changes["work"]; log == nil || len(log.Changes) != 1 {
+		t.Fatalf("Expected change log to be exported, got %+v", log)
+	}
+
+	found := false
+	for _, token := range export.Tokens {
+		found = found || token.Id == ctx.authToken.Id
+	}
+	if !found {
+		t.Fatalf("Expected auth token metadata to be exported, got %+v", export.Tokens)
+	}
+
+	// Auth token secrets must never end up in the archive
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := ioutil.ReadAll(gz); bytes.Contains(raw, []byte(ctx.authToken.Token)) {
+		t.Fatal("Export archive should not contain auth token secrets")
+	}
+
+	writes := 0
+	for i, e := range export.Events {
+		if i > 0 && e.Time.Before(export.Events[i-1].Time) {
+			t.Fatal("Events should be sorted by time")
+		}
+		if e.Type == "data_store:write" {
+			writes++
+		}
+	}
+	if writes != 2 {
+		t.Fatalf("Expected 2 data_store:write events, got %d", writes)
+	}
+
+	// Importing should fail while the vaults exist
+	if res, err = ctx.request("POST", ctx.host+"/import/", string(archive), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &VaultExists{})
+
+	if res, err = ctx.request("POST", ctx.host+"/import/", "not an archive", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &BadRequest{"invalid export archive"})
+
+	// Import into a different account, which gets created along the way
+	other := &Account{Email: "other@padlock.io"}
+	if err := ImportAccountExport(ctx.storage, other, export, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.storage.Get(other); err != nil {
+		t.Fatal(err)
+	}
+	data := &DataStore{Account: other, Vault: "work"}
+	if err := ctx.storage.Get(data); err != nil || string(data.Content) != "work data" {
+		t.Fatalf("Expected imported vault content, got %q (%v)", data.Content, err)
+	}
+
+	// A default vault with an empty data store still exists if it is synchronized in delta mode
+	delta := &Account{Email: "delta@padlock.io"}
+	if _, err := AppendChange(ctx.storage, &ChangeLog{Account: delta}, []byte("change"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	export, _ = ReadAccountExport(bytes.NewReader(archive))
+	if err := ImportAccountExport(ctx.storage, delta, export, 0); err == nil {
+		t.Fatal("Expected import into a vault with a change log to fail")
+	} else if _, ok := err.(*VaultExists); !ok {
+		t.Fatalf("Expected VaultExists error, got %v", err)
+	}
+
+	// Exceeding the quota should fail without importing anything
+	export, _ = ReadAccountExport(bytes.NewReader(archive))
+	if err := ImportAccountExport(ctx.storage, &Account{Email: "third@padlock.io"}, export, 5); err == nil {
+		t.Fatal("Expected import exceeding the quota to fail")
+	}
+	if err := ctx.storage.Get(&Account{Email: "third@padlock.io"}); err != ErrNotFound {
+		t.Fatalf("Failed import should not create an account, got %v", err)
+	}
+
+	// The imported history counts towards the quota as well
+	var contentSize int64
+	for _, content := range export.Content {
+		contentSize += int64(len(content))
+	}
+	export, _ = ReadAccountExport(bytes.NewReader(archive))
+	if err := ImportAccountExport(ctx.storage, &Account{Email: "third@padlock.io"}, export, contentSize); err == nil {
+		t.Fatal("Expected import exceeding the quota with its history to fail")
+	} else if _, ok := err.(*StoreQuotaExceeded); !ok {
+		t.Fatalf("Expected StoreQuotaExceeded error, got %v", err)
+	}
+
+	// Once the vaults are gone, the archive can be imported through the api
+	acc := &Account{Email: testEmail}
+	for _, name := range []string{"work", DefaultVault} {
+		if err := DeleteVault(ctx.storage, acc, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if res, err = ctx.request("POST", ctx.host+"/import/", string(archive), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if res, err = ctx.request("GET", ctx.host+"/store/work/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^work data$")
+}
+
+func TestDeleteAccount(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContext()
+	acc := &Account{Email: testEmail}
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.sender.Reset()
+	if res, err = ctx.request("POST", ctx.host+"/deleteaccount/", url.Values{
+		"actType": {"code"},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "^$")
+
+	// The account should only be deleted once the owner confirms the deletion
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100 && ctx.sender.Recipient == ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	codePattern := "[a-f0-9]{6}"
+	if match, _ := regexp.MatchString(fmt.Sprintf("^%s, %s/a/\\?t=, %s$", testEmail, ctx.host, codePattern), ctx.sender.Message); !match {
+		t.Fatalf("Unexpected confirmation message: %s", ctx.sender.Message)
+	}
+	code := regexp.MustCompile(codePattern + "$").FindString(ctx.sender.Message)
+
+	if res, err = ctx.request("POST", ctx.host+"/activate/", url.Values{
+		"email": {testEmail},
+		"code":  {"000000"},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &BadRequest{"invalid activation token"})
+
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err = ctx.request("POST", ctx.host+"/activate/", url.Values{
+		"email": {testEmail},
+		"code":  {code},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	if err := ctx.storage.Get(acc); err != ErrNotFound {
+		t.Fatalf("Expected account to be deleted, got %v", err)
+	}
+}
+
+func TestRemoveAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Vaults are listed within the transaction, which must not block bolt
+	storage := &BoltStorage{Config: &BoltConfig{Path: filepath.Join(dir, "padlock.db")}}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	acc := &Account{Email: testEmail}
+	owner := &Account{Email: "owner@padlock.io"}
+
+	for _, s := range []Storable{
+		acc,
+		owner,
+		&DataStore{Account: acc, Content: []byte("default")},
+		&DataStore{Account: acc, Vault: "work", Content: []byte("work")},
+		&StoreHistory{Account: acc, Vault: "work", Revisions: []*StoreRevision{{Id: "1", Content: []byte("work")}}},
+		&SharedVault{Owner: acc.Email, Vault: "work", Members: []*VaultMember{{Email: owner.Email}}},
+		&DataStore{Account: owner, Vault: "shared", Content: []byte("shared")},
+		&SharedVault{Owner: owner.Email, Vault: "shared", Members: []*VaultMember{{Email: acc.Email}}},
+	} {
+		if err := storage.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RemoveAccount(storage, acc.Email); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []Storable{
+		&Account{Email: acc.Email},
+		&DataStore{Account: acc},
+		&DataStore{Account: acc, Vault: "work"},
+		&StoreHistory{Account: acc, Vault: "work"},
+		&SharedVault{Owner: acc.Email, Vault: "work"},
+	} {
+		if err := storage.Get(s); err != ErrNotFound {
+			t.Fatalf("Expected %T to be removed along with the account, got %v", s, err)
+		}
+	}
+
+	// The account should also be removed from vaults shared with it
+	sv := &SharedVault{Owner: owner.Email, Vault: "shared"}
+	if err := storage.Get(sv); err != nil || sv.Member(acc.Email) != nil {
+		t.Fatalf("Expected account to be removed from shared vault, got %v (%v)", sv.Members, err)
+	}
+}
+
+func TestDeletionGracePeriod(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContextWithConfig(&ServerConfig{DeletionGracePeriod: time.Hour})
+	acc := &Account{Email: testEmail}
+
+	if _, err := ctx.loginWeb(testEmail, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.storage.Put(&DataStore{Account: acc, Content: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Waits for the email notifying the owner about a deletion and returns the undo link contained in it
+	undoLink := func(vault string) string {
+		for i := 0; i < 100 && ctx.sender.Recipient == ""; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		linkPattern := fmt.Sprintf(`%s/undelete/\?t=[a-zA-Z0-9\-_]+\.%s`, ctx.host, tokenPattern)
+		if match, _ := regexp.MatchString(fmt.Sprintf("^%s, %s, %s$", testEmail, vault, linkPattern), ctx.sender.Message); !match {
+			t.Fatalf("Unexpected deletion message: %s", ctx.sender.Message)
+		}
+		return regexp.MustCompile(linkPattern).FindString(ctx.sender.Message)
+	}
+
+	// Makes the pending deletion of the given vault due and purges it
+	purge := func(vault string) {
+		d := &PendingDeletion{Email: testEmail, Vault: vault}
+		if err := ctx.storage.Get(d); err != nil {
+			t.Fatal(err)
+		}
+		d.Purge = time.Now().Add(-time.Minute)
+		if err := ctx.storage.Put(d); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := ctx.server.PurgeDeletions(); err != nil || n != 1 {
+			t.Fatalf("Expected a single deletion to be purged, got %d, %v", n, err)
+		}
+	}
+
+	// Resetting data from the dashboard should only schedule the deletion
+	ctx.sender.Reset()
+	if res, err = ctx.request("POST", ctx.host+"/deletestore/", url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+	undoLink(DefaultVault)
+
+	// Nothing should be deleted before the grace period has passed
+	if n, err := ctx.server.PurgeDeletions(); err != nil || n != 0 {
+		t.Fatalf("Expected no deletions to be purged, got %d, %v", n, err)
+	}
+	if err := ctx.storage.Get(&DataStore{Account: acc}); err != nil {
+		t.Fatal(err)
+	}
+
+	purge(DefaultVault)
+
+	if err := ctx.storage.Get(&DataStore{Account: acc}); err != ErrNotFound {
+		t.Fatalf("Expected data store to be deleted, got %v", err)
+	}
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.sender.Reset()
+	if res, err = ctx.request("POST", ctx.host+"/deleteaccount/", url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+
+	// Confirming the deletion should only schedule it
+	for i := 0; i < 100 && ctx.sender.Recipient == ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	confirmLink := regexp.MustCompile(fmt.Sprintf("%s/a/\\?t=%s", ctx.host, tokenPattern)).FindString(ctx.sender.Message)
+	ctx.sender.Reset()
+
+	// Opening the link should only show a confirmation page
+	if res, err = ctx.request("GET", confirmLink, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, fmt.Sprintf("^delete-account,%s,%s$", testEmail, tokenPattern))
+	if deletions, err := GetPendingDeletions(ctx.storage, testEmail); err != nil || len(deletions) != 0 {
+		t.Fatalf("Expected no pending deletions, got %v, %v", deletions, err)
+	}
+
+	// Submitting the confirmation requires a csrf token
+	if res, err = ctx.request("POST", confirmLink, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &InvalidCsrfToken{})
+
+	if res, err = ctx.request("POST", confirmLink, url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusAccepted, "")
+	link := undoLink("")
+
+	// The confirmation link is used up along with the deletion
+	if res, err = ctx.request("POST", confirmLink, url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &BadRequest{"invalid activation token"})
+
+	if deletions, err := GetPendingDeletions(ctx.storage, testEmail); err != nil || len(deletions) != 1 {
+		t.Fatalf("Expected a single pending deletion, got %v, %v", deletions, err)
+	}
+
+	// Undoing a deletion requires the correct token
+	if res, err = ctx.request("GET", link[:len(link)-1]+"x", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &BadRequest{"no such pending deletion"})
+
+	if res, err = ctx.request("GET", link, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if deletions, err := GetPendingDeletions(ctx.storage, testEmail); err != nil || len(deletions) != 0 {
+		t.Fatalf("Expected no pending deletions, got %v, %v", deletions, err)
+	}
+
+	// Purging an account deletion should remove the account along with all pending deletions
+	if _, err := ScheduleDeletion(ctx.storage, testEmail, DefaultVault, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ScheduleDeletion(ctx.storage, testEmail, "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	purge("")
+
+	if err := ctx.storage.Get(acc); err != ErrNotFound {
+		t.Fatalf("Expected account to be deleted, got %v", err)
+	}
+	if deletions, err := ListPendingDeletions(ctx.storage); err != nil || len(deletions) != 0 {
+		t.Fatalf("Expected no pending deletions, got %v, %v", deletions, err)
+	}
+}
+
+func TestTwoFactorAuthentication(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContext()
+
+	if _, err := ctx.loginWeb(testEmail, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests a new web login and returns the activation link sent via email
+	requestLogin := func(tType string) string {
+		ctx.sender.Reset()
+		if res, err = ctx.request("POST", ctx.host+"/auth/", url.Values{
+			"email": {testEmail},
+			"type":  {tType},
+		}.Encode(), ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusAccepted, "")
+		for i := 0; i < 100 && ctx.sender.Recipient == ""; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		link, err := ctx.extractActivationLink()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+
+	activate := func(link string, code string) *http.Response {
+		if res, err = ctx.request("POST", link, url.Values{
+			"totp": {code},
+		}.Encode(), 0); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res, err = ctx.request("POST", ctx.host+"/totp/", url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	body, err := validateResponse(res, http.StatusOK, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enrollment := &struct {
+		Secret string
+		Uri    string
+	}{}
+	if err := json.Unmarshal(body, enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.Uri, "otpauth://totp/") || !strings.Contains(enrollment.Uri, enrollment.Secret) {
+		t.Fatalf("Unexpected provisioning uri: %s", enrollment.Uri)
+	}
+
+	totp := &TOTP{Secret: enrollment.Secret}
+	code := func(offset int) string {
+		c, _ := totp.Code(time.Now().Add(time.Duration(offset) * totpPeriod))
+		return c
+	}
+
+	// Logging in should not require a code until the enrollment is confirmed
+	activate(requestLogin("web"), "")
+	testResponse(t, res, http.StatusOK, "")
+
+	if res, err = ctx.request("POST", ctx.host+"/totp/enable/", url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+		"code":               {"invalid"},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &InvalidTOTPCode{})
+
+	if res, err = ctx.request("POST", ctx.host+"/totp/enable/", url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+		"code":               {code(0)},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if body, err = validateResponse(res, http.StatusOK, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	recovery := &struct{ RecoveryCodes []string }{}
+	if err := json.Unmarshal(body, recovery); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(recovery.RecoveryCodes))
+	}
+
+	// Web logins should now require a valid code
+	link := requestLogin("web")
+	testError(t, activate(link, ""), &TOTPRequired{})
+	testError(t, activate(link, "invalid"), &InvalidTOTPCode{})
+
+	// Html clients should be asked for the code instead
+	if res, err = ctx.requestWithHeaders("GET", link, "", 0, map[string]string{"Accept": "text/html"}); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, fmt.Sprintf("^totp,%s,false$", testEmail))
+
+	testResponse(t, activate(link, code(1)), http.StatusOK, "")
+
+	// Codes can't be used twice
+	testError(t, activate(requestLogin("web"), code(1)), &InvalidTOTPCode{})
+
+	// Recovery codes work in place of a code, but only once
+	testResponse(t, activate(requestLogin("web"), recovery.RecoveryCodes[0]), http.StatusOK, "")
+	testError(t, activate(requestLogin("web"), recovery.RecoveryCodes[0]), &InvalidTOTPCode{})
+
+	// Invalid codes are counted per account across login requests. After too many, no codes are
+	// accepted for a while
+	acc := &Account{Email: testEmail}
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+	for i := acc.TOTP.FailedAttempts; i < maxTOTPAttempts; i++ {
+		testError(t, activate(requestLogin("web"), "invalid"), &InvalidTOTPCode{})
+	}
+	link = requestLogin("web")
+	testResponse(t, activate(link, recovery.RecoveryCodes[1]), http.StatusTooManyRequests, "totp_locked")
+
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+	if acc.TOTP.FailedAttempts != maxTOTPAttempts || !acc.TOTP.LockedUntil.After(time.Now()) {
+		t.Fatalf("Expected account to be locked after %d failed attempts, got %+v", maxTOTPAttempts, acc.TOTP)
+	}
+
+	// Once the lockout is over, a valid code resets the counter
+	acc.TOTP.LockedUntil = time.Now().Add(-time.Second)
+	if err := ctx.storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, activate(link, recovery.RecoveryCodes[1]), http.StatusOK, "")
+
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+	if acc.TOTP.FailedAttempts != 0 || !acc.TOTP.LockedUntil.IsZero() {
+		t.Fatalf("Expected failed attempts to be reset, got %+v", acc.TOTP)
+	}
+
+	// Pairing a device doesn't require a code by default, but doesn't log into the dashboard either
+	webTokens := len(acc.AuthTokensByType("web"))
+
+	if res, err = ctx.request("GET", requestLogin("api"), "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+	if len(acc.AuthTokensByType("web")) != webTokens {
+		t.Fatal("Pairing a device should not create a web session bypassing the second factor")
+	}
+
+	// Turning two-factor authentication off requires a valid code
+	if res, err = ctx.request("POST", ctx.host+"/totp/disable/", url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+		"code":               {"invalid"},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &InvalidTOTPCode{})
+
+	if res, err = ctx.request("POST", ctx.host+"/totp/disable/", url.Values{
+		"gorilla.csrf.Token": {ctx.getCsrfToken()},
+		"code":               {recovery.RecoveryCodes[3]},
+	}.Encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if err := ctx.storage.Get(acc); err != nil || acc.TOTP != nil {
+		t.Fatalf("Expected two-factor authentication to be turned off, got %+v (%v)", acc.TOTP, err)
+	}
+
+	testResponse(t, activate(requestLogin("web"), ""), http.StatusOK, "")
+}
+
+func TestDashboard(t *testing.T) {
+	ctx := newServerTestContext()
+	ctx.followRedirects(true)
+
+	// If not logged in, should redirect to login page
+	res, _ := ctx.request("GET", ctx.host+"/dashboard/", "", 0)
+	testResponse(t, res, http.StatusOK, "^login,,$")
+
+	if _, err := ctx.loginWeb(testEmail, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// We should be logged in now, so dashboard should render
+	res, _ = ctx.request("GET", ctx.host+"/dashboard/", "", 0)
+	testResponse(t, res, http.StatusOK, "^dashboard$")
+}
+
+func TestLogout(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContext()
+
+	if _, err = ctx.loginWeb(testEmail, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Log out
+	if res, err = ctx.request("GET", ctx.host+"/logout/", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "")
+
+	// If not logged in, should redirect to login page
+	if res, err = ctx.request("GET", ctx.host+"/dashboard/", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusOK, "^login,,$")
+}
+
+func TestRevokeAuthToken(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContext()
+	ctx.followRedirects(true)
+
+	t.Run("unautenticated", func(t *testing.T) {
+		// If not logged in, should redirect to login page
+		if res, err = ctx.request("POST", ctx.host+"/revoke/", "", ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusOK, "login,,")
+	})
+
+	// Login in
+	if res, err = ctx.loginWeb(testEmail, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("revoke by token", func(t *testing.T) {
+		// Create and activate new auth token
+		if res, err = ctx.loginApi(testEmail); err != nil {
+			t.Fatal(err)
+		}
+		at := ctx.authToken
+		ctx.authToken = nil
+
+		// Revoke auth token by token
+		if res, err = ctx.request("POST", ctx.host+"/revoke/", url.Values{
+			"gorilla.csrf.Token": {ctx.getCsrfToken()},
+			"token":              {at.Token},
+		}.Encode(), 0); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusOK, "")
+
+		ctx.authToken = at
+		if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &ExpiredAuthToken{})
+	})
+
+	t.Run("revoke by id", func(t *testing.T) {
+		// Create and activate new auth token
+		if res, err = ctx.loginApi(testEmail); err != nil {
+			t.Fatal(err)
+		}
+		at := ctx.authToken
+		ctx.authToken = nil
+
+		// Get id
+		acc := &Account{Email: at.Email}
+		ctx.storage.Get(acc)
+		at.Validate(acc)
+
+		// Revoke auth token by id
+		if res, err = ctx.request("POST", ctx.host+"/revoke/", url.Values{
+			"gorilla.csrf.Token": {ctx.getCsrfToken()},
+			"id":                 {at.Id},
+		}.Encode(), 0); err != nil {
+			t.Fatal(err)
+		}
+		testResponse(t, res, http.StatusOK, "")
+
+		ctx.authToken = at
+		if res, err = ctx.request("GET", ctx.host+"/store/", "", ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		testError(t, res, &ExpiredAuthToken{})
+	})
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	ctx := newServerTestContext()
+	// Requests with unsupported HTTP methods should return with 405 - method not allowed
+	if res, err := ctx.request("GET", ctx.host+"/auth/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	} else {
+		testError(t, res, &MethodNotAllowed{})
+	}
+}
+
+func TestUnsupportedEndpoint(t *testing.T) {
+	ctx := newServerTestContext()
+	// Requests to unsupported paths should return with 404 - not found
+	if res, err := ctx.request("GET", ctx.host+"/invalidpath", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	} else {
+		testError(t, res, &UnsupportedEndpoint{})
+	}
+}
+
+func TestOutdatedVersion(t *testing.T) {
+	ctx := newServerTestContext()
+
+	// The root path is a special case in that the only way to figure out if the client is using
+	// and older api version is if the Authorization header is using the 'ApiKey' authentication scheme
+	token, _ := token()
+	req, _ := http.NewRequest("GET", ctx.host+"/", nil)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s:%s", testEmail, token))
+	res, _ := ctx.client.Do(req)
+	testError(t, res, &UnsupportedApiVersion{})
+	if ctx.sender.Recipient != testEmail {
+		t.Errorf("Expected outdated message to be sent to %s, instead got %s", testEmail, ctx.sender.Recipient)
+	}
+
+	ctx.resetAll()
+
+	// When doing an auth request, the email form field should be used for sending the notification since
+	// the user is not authenticated
+	res, _ = ctx.request("POST", ctx.host+"/auth/", url.Values{
+		"email": {testEmail},
+	}.Encode(), 0)
+	testError(t, res, &UnsupportedApiVersion{0, ApiVersion})
+	if ctx.sender.Recipient != testEmail {
+		t.Errorf("Expected outdated message to be sent to %s, instead got %s", testEmail, ctx.sender.Recipient)
+	}
+
+	ctx.resetAll()
+
+	ctx.loginApi(testEmail)
+
+	// When doing an auth request, the email form field should be used for sending the notification since
+	// the user is not authenticated
+	res, _ = ctx.request("GET", ctx.host+"/store/", url.Values{
+		"email": {testEmail},
+	}.Encode(), 0)
+	testError(t, res, &UnsupportedApiVersion{0, ApiVersion})
+	if ctx.sender.Recipient != testEmail {
+		t.Errorf("Expected outdated message to be sent to %s, instead got %s", testEmail, ctx.sender.Recipient)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	ctx := newServerTestContext()
+	res, _ := ctx.request("GET", ctx.host+"/panic/", "", 0)
+	testError(t, res, &ServerError{})
+	res, _ = ctx.request("POST", ctx.host+"/panic/", "", 0)
+	testError(t, res, &ServerError{})
+}
+
+func TestErrorFormat(t *testing.T) {
+	ctx := newServerTestContext()
+
+	e := &UnsupportedEndpoint{}
+	testErr := func(format string, expected []byte) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/invalidpath/?v=%d", ctx.host, ApiVersion), nil)
+		if format != "" {
+			req.Header.Add("Accept", format)
+		}
+		res, _ := ctx.client.Do(req)
 		defer res.Body.Close()
 		body, _ := ioutil.ReadAll(res.Body)
 		if !bytes.Equal(body, expected) {
@@ -1020,3 +2531,210 @@ func TestSecretInConfig(t *testing.T) {
 		t.Errorf("User-provided secret not set in server. Expected: %q, got: %q", secret, ctx.server.secret)
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	ctx := newServerTestContextWithConfig(&ServerConfig{
+		Metrics: MetricsConfig{Enabled: true},
+		Admin:   AdminConfig{Addr: "127.0.0.1:0", Token: "secret"},
+	})
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ctx.request("PUT", ctx.host+"/store/", "some data", ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	// Unsupported method
+	if res, err = ctx.request("DELETE", ctx.host+"/store/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusMethodNotAllowed, "")
+
+	if err := ctx.server.Metrics.UpdateAccountStats(ctx.server.Storage); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metrics should not be exposed on the public port
+	if res, err = ctx.request("GET", ctx.host+"/metrics", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode == http.StatusOK {
+		t.Fatal("Metrics should not be served by the main server")
+	}
+
+	admin := httptest.NewServer(ctx.server.AdminHandler())
+	defer admin.Close()
+
+	if res, err = ctx.client.Get(admin.URL + "/metrics"); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusUnauthorized, "")
+
+	req, _ := http.NewRequest("GET", admin.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if res, err = ctx.client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	body, err := validateResponse(res, http.StatusOK, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`padlock_http_requests_total{code="204",method="PUT",path="/store/"} 1`,
+		`padlock_http_requests_total{code="405",method="DELETE",path="/store/"} 1`,
+		`padlock_errors_total{code="method_not_allowed"} 1`,
+		`padlock_storage_operation_duration_seconds_count{operation="get",type="auth-accounts"}`,
+		`padlock_http_request_duration_seconds_bucket{method="POST",path="/auth/",le="+Inf"} 1`,
+		`padlock_accounts 1`,
+		`padlock_devices 1`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Expected metrics to contain '%s', got:\n%s", line, body)
+		}
+	}
+}
+
+func TestStoreQuota(t *testing.T) {
+	ctx := newServerTestContextWithConfig(&ServerConfig{MaxStoreSize: 10})
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ctx.request("PUT", ctx.host+"/store/", "0123456789", ApiVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if res, err = ctx.request("PUT", ctx.host+"/store/", "0123456789a", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &StoreQuotaExceeded{})
+
+	// The quota should apply to the decompressed data
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(bytes.Repeat([]byte("a"), 1000))
+	gz.Close()
+
+	if res, err = ctx.requestWithHeaders("PUT", ctx.host+"/store/", buf.String(), ApiVersion, map[string]string{
+		"Content-Encoding": "gzip",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &StoreQuotaExceeded{})
+
+	// Per-account overrides take precedence over the server default
+	acc := &Account{Email: testEmail}
+	if err := ctx.storage.Get(acc); err != nil {
+		t.Fatal(err)
+	}
+	acc.MaxStoreSize = 20
+	if err := ctx.storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err = ctx.request("PUT", ctx.host+"/store/", "0123456789abcde", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusNoContent, "")
+
+	if res, err = ctx.request("GET", ctx.host+"/account/", "", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	body, err := validateResponse(res, http.StatusOK, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := struct {
+		Usage StoreUsage
+	}{}
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Usage != (StoreUsage{Store: 15, History: 0, Quota: 20}) {
+		t.Fatalf("Unexpected usage: %+v", info.Usage)
+	}
+}
+
+func TestTotalStoreQuota(t *testing.T) {
+	var res *http.Response
+	var err error
+
+	ctx := newServerTestContextWithConfig(&ServerConfig{
+		MaxStoreSize: 20,
+		MaxVaults:    2,
+		History:      HistoryConfig{Size: 3},
+	})
+
+	if _, err := ctx.loginApi(testEmail); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(path string, content string) *http.Response {
+		if res, err = ctx.request("PUT", ctx.host+path, content, ApiVersion); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	checkUsage := func(expected StoreUsage) {
+		usage, err := GetStoreUsage(ctx.storage, &Account{Email: testEmail}, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *usage != expected {
+			t.Fatalf("Expected usage %+v, got %+v", expected, usage)
+		}
+	}
+
+	// The revision reflecting the current content doesn't count towards the quota
+	testResponse(t, write("/store/", "0123456789"), http.StatusNoContent, "")
+	checkUsage(StoreUsage{Store: 10, History: 0, Quota: 20})
+
+	// Old revisions are dropped to make room for writes close to the limit...
+	testResponse(t, write("/store/", "012345678901234567"), http.StatusNoContent, "")
+	checkUsage(StoreUsage{Store: 18, History: 0, Quota: 20})
+
+	// ...and the history never keeps an account at the limit from writing less
+	testResponse(t, write("/store/", "0123"), http.StatusNoContent, "")
+	checkUsage(StoreUsage{Store: 4, History: 0, Quota: 20})
+
+	// Revisions are kept as long as they fit
+	testResponse(t, write("/store/", "012345"), http.StatusNoContent, "")
+	checkUsage(StoreUsage{Store: 6, History: 4, Quota: 20})
+
+	if res, err = ctx.request("POST", ctx.host+"/vaults/", url.Values{
+		"name": {"work"},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testResponse(t, res, http.StatusCreated, "")
+
+	// The default vault counts towards the maximum number of vaults
+	if res, err = ctx.request("POST", ctx.host+"/vaults/", url.Values{
+		"name": {"personal"},
+	}.Encode(), ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &TooManyVaults{})
+
+	// Writes to any vault should fail once the combined usage of all vaults exceeds the quota, even
+	// without history
+	testError(t, write("/store/work/", "0123456789abcde"), &StoreQuotaExceeded{})
+
+	if res, err = ctx.request("POST", ctx.host+"/changes/work/", "0123456789abcde", ApiVersion); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, res, &StoreQuotaExceeded{})
+
+	// Rejected writes should leave no trace
+	checkUsage(StoreUsage{Store: 6, History: 4, Quota: 20})
+}
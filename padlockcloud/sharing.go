@@ -0,0 +1,264 @@
+package padlockcloud
+
+import "time"
+
+// Roles determining the access an account has to a vault
+const (
+	// Full access, including sharing and deleting the vault
+	VaultRoleOwner = "owner"
+	// Members with this role can read the vault and its history
+	VaultRoleRead = "read"
+	// Members with this role can additionally update the vault and restore previous revisions
+	VaultRoleWrite = "write"
+)
+
+// Member of a shared vault
+type VaultMember struct {
+	Email string
+	// Either `VaultRoleRead` or `VaultRoleWrite`
+	Role string
+	// Whether the member has accepted the invite. Members only gain access once they accepted
+	Accepted bool
+	// Time the member was last invited
+	Invited time.Time
+}
+
+// Returns true if the member is allowed to access a vault in the given role
+func (m *VaultMember) CanAccess(role string) bool {
+	return m.Accepted && (role == VaultRoleRead || role == m.Role)
+}
+
+func (m *VaultMember) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"email":    m.Email,
+		"role":     m.Role,
+		"accepted": m.Accepted,
+		"invited":  m.Invited,
+	}
+}
+
+// SharedVault holds the members a named vault is shared with. The content of the vault itself remains
+// in the data store of the owning account
+type SharedVault struct {
+	// Email of the account owning the vault
+	Owner string
+	// Name of the shared vault
+	Vault   string
+	Members []*VaultMember
+}
+
+// Implementation of the `Storable.Key` interface method
+func (sv *SharedVault) Key() []byte {
+	return vaultKey(sv.Owner, sv.Vault)
+}
+
+// Implementation of the `Storable.Deserialize` interface method
+func (sv *SharedVault) Deserialize(data []byte) error {
+	return unmarshalVersioned(sv, data, sv)
+}
+
+// Implementation of the `Storable.Serialize` interface method
+func (sv *SharedVault) Serialize() ([]byte, error) {
+	return marshalVersioned(sv, sv)
+}
+
+// Returns the member with the given email or nil if no such member exists
+func (sv *SharedVault) Member(email string) *VaultMember {
+	for _, m := range sv.Members {
+		if m.Email == email {
+			return m
+		}
+	}
+	return nil
+}
+
+// Removes the member with the given email. Returns false if no such member exists
+func (sv *SharedVault) RemoveMember(email string) bool {
+	for i, m := range sv.Members {
+		if m.Email == email {
+			sv.Members = append(sv.Members[:i], sv.Members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (sv *SharedVault) ToMap() []map[string]interface{} {
+	members := make([]map[string]interface{}, 0, len(sv.Members))
+	for _, m := range sv.Members {
+		members = append(members, m.ToMap())
+	}
+	return members
+}
+
+// Adds a member to a named vault of `owner` or updates the role of an existing member. New members have to
+// accept the invite before they gain access to the vault
+func InviteVaultMember(storage Storage, owner *Account, vault string, email string, role string) (*SharedVault, error) {
+	sv := &SharedVault{Owner: owner.Email, Vault: vault}
+
+	if err := storage.Update(func(tx StorageTx) error {
+		if err := tx.Get(&DataStore{Account: owner, Vault: vault}); err == ErrNotFound {
+			return &VaultNotFound{vault}
+		} else if err != nil {
+			return err
+		}
+
+		if err := tx.Get(sv); err != nil && err != ErrNotFound {
+			return err
+		}
+
+		member := sv.Member(email)
+		if member == nil {
+			member = &VaultMember{Email: email}
+			sv.Members = append(sv.Members, member)
+		}
+
+		member.Role = role
+		if !member.Accepted {
+			member.Invited = time.Now()
+		}
+
+		return tx.Put(sv)
+	}); err != nil {
+		return nil, err
+	}
+
+	return sv, nil
+}
+
+// Marks the invite of `email` to the shared vault with the given key as accepted. Invites that have been
+// revoked in the meantime are ignored
+func acceptVaultInvite(tx StorageTx, key string, email string) error {
+	owner, vault := splitVaultKey([]byte(key))
+	sv := &SharedVault{Owner: owner, Vault: vault}
+
+	if err := tx.Get(sv); err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	member := sv.Member(email)
+	if member == nil {
+		return nil
+	}
+
+	member.Accepted = true
+
+	return tx.Put(sv)
+}
+
+// Removes a member from a shared vault. Returns `ErrNotFound` if the vault is not shared with `email`
+func RemoveVaultMember(storage Storage, owner string, vault string, email string) error {
+	return storage.Update(func(tx StorageTx) error {
+		return removeVaultMember(tx, owner, vault, email)
+	})
+}
+
+func removeVaultMember(tx StorageTx, owner string, vault string, email string) error {
+	sv := &SharedVault{Owner: owner, Vault: vault}
+	if err := tx.Get(sv); err != nil {
+		return err
+	}
+
+	if !sv.RemoveMember(email) {
+		return ErrNotFound
+	}
+
+	return tx.Put(sv)
+}
+
+// Returns all shared vaults `email` is a member of, including those with pending invites
+func memberships(storage Storage, email string) ([]*SharedVault, error) {
+	iter, err := storage.Iterator(&SharedVault{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	var shared []*SharedVault
+	for iter.Next() {
+		sv := &SharedVault{}
+		if err := iter.Get(sv); err != nil {
+			return nil, err
+		}
+		if sv.Member(email) != nil {
+			shared = append(shared, sv)
+		}
+	}
+
+	return shared, nil
+}
+
+// Lists the vaults shared with an account by other accounts. Only vaults with accepted invites are included
+func GetSharedVaults(storage Storage, acc *Account) ([]*Vault, error) {
+	shared, err := memberships(storage, acc.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	vaults := make([]*Vault, 0, len(shared))
+	for _, sv := range shared {
+		member := sv.Member(acc.Email)
+		if !member.Accepted {
+			continue
+		}
+
+		data := &DataStore{Account: &Account{Email: sv.Owner}, Vault: sv.Vault}
+		if err := storage.Get(data); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		vault := newVault(data)
+		vault.Role = member.Role
+		vaults = append(vaults, vault)
+	}
+
+	return vaults, nil
+}
+
+// Determines the vault addressed by a request path (see `vaultFromPath`) and makes sure the authenticated
+// account has access to it in the given role. Returns the account owning the vault along with its name.
+// Vaults shared with the account are reported as not found unless the account is an accepted member
+func authorizeVault(storage Storage, path string, prefix string, auth *AuthToken, role string) (*Account, string, error) {
+	owner, vault, err := vaultFromPath(path, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if owner == "" || owner == auth.Email {
+		return auth.Account(), vault, nil
+	}
+
+	sv := &SharedVault{Owner: owner, Vault: vault}
+	if err := storage.Get(sv); err == ErrNotFound {
+		return nil, "", &VaultNotFound{vault}
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	member := sv.Member(auth.Email)
+	if member == nil || !member.Accepted {
+		return nil, "", &VaultNotFound{vault}
+	}
+
+	if !member.CanAccess(role) {
+		return nil, "", &VaultAccessDenied{vault}
+	}
+
+	acc := &Account{Email: owner}
+	if err := storage.Get(acc); err == ErrNotFound {
+		return nil, "", &VaultNotFound{vault}
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	return acc, vault, nil
+}
+
+func init() {
+	RegisterStorable(&SharedVault{}, "shared-vaults")
+	RegisterSchema(&SharedVault{})
+}
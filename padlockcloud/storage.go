@@ -2,10 +2,15 @@ package padlockcloud
 
 import "reflect"
 import "errors"
+import "os"
+import "bytes"
+import "sort"
+import "sync"
 import "encoding/json"
 import "path/filepath"
 import "github.com/syndtr/goleveldb/leveldb"
 import "github.com/syndtr/goleveldb/leveldb/iterator"
+import "github.com/syndtr/goleveldb/leveldb/opt"
 
 // Error singletons
 var (
@@ -15,9 +20,17 @@ var (
 	ErrNotFound = errors.New("padlock: not found")
 	// A query was attempted on a closed storage
 	ErrStorageClosed = errors.New("padlock: storage closed")
+	// A snapshot was requested from a storage that can't take one
+	ErrSnapshotUnsupported = errors.New("padlock: snapshots not supported")
 )
 
 func typeFromStorable(t Storable) reflect.Type {
+	// Wrapped storables report the type of the underlying object
+	if typed, ok := t.(interface {
+		storableType() reflect.Type
+	}); ok {
+		return typed.storableType()
+	}
 	return reflect.TypeOf(t).Elem()
 }
 
@@ -33,10 +46,30 @@ type Storable interface {
 	Deserialize([]byte) error
 }
 
+// Iterators return records in ascending key order, regardless of the storage implementation
 type StorageIterator interface {
 	Next() bool
+	// Positions the iterator such that the following call to `Next` moves it to the first record with a
+	// key greater than or equal to `key`
+	Seek(key []byte)
+	// Returns the key of the current record
+	Key() []byte
 	Get(Storable) error
 	Release()
+	// Returns the error that caused `Next` to return false before reaching the last record, if any.
+	// Should be checked after iterating, since a failing storage is otherwise indistinguishable from
+	// one without any further records
+	Error() error
+}
+
+// Common interface for accessing objects within a transaction
+type StorageTx interface {
+	// Populates a given `Storable` object with data retrieved from the store
+	Get(Storable) error
+	// Updates the store with the data from a given `Storable` object
+	Put(Storable) error
+	// Removes a given `Storable` object from the store
+	Delete(Storable) error
 }
 
 // Common interface for storage implementations
@@ -57,6 +90,23 @@ type Storage interface {
 	Delete(Storable) error
 	// Lists all keys for a given `Storable` type
 	Iterator(Storable) (StorageIterator, error)
+	// Runs the given function within a transaction. Changes made through the provided `StorageTx` are
+	// applied atomically if the function returns nil and discarded otherwise. Transactions are only
+	// isolated from each other, not from plain calls to `Put` or `Delete`, so any read-modify-write of a
+	// record that may be changed concurrently has to happen within `Update`
+	Update(func(StorageTx) error) error
+}
+
+type StorageConfig struct {
+	// Storage backend to use. Supported values are "leveldb" (default), "bolt", "memory" and "s3"
+	Backend string `yaml:"backend"`
+	// Backends to use for individual record types, mapping type identifiers to backend names, e.g.
+	// `data-stores: s3`. Types without a route are stored in `Backend`
+	Routes map[string]string `yaml:"routes"`
+	// Settings for encrypting records at rest
+	Encryption EncryptionConfig `yaml:"encryption"`
+	// Settings for compressing records
+	Compression CompressionConfig `yaml:"compression"`
 }
 
 // Map of supported `Storable` implementations along with identifier strings that can be used for
@@ -69,6 +119,22 @@ func RegisterStorable(t Storable, loc string) {
 
 type LevelDBIterator struct {
 	iterator.Iterator
+	// Set after seeking, in which case `Next` should not advance the underlying iterator
+	seeked bool
+	valid  bool
+}
+
+func (iter *LevelDBIterator) Next() bool {
+	if iter.seeked {
+		iter.seeked = false
+		return iter.valid
+	}
+	return iter.Iterator.Next()
+}
+
+func (iter *LevelDBIterator) Seek(key []byte) {
+	iter.valid = iter.Iterator.Seek(key)
+	iter.seeked = true
 }
 
 func (iter *LevelDBIterator) Get(t Storable) error {
@@ -80,17 +146,24 @@ type LevelDBConfig struct {
 	Path string `yaml:"path"`
 }
 
+// Name of the LevelDB database used for journaling transactions spanning multiple `Storable` types
+const levelDBJournalLoc = "transaction-journal"
+
 // LevelDB implementation of the `Storage` interface
 type LevelDBStorage struct {
 	Config *LevelDBConfig
 	// Map of `leveldb.DB` instances associated with different `Storable` types
 	stores map[reflect.Type]*leveldb.DB
+	// Database holding batches of pending transactions
+	journal *leveldb.DB
+	// Used for serializing transactions. Plain writes don't take it, see `Storage.Update`
+	txMutex sync.Mutex
 }
 
 // Implementation of the `Storage.Open` interface method
 func (s *LevelDBStorage) Open() error {
 	// Instantiate stores map
-	s.stores = make(map[reflect.Type]*leveldb.DB)
+	stores := make(map[reflect.Type]*leveldb.DB)
 
 	// Create `leveldb.DB` instance for each supported `Storable` type
 	for t, loc := range StorableTypes {
@@ -98,10 +171,19 @@ func (s *LevelDBStorage) Open() error {
 		if err != nil {
 			return err
 		}
-		s.stores[t] = db
+		stores[t] = db
 	}
 
-	return nil
+	journal, err := leveldb.OpenFile(filepath.Join(s.Config.Path, levelDBJournalLoc), nil)
+	if err != nil {
+		return err
+	}
+
+	s.stores = stores
+	s.journal = journal
+
+	// Finish any transactions that have been interrupted before they were fully applied
+	return s.replayJournal()
 }
 
 // Implementation of the `Storage.Close` interface method
@@ -113,7 +195,14 @@ func (s *LevelDBStorage) Close() error {
 		}
 	}
 
+	if s.journal != nil {
+		if err := s.journal.Close(); err != nil {
+			return err
+		}
+	}
+
 	s.stores = nil
+	s.journal = nil
 
 	return nil
 }
@@ -211,12 +300,268 @@ func (s *LevelDBStorage) Iterator(t Storable) (StorageIterator, error) {
 	}
 
 	iter := db.NewIterator(nil, nil)
-	return &LevelDBIterator{iter}, nil
+	return &LevelDBIterator{Iterator: iter}, nil
+}
+
+// Implementation of the `SnapshotStorage.Snapshot` interface method. Snapshots are taken while no
+// transaction is being committed so they reflect a consistent state across all types
+func (s *LevelDBStorage) Snapshot() (StorageSnapshot, error) {
+	if s.stores == nil {
+		return nil, ErrStorageClosed
+	}
+
+	s.txMutex.Lock()
+	defer s.txMutex.Unlock()
+
+	snapshot := &levelDBSnapshot{make(map[reflect.Type]*leveldb.Snapshot)}
+	for t, db := range s.stores {
+		snap, err := db.GetSnapshot()
+		if err != nil {
+			snapshot.Release()
+			return nil, err
+		}
+		snapshot.snapshots[t] = snap
+	}
+
+	return snapshot, nil
+}
+
+type levelDBSnapshot struct {
+	snapshots map[reflect.Type]*leveldb.Snapshot
+}
+
+func (s *levelDBSnapshot) Iterator(t Storable) (StorageIterator, error) {
+	snap := s.snapshots[typeFromStorable(t)]
+	if snap == nil {
+		return nil, ErrUnregisteredStorable
+	}
+
+	return &LevelDBIterator{Iterator: snap.NewIterator(nil, nil)}, nil
+}
+
+func (s *levelDBSnapshot) Release() {
+	for _, snap := range s.snapshots {
+		snap.Release()
+	}
+}
+
+// Implementation of the `Storage.Update` interface method. Since each `Storable` type lives in a separate
+// LevelDB database, changes spanning multiple types are first written to a journal which is replayed
+// on the next call to `Open` should the transaction be interrupted before all changes were applied
+func (s *LevelDBStorage) Update(fn func(StorageTx) error) error {
+	if s.stores == nil {
+		return ErrStorageClosed
+	}
+
+	s.txMutex.Lock()
+	defer s.txMutex.Unlock()
+
+	tx := &levelDBTx{
+		storage: s,
+		batches: make(map[reflect.Type]*leveldb.Batch),
+		pending: make(map[reflect.Type]map[string]*txEntry),
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return s.commit(tx.batches)
+}
+
+// Atomically applies a set of batches to their respective databases
+func (s *LevelDBStorage) commit(batches map[reflect.Type]*leveldb.Batch) error {
+	wo := &opt.WriteOptions{Sync: true}
+
+	if len(batches) == 0 {
+		return nil
+	}
+
+	// Writes to a single database are atomic to begin with
+	if len(batches) == 1 {
+		for t, batch := range batches {
+			return s.stores[t].Write(batch, wo)
+		}
+	}
+
+	key, err := s.writeJournal(batches)
+	if err != nil {
+		return err
+	}
+
+	for t, batch := range batches {
+		if err := s.stores[t].Write(batch, wo); err != nil {
+			return err
+		}
+	}
+
+	return s.journal.Delete(key, wo)
+}
+
+// Writes a set of batches to the journal, returning the key of the journal entry
+func (s *LevelDBStorage) writeJournal(batches map[reflect.Type]*leveldb.Batch) ([]byte, error) {
+	entry := make(map[string][]byte)
+	for t, batch := range batches {
+		entry[StorableTypes[t]] = batch.Dump()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.journal.Put(key, data, &opt.WriteOptions{Sync: true}); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Applies all batches remaining in the journal. Since batches only contain puts and deletes,
+// applying a batch multiple times is harmless
+func (s *LevelDBStorage) replayJournal() error {
+	iter := s.journal.NewIterator(nil, nil)
+	defer iter.Release()
+
+	locs := make(map[string]reflect.Type)
+	for t, loc := range StorableTypes {
+		locs[loc] = t
+	}
+
+	for iter.Next() {
+		var entry map[string][]byte
+		if err := json.Unmarshal(iter.Value(), &entry); err != nil {
+			return err
+		}
+
+		batches := make(map[reflect.Type]*leveldb.Batch)
+		for loc, dump := range entry {
+			t, ok := locs[loc]
+			if !ok {
+				return ErrUnregisteredStorable
+			}
+			batch := &leveldb.Batch{}
+			if err := batch.Load(dump); err != nil {
+				return err
+			}
+			batches[t] = batch
+		}
+
+		for t, batch := range batches {
+			if err := s.stores[t].Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+				return err
+			}
+		}
+
+		if err := s.journal.Delete(iter.Key(), &opt.WriteOptions{Sync: true}); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Pending change within a transaction
+type txEntry struct {
+	data    []byte
+	deleted bool
+}
+
+// Implementation of the `StorageTx` interface for `LevelDBStorage`. Changes are collected in batches
+// and only written once the transaction is committed. Reads reflect pending changes
+type levelDBTx struct {
+	storage *LevelDBStorage
+	batches map[reflect.Type]*leveldb.Batch
+	pending map[reflect.Type]map[string]*txEntry
+}
+
+func (tx *levelDBTx) Get(t Storable) error {
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
+	if entry := tx.pending[typeFromStorable(t)][string(t.Key())]; entry != nil {
+		if entry.deleted {
+			return ErrNotFound
+		}
+		return t.Deserialize(entry.data)
+	}
+
+	return tx.storage.Get(t)
+}
+
+// Records a pending change for a given storable
+func (tx *levelDBTx) record(t Storable, data []byte, deleted bool) error {
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
+	if _, err := tx.storage.getDB(t); err != nil {
+		return err
+	}
+
+	typ := typeFromStorable(t)
+	key := t.Key()
+
+	if tx.batches[typ] == nil {
+		tx.batches[typ] = &leveldb.Batch{}
+		tx.pending[typ] = make(map[string]*txEntry)
+	}
+
+	if deleted {
+		tx.batches[typ].Delete(key)
+	} else {
+		tx.batches[typ].Put(key, data)
+	}
+
+	tx.pending[typ][string(key)] = &txEntry{data, deleted}
+
+	return nil
+}
+
+func (tx *levelDBTx) Put(t Storable) error {
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
+	data, err := t.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return tx.record(t, data, false)
+}
+
+func (tx *levelDBTx) Delete(t Storable) error {
+	return tx.record(t, nil, true)
+}
+
+// Creates an iterator over the records in a given map, sorted by key
+func newSliceIterator(m map[string][]byte) *SliceIterator {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	iter := &SliceIterator{i: -1}
+	for _, key := range keys {
+		iter.keys = append(iter.keys, []byte(key))
+		iter.s = append(iter.s, m[key])
+	}
+
+	return iter
 }
 
 type SliceIterator struct {
-	s [][]byte
-	i int
+	keys [][]byte
+	s    [][]byte
+	i    int
 }
 
 func (iter *SliceIterator) Next() bool {
@@ -228,114 +573,303 @@ func (iter *SliceIterator) Next() bool {
 	return false
 }
 
+func (iter *SliceIterator) Seek(key []byte) {
+	iter.i = sort.Search(len(iter.keys), func(i int) bool {
+		return bytes.Compare(iter.keys[i], key) >= 0
+	}) - 1
+}
+
+func (iter *SliceIterator) Key() []byte {
+	return iter.keys[iter.i]
+}
+
 func (iter *SliceIterator) Get(t Storable) error {
-	return t.Deserialize(iter.s[iter.i])
+	return t.Deserialize(append([]byte{}, iter.s[iter.i]...))
 }
 
 func (iter *SliceIterator) Release() {
+	iter.keys = nil
 	iter.s = nil
 }
 
-// In-memory implemenation of the `Storage` interface Mainly used for testing
+func (iter *SliceIterator) Error() error {
+	return nil
+}
+
+type MemoryConfig struct {
+	// Path to a snapshot file in the backup archive format. If provided, the storage is populated
+	// from this file when opened
+	Snapshot string `yaml:"snapshot"`
+	// Write the contents of the storage back to the snapshot file when closing it
+	Persist bool `yaml:"persist"`
+}
+
+// In-memory implemenation of the `Storage` interface Mainly used for testing. Records are serialized
+// like in any other storage and the storage is safe for concurrent use
 type MemoryStorage struct {
-	store map[reflect.Type](map[string][]byte)
+	Config *MemoryConfig
+	store  map[reflect.Type](map[string][]byte)
+	mutex  sync.RWMutex
+	// Used for serializing transactions. Plain writes don't take it, see `Storage.Update`
+	txMutex sync.Mutex
 }
 
 func (s *MemoryStorage) Open() error {
+	s.mutex.Lock()
 	s.store = make(map[reflect.Type](map[string][]byte))
+	for t := range StorableTypes {
+		s.store[t] = make(map[string][]byte)
+	}
+	s.mutex.Unlock()
+
+	if s.Config != nil && s.Config.Snapshot != "" {
+		if _, err := RestoreBackupFile(s.Config.Snapshot, s); err != nil && !(os.IsNotExist(err) && s.Config.Persist) {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (s *MemoryStorage) Close() error {
+	if s.Config != nil && s.Config.Snapshot != "" && s.Config.Persist && s.Ready() {
+		if _, err := WriteBackupFile(s.Config.Snapshot, s); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *MemoryStorage) Get(t Storable) error {
+// Returns the map holding records of the type of a given `Storable`. Callers need to hold the mutex
+func (s *MemoryStorage) getMap(t Storable) (map[string][]byte, error) {
 	if s.store == nil {
-		return ErrStorageClosed
+		return nil, ErrStorageClosed
 	}
 
 	if t == nil {
-		return ErrUnregisteredStorable
+		return nil, ErrUnregisteredStorable
 	}
 
-	tm := s.store[reflect.TypeOf(t)]
-	if tm == nil {
-		return ErrNotFound
+	m := s.store[typeFromStorable(t)]
+	if m == nil {
+		return nil, ErrUnregisteredStorable
+	}
+
+	return m, nil
+}
+
+func (s *MemoryStorage) Get(t Storable) error {
+	s.mutex.RLock()
+	m, err := s.getMap(t)
+	var data []byte
+	if err == nil {
+		data = m[string(t.Key())]
 	}
-	data := tm[string(t.Key())]
+	s.mutex.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
 	if data == nil {
 		return ErrNotFound
 	}
-	return json.Unmarshal(data, t)
+
+	return t.Deserialize(append([]byte{}, data...))
 }
 
 func (s *MemoryStorage) Put(t Storable) error {
-	if s.store == nil {
-		return ErrStorageClosed
-	}
-
 	if t == nil {
 		return ErrUnregisteredStorable
 	}
 
-	data, err := json.Marshal(t)
+	data, err := t.Serialize()
 	if err != nil {
 		return err
 	}
 
-	if s.store[reflect.TypeOf(t)] == nil {
-		s.store[reflect.TypeOf(t)] = make(map[string][]byte)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, err := s.getMap(t)
+	if err != nil {
+		return err
 	}
-	s.store[reflect.TypeOf(t)][string(t.Key())] = data
+
+	m[string(t.Key())] = append([]byte{}, data...)
 
 	return nil
 }
 
 func (s *MemoryStorage) Delete(t Storable) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, err := s.getMap(t)
+	if err != nil {
+		return err
+	}
+
+	delete(m, string(t.Key()))
+
+	return nil
+}
+
+func (s *MemoryStorage) Ready() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.store != nil
+}
+
+func (s *MemoryStorage) CanStore(t Storable) bool {
+	if t == nil {
+		return false
+	}
+	_, ok := StorableTypes[typeFromStorable(t)]
+	return ok
+}
+
+// Implementation of the `Storage.Update` interface method. Changes are collected and applied at once
+// when the transaction is committed
+func (s *MemoryStorage) Update(fn func(StorageTx) error) error {
+	if !s.Ready() {
+		return ErrStorageClosed
+	}
+
+	s.txMutex.Lock()
+	defer s.txMutex.Unlock()
+
+	tx := &memoryTx{
+		storage: s,
+		pending: make(map[reflect.Type]map[string]*txEntry),
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if s.store == nil {
 		return ErrStorageClosed
 	}
 
-	if t == nil {
+	for t, entries := range tx.pending {
+		for key, entry := range entries {
+			if entry.deleted {
+				delete(s.store[t], key)
+			} else {
+				s.store[t][key] = entry.data
+			}
+		}
+	}
+
+	return nil
+}
+
+// Implementation of the `StorageTx` interface for `MemoryStorage`. Reads reflect pending changes
+type memoryTx struct {
+	storage *MemoryStorage
+	pending map[reflect.Type]map[string]*txEntry
+}
+
+// Records a pending change for a given storable
+func (tx *memoryTx) record(t Storable, data []byte, deleted bool) error {
+	if !tx.storage.CanStore(t) {
 		return ErrUnregisteredStorable
 	}
 
-	ts := s.store[reflect.TypeOf(t)]
-	if ts != nil {
-		delete(ts, string(t.Key()))
+	typ := typeFromStorable(t)
+	if tx.pending[typ] == nil {
+		tx.pending[typ] = make(map[string]*txEntry)
 	}
+
+	tx.pending[typ][string(t.Key())] = &txEntry{data, deleted}
+
 	return nil
 }
 
-func (s *MemoryStorage) Ready() bool {
-	return s.store != nil
+func (tx *memoryTx) Get(t Storable) error {
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
+	if entry := tx.pending[typeFromStorable(t)][string(t.Key())]; entry != nil {
+		if entry.deleted {
+			return ErrNotFound
+		}
+		return t.Deserialize(append([]byte{}, entry.data...))
+	}
+
+	return tx.storage.Get(t)
 }
 
-func (s *MemoryStorage) CanStore(t Storable) bool {
-	return true
+func (tx *memoryTx) Put(t Storable) error {
+	if t == nil {
+		return ErrUnregisteredStorable
+	}
+
+	data, err := t.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return tx.record(t, append([]byte{}, data...), false)
+}
+
+func (tx *memoryTx) Delete(t Storable) error {
+	return tx.record(t, nil, true)
 }
 
+// Returns all records of the type of a given `Storable`, sorted by key
 func (s *MemoryStorage) Iterator(t Storable) (StorageIterator, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	m, err := s.getMap(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSliceIterator(m), nil
+}
+
+// Implementation of the `SnapshotStorage.Snapshot` interface method
+func (s *MemoryStorage) Snapshot() (StorageSnapshot, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	if s.store == nil {
 		return nil, ErrStorageClosed
 	}
 
-	if t == nil {
-		return nil, ErrUnregisteredStorable
+	snapshot := &memorySnapshot{make(map[reflect.Type]map[string][]byte)}
+	for t, m := range s.store {
+		snapshot.store[t] = make(map[string][]byte)
+		for key, val := range m {
+			// Values are never modified in place so there is no need to copy them
+			snapshot.store[t][key] = val
+		}
 	}
 
-	ts := s.store[reflect.TypeOf(t)]
-	if ts == nil {
+	return snapshot, nil
+}
+
+type memorySnapshot struct {
+	store map[reflect.Type]map[string][]byte
+}
+
+func (s *memorySnapshot) Iterator(t Storable) (StorageIterator, error) {
+	m := s.store[typeFromStorable(t)]
+	if m == nil {
 		return nil, ErrUnregisteredStorable
 	}
 
-	var sl [][]byte
-	for _, val := range ts {
-		sl = append(sl, val)
-	}
+	return newSliceIterator(m), nil
+}
 
-	return &SliceIterator{
-		s: sl,
-	}, nil
+func (s *memorySnapshot) Release() {
+	s.store = nil
 }
@@ -3,6 +3,14 @@ package padlockcloud
 import "testing"
 import "io/ioutil"
 import "os"
+import "path/filepath"
+import "fmt"
+import "strings"
+import "errors"
+import "reflect"
+import "sync"
+import "sort"
+import "github.com/syndtr/goleveldb/leveldb"
 
 type testStrbl string
 
@@ -19,19 +27,42 @@ func (m *testStrbl) Deserialize(data []byte) error {
 	return nil
 }
 
-func TestLevelDBStorage(t *testing.T) {
-	dir, err := ioutil.TempDir("", "")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(dir)
+// Storable type that never gets registered
+type testUnregisteredStrbl struct {
+	testStrbl
+}
 
-	storage := &LevelDBStorage{
-		Config: &LevelDBConfig{
-			Path: dir,
-		},
+// Storable type with variable keys, used for testing iteration
+type testKeyedStrbl struct {
+	Name  string
+	Value string
+}
+
+func (m *testKeyedStrbl) Key() []byte {
+	return []byte(m.Name)
+}
+
+func (m *testKeyedStrbl) Serialize() ([]byte, error) {
+	return []byte(m.Name + ":" + m.Value), nil
+}
+
+func (m *testKeyedStrbl) Deserialize(data []byte) error {
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid data: %s", data)
 	}
+	m.Name, m.Value = parts[0], parts[1]
+	return nil
+}
+
+func init() {
+	RegisterStorable(new(testStrbl), "mystrbl")
+	RegisterStorable(new(testKeyedStrbl), "mykeyedstrbl")
+}
 
+// Runs a common set of tests against a given `Storage` implementation. `storage` should not be opened yet
+// and should be empty once opened
+func testStorage(t *testing.T, storage Storage) {
 	var storable testStrbl = "All work and no joy makes jack a dull boy"
 
 	// Storage.Open() has not been called yet so we should get the appropriate error
@@ -39,22 +70,29 @@ func TestLevelDBStorage(t *testing.T) {
 		t.Fatalf("Should return error for closed storage, got %v", err)
 	}
 
-	// Let's open the storage very quickly even though we haven't registered any types yet so we can
-	// check for the ErrUnregisteredStorable error
-	storage.Open()
-	// Storage.Open() has not been called yet so we should get the appropriate error
-	if err := storage.Get(&storable); err != ErrUnregisteredStorable {
-		t.Fatalf("Should return error for unregistered storable type, got %v", err)
+	if storage.Ready() {
+		t.Fatal("Storage should not be ready before opening it")
 	}
-	storage.Close()
-
-	// No register the storable type
-	RegisterStorable(&storable, "mystrbl")
 
 	// Open storage now
-	storage.Open()
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
 	defer storage.Close()
 
+	if !storage.Ready() {
+		t.Fatal("Storage should be ready after opening it")
+	}
+
+	// Trying to load a type that was never registered should give us the appropriate error
+	if err := storage.Get(&testUnregisteredStrbl{}); err != ErrUnregisteredStorable {
+		t.Fatalf("Should return error for unregistered storable type, got %v", err)
+	}
+
+	if storage.CanStore(&testUnregisteredStrbl{}) || !storage.CanStore(&storable) {
+		t.Fatal("Storage should only be able to store registered types")
+	}
+
 	// Still haven't written anything to storage, so trying to get a specific instace should give us
 	// ErrNotFound
 	if err := storage.Get(&storable); err != ErrNotFound {
@@ -86,4 +124,390 @@ func TestLevelDBStorage(t *testing.T) {
 		t.Fatalf("Should get error not found, got %v", err)
 	}
 
+	// Write enough records to span multiple batches in batched iterators
+	n := 250
+	for i := 0; i < n; i++ {
+		if err := storage.Put(&testKeyedStrbl{fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter, err := storage.Iterator(&testKeyedStrbl{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for iter.Next() {
+		s := &testKeyedStrbl{}
+		if err := iter.Get(s); err != nil {
+			t.Fatal(err)
+		}
+		// Deleting while iterating should not interfere with the iteration
+		if err := storage.Delete(s); err != nil {
+			t.Fatal(err)
+		}
+		seen[s.Name] = true
+	}
+	iter.Release()
+
+	if len(seen) != n {
+		t.Fatalf("Expected to iterate over %d records, got %d", n, len(seen))
+	}
+
+	if err := storage.Get(&testKeyedStrbl{Name: "key001"}); err != ErrNotFound {
+		t.Fatalf("Should get error not found, got %v", err)
+	}
+
+	testStorageUpdate(t, storage)
+	testStorageIteration(t, storage)
+}
+
+// Tests ordering, seeking, prefix filtering and pagination for an opened, empty storage
+func testStorageIteration(t *testing.T, storage Storage) {
+	// Insert in reverse order to make sure records come back sorted
+	for i := 249; i >= 0; i-- {
+		prefix := "a"
+		if i%2 == 1 {
+			prefix = "b"
+		}
+		if err := storage.Put(&testKeyedStrbl{fmt.Sprintf("%s%03d", prefix, i), "value"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collect := func(iter StorageIterator) []string {
+		var keys []string
+		for iter.Next() {
+			s := &testKeyedStrbl{}
+			if err := iter.Get(s); err != nil {
+				t.Fatal(err)
+			}
+			if s.Name != string(iter.Key()) {
+				t.Fatalf("Expected key %s to match record %s", iter.Key(), s.Name)
+			}
+			keys = append(keys, s.Name)
+		}
+		iter.Release()
+		return keys
+	}
+
+	iter, err := storage.Iterator(&testKeyedStrbl{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := collect(iter)
+	if len(keys) != 250 || !sort.StringsAreSorted(keys) {
+		t.Fatalf("Expected 250 records in ascending order, got %d", len(keys))
+	}
+
+	// Seeking to a key that doesn't exist should start at the next one
+	iter, _ = storage.Iterator(&testKeyedStrbl{})
+	iter.Seek([]byte("b200"))
+	if keys := collect(iter); len(keys) != 25 || keys[0] != "b201" {
+		t.Fatalf("Expected 25 records starting with b201, got %d", len(keys))
+	}
+
+	iter, _ = storage.Iterator(&testKeyedStrbl{})
+	if keys := collect(NewPrefixIterator(iter, []byte("a"))); len(keys) != 125 || keys[124] != "a248" {
+		t.Fatalf("Expected 125 records with prefix a, got %d", len(keys))
+	}
+
+	// Page through records with prefix b, deleting records along the way
+	var paged []string
+	opts := &PageOptions{Prefix: []byte("b"), Limit: 40}
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Too many pages")
+		}
+
+		s := &testKeyedStrbl{}
+		next, err := IteratePage(storage, s, opts, func(key []byte) error {
+			if string(key) != s.Name {
+				return fmt.Errorf("Expected key %s to match record %s", key, s.Name)
+			}
+			paged = append(paged, s.Name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(paged) > 0 {
+			if err := storage.Delete(&testKeyedStrbl{Name: paged[len(paged)-1]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		opts.Token = next
+	}
+
+	if len(paged) != 125 || !sort.StringsAreSorted(paged) || paged[0] != "b001" {
+		t.Fatalf("Expected to page through 125 records with prefix b, got %d", len(paged))
+	}
+
+	if _, err := IteratePage(storage, &testKeyedStrbl{}, &PageOptions{Token: "not a token!"}, nil); err != ErrInvalidPageToken {
+		t.Fatalf("Expected invalid page token error, got %v", err)
+	}
+
+	iter, _ = storage.Iterator(&testKeyedStrbl{})
+	for iter.Next() {
+		if err := storage.Delete(&testKeyedStrbl{Name: string(iter.Key())}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter.Release()
+}
+
+// Tests transactions for an opened, empty storage
+func testStorageUpdate(t *testing.T, storage Storage) {
+	var storable testStrbl = "some value"
+	keyed := &testKeyedStrbl{"key", "value"}
+
+	// Changes should not be applied if the transaction fails
+	txErr := errors.New("transaction failed")
+	if err := storage.Update(func(tx StorageTx) error {
+		if err := tx.Put(&storable); err != nil {
+			return err
+		}
+		if err := tx.Put(keyed); err != nil {
+			return err
+		}
+		return txErr
+	}); err != txErr {
+		t.Fatalf("Expected transaction error to be returned, got %v", err)
+	}
+
+	if err := storage.Get(&storable); err != ErrNotFound {
+		t.Fatalf("Changes from failed transaction should not be applied, got %v", err)
+	}
+	if err := storage.Get(&testKeyedStrbl{Name: "key"}); err != ErrNotFound {
+		t.Fatalf("Changes from failed transaction should not be applied, got %v", err)
+	}
+
+	// Successful transactions should apply all changes. Changes should be visible within the transaction
+	if err := storage.Update(func(tx StorageTx) error {
+		if err := tx.Put(&storable); err != nil {
+			return err
+		}
+		if err := tx.Put(keyed); err != nil {
+			return err
+		}
+
+		var s testStrbl
+		if err := tx.Get(&s); err != nil || s != storable {
+			return fmt.Errorf("Expected pending change to be visible, got %v", err)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var s testStrbl
+	if err := storage.Get(&s); err != nil || s != storable {
+		t.Fatalf("Expected '%s', got '%s' (%v)", storable, s, err)
+	}
+	k := &testKeyedStrbl{Name: "key"}
+	if err := storage.Get(k); err != nil || k.Value != keyed.Value {
+		t.Fatalf("Expected '%s', got '%s' (%v)", keyed.Value, k.Value, err)
+	}
+
+	// Deleting multiple objects
+	if err := storage.Update(func(tx StorageTx) error {
+		if err := tx.Delete(&storable); err != nil {
+			return err
+		}
+		if err := tx.Delete(keyed); err != nil {
+			return err
+		}
+		if err := tx.Get(new(testStrbl)); err != ErrNotFound {
+			return fmt.Errorf("Expected pending deletion to be visible, got %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Get(&storable); err != ErrNotFound {
+		t.Fatalf("Should get error not found, got %v", err)
+	}
+	if err := storage.Get(&testKeyedStrbl{Name: "key"}); err != ErrNotFound {
+		t.Fatalf("Should get error not found, got %v", err)
+	}
+}
+
+func TestLevelDBStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testStorage(t, &LevelDBStorage{
+		Config: &LevelDBConfig{
+			Path: dir,
+		},
+	})
+}
+
+func TestLevelDBJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &LevelDBStorage{
+		Config: &LevelDBConfig{
+			Path: dir,
+		},
+	}
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a transaction that was interrupted after being written to the journal
+	b1 := &leveldb.Batch{}
+	b1.Put([]byte("somekey"), []byte("journaled"))
+	b2 := &leveldb.Batch{}
+	b2.Put([]byte("key"), []byte("key:journaled"))
+	if _, err := storage.writeJournal(map[reflect.Type]*leveldb.Batch{
+		typeFromStorable(new(testStrbl)):      b1,
+		typeFromStorable(new(testKeyedStrbl)): b2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.Close()
+
+	// Pending transactions should be applied when opening the storage
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	var s testStrbl
+	if err := storage.Get(&s); err != nil || s != "journaled" {
+		t.Fatalf("Expected journaled change to be applied, got '%s' (%v)", s, err)
+	}
+	k := &testKeyedStrbl{Name: "key"}
+	if err := storage.Get(k); err != nil || k.Value != "journaled" {
+		t.Fatalf("Expected journaled change to be applied, got '%s' (%v)", k.Value, err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, &MemoryStorage{})
+}
+
+func TestMemoryStorageConcurrency(t *testing.T) {
+	storage := &MemoryStorage{}
+	storage.Open()
+	defer storage.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s := &testKeyedStrbl{fmt.Sprintf("key%d-%d", i, j), "value"}
+				if err := storage.Put(s); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := storage.Update(func(tx StorageTx) error {
+					return tx.Delete(s)
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+				iter, err := storage.Iterator(s)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for iter.Next() {
+				}
+				iter.Release()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMemoryStorageSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &MemoryConfig{Snapshot: filepath.Join(dir, "fixtures.jsonl.gz")}
+	storage := &MemoryStorage{Config: config}
+
+	// A missing snapshot file is only acceptable if the storage is supposed to create it
+	if err := storage.Open(); !os.IsNotExist(err) {
+		t.Fatalf("Expected error for missing snapshot file, got %v", err)
+	}
+
+	config.Persist = true
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	acc := &Account{Email: "martin@padlock.io"}
+	if err := storage.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(&DataStore{Account: acc, Content: []byte("some data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes should not be written back unless configured
+	config.Persist = false
+	storage = &MemoryStorage{Config: config}
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := &DataStore{Account: acc}
+	if err := storage.Get(data); err != nil || string(data.Content) != "some data" {
+		t.Fatalf("Expected data store to be loaded from snapshot, got '%s' (%v)", data.Content, err)
+	}
+
+	if err := storage.Delete(acc); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	if err := storage.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Get(&Account{Email: acc.Email}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testStorage(t, &BoltStorage{
+		Config: &BoltConfig{
+			Path: filepath.Join(dir, "padlock.db"),
+		},
+	})
 }
@@ -18,6 +18,16 @@ type Templates struct {
 	ErrorPage              *t.Template
 	LoginPage              *t.Template
 	Dashboard              *t.Template
+	// Email template for inviting someone to a shared vault
+	VaultInviteEmail *t.Template
+	// Email template for notifying account owners about scheduled deletions
+	DeletionEmail *t.Template
+	// Email template for confirming the deletion of an account
+	DeleteAccountEmail *t.Template
+	// Page for entering a two-factor authentication code when logging in
+	TOTPPage *t.Template
+	// Page for confirming the deletion of an account
+	DeleteAccountPage *t.Template
 }
 
 func ExtendTemplate(base *t.Template, path string) (*t.Template, error) {
@@ -64,6 +74,21 @@ func LoadTemplates(tt *Templates, p string) error {
 	if tt.Dashboard, err = ExtendTemplate(tt.BasePage, fp.Join(p, "page/dashboard.html.tmpl")); err != nil {
 		return err
 	}
+	if tt.VaultInviteEmail, err = ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/vault-invite.txt.tmpl")); err != nil {
+		return err
+	}
+	if tt.DeletionEmail, err = ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/deletion.txt.tmpl")); err != nil {
+		return err
+	}
+	if tt.DeleteAccountEmail, err = ExtendTemplate(tt.BaseEmail, fp.Join(p, "email/delete-account.txt.tmpl")); err != nil {
+		return err
+	}
+	if tt.TOTPPage, err = ExtendTemplate(tt.BasePage, fp.Join(p, "page/totp.html.tmpl")); err != nil {
+		return err
+	}
+	if tt.DeleteAccountPage, err = ExtendTemplate(tt.BasePage, fp.Join(p, "page/delete-account.html.tmpl")); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -28,7 +28,12 @@ func TestLoadTemplates(t *testing.T) {
 		templates.DeprecatedVersionEmail == nil ||
 		templates.ErrorPage == nil ||
 		templates.LoginPage == nil ||
-		templates.Dashboard == nil {
+		templates.Dashboard == nil ||
+		templates.VaultInviteEmail == nil ||
+		templates.DeletionEmail == nil ||
+		templates.DeleteAccountEmail == nil ||
+		templates.TOTPPage == nil ||
+		templates.DeleteAccountPage == nil {
 		t.Fatal("All templates should be initialized and not nil")
 	}
 }
@@ -0,0 +1,288 @@
+package padlockcloud
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Issuer shown in authenticator apps
+const totpIssuer = "Padlock Cloud"
+
+// Number of digits of a TOTP code
+const totpDigits = 6
+
+// Duration each TOTP code is valid for
+var totpPeriod = 30 * time.Second
+
+// Number of periods before and after the current one for which codes are still accepted, to allow for
+// clock drift between server and authenticator
+var totpSkew int64 = 1
+
+// Number of recovery codes generated when enabling two-factor authentication
+var recoveryCodeCount = 10
+
+// Number of consecutive failed attempts at entering a TOTP code after which the account is locked
+// temporarily
+var maxTOTPAttempts = 5
+
+// Duration two-factor authentication is locked for after `maxTOTPAttempts` failed attempts. Doubles with
+// each further failed attempt, up to `maxTOTPLockout`
+var totpLockout = time.Minute
+var maxTOTPLockout = 24 * time.Hour
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP holds the settings for two-factor authentication via time-based one-time passwords (RFC 6238)
+// for an account
+type TOTP struct {
+	// Base32-encoded secret shared with the authenticator app
+	Secret string `yaml:"-"`
+	// Whether the account owner confirmed the enrollment with a valid code. Until then, no code is required
+	// for logging in
+	Enabled bool `yaml:"enabled"`
+	// Whether a code is also required for pairing new devices, in addition to logging into the dashboard
+	RequireForApi bool `yaml:"require_for_api"`
+	// SHA-256 hashes of the recovery codes that haven't been used yet
+	RecoveryCodes []string `yaml:"-"`
+	// Time period of the most recently accepted code. Codes can't be used more than once
+	LastPeriod int64 `yaml:"-"`
+	// Time two-factor authentication was enabled
+	EnabledAt time.Time `yaml:"enabled_at"`
+	// Number of consecutive invalid codes entered for this account
+	FailedAttempts int `yaml:"failed_attempts"`
+	// No codes are accepted until this time after too many failed attempts
+	LockedUntil time.Time `yaml:"locked_until"`
+}
+
+// Creates a new TOTP configuration with a random secret. Two-factor authentication is only enabled once
+// the enrollment is confirmed with a valid code, see `TOTP.Enable`
+func NewTOTP() (*TOTP, error) {
+	secret, err := randomBytes(20)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTP{Secret: totpEncoding.EncodeToString(secret)}, nil
+}
+
+// Returns the `otpauth://` uri for adding the secret to an authenticator app, usually presented as
+// a QR code
+func (t *TOTP) ProvisioningURI(email string) string {
+	u := &url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + email,
+	}
+
+	u.RawQuery = url.Values{
+		"secret":    {t.Secret},
+		"issuer":    {totpIssuer},
+		"digits":    {fmt.Sprintf("%d", totpDigits)},
+		"period":    {fmt.Sprintf("%d", totpPeriod/time.Second)},
+		"algorithm": {"SHA1"},
+	}.Encode()
+
+	return u.String()
+}
+
+// Computes the code for the given secret and time period as described in RFC 4226 and RFC 6238
+func totpCode(key []byte, period int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(period))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, bin%mod)
+}
+
+// Returns the code for the time period `now` falls into
+func (t *TOTP) Code(now time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(t.Secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, now.Unix()/int64(totpPeriod/time.Second)), nil
+}
+
+// Checks a code against the codes for the periods around `now`. Codes for periods up to and including
+// the one of the last accepted code are rejected, so each code can only be used once
+func (t *TOTP) Verify(code string, now time.Time) bool {
+	key, err := totpEncoding.DecodeString(t.Secret)
+	if err != nil {
+		return false
+	}
+
+	code = strings.TrimSpace(code)
+	current := now.Unix() / int64(totpPeriod/time.Second)
+
+	for p := current - totpSkew; p <= current+totpSkew; p++ {
+		if p <= t.LastPeriod {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, p)), []byte(code)) == 1 {
+			t.LastPeriod = p
+			return true
+		}
+	}
+
+	return false
+}
+
+// Confirms the enrollment with a code from the authenticator app, enabling two-factor authentication.
+// Fails with an `InvalidTOTPCode` error if the code is invalid. Returns the generated recovery codes
+func (t *TOTP) Enable(code string, requireForApi bool) ([]string, error) {
+	if !t.Verify(code, time.Now()) {
+		return nil, &InvalidTOTPCode{}
+	}
+
+	codes, err := t.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	t.Enabled = true
+	t.RequireForApi = requireForApi
+	t.EnabledAt = time.Now()
+
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replaces all recovery codes with new ones. Only the hashes are kept, so the returned codes need to be
+// shown to the account owner right away
+func (t *TOTP) GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	t.RecoveryCodes = hashes
+
+	return codes, nil
+}
+
+// Checks a recovery code, removing it if it is valid so it can't be used again
+func (t *TOTP) UseRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+	for i, h := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Checks a code entered by the account owner, which may either be a TOTP code or one of the recovery codes
+func (t *TOTP) Check(code string) bool {
+	return t.Verify(code, time.Now()) || t.UseRecoveryCode(code)
+}
+
+// Checks a code like `Check`, while limiting the number of consecutive failed attempts. After
+// `maxTOTPAttempts` invalid codes, all codes are rejected with a `TOTPLocked` error for `totpLockout`,
+// doubling with each further invalid code. Fails with an `InvalidTOTPCode` error if the code is invalid.
+// The changed counter needs to be persisted whether or not the code is valid
+func (t *TOTP) Attempt(code string, now time.Time) error {
+	if now.Before(t.LockedUntil) {
+		return &TOTPLocked{t.LockedUntil}
+	}
+
+	if t.Check(code) {
+		t.FailedAttempts = 0
+		t.LockedUntil = time.Time{}
+		return nil
+	}
+
+	t.FailedAttempts++
+
+	if n := t.FailedAttempts - maxTOTPAttempts; n >= 0 {
+		lockout := maxTOTPLockout
+		if n < 32 && totpLockout<<uint(n) < maxTOTPLockout {
+			lockout = totpLockout << uint(n)
+		}
+		t.LockedUntil = now.Add(lockout)
+	}
+
+	return &InvalidTOTPCode{}
+}
+
+func (t *TOTP) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":       t.Enabled,
+		"requireForApi": t.RequireForApi,
+		"recoveryCodes": len(t.RecoveryCodes),
+	}
+}
+
+// Returns true if a TOTP code is required for activating auth tokens of the given type
+func (acc *Account) RequiresTOTP(tType string) bool {
+	return acc.TOTP != nil && acc.TOTP.Enabled && (tType == "web" || acc.TOTP.RequireForApi)
+}
+
+// Checks a TOTP or recovery code entered for logging into the account with the given email, persisting
+// the changes to the accounts TOTP settings, i.e. the last used period, the consumed recovery code or
+// the number of failed attempts. Fails with a `TOTPRequired` error if no code is provided, with an
+// `InvalidTOTPCode` error if the code is invalid and with a `TOTPLocked` error after too many invalid codes
+func VerifyTOTP(storage Storage, email string, code string) error {
+	if code == "" {
+		return &TOTPRequired{}
+	}
+
+	var result error
+
+	if err := storage.Update(func(tx StorageTx) error {
+		acc := &Account{Email: email}
+		if err := tx.Get(acc); err != nil {
+			return err
+		}
+
+		if acc.TOTP == nil || !acc.TOTP.Enabled {
+			return nil
+		}
+
+		// Failed attempts are counted in the same transaction, so concurrent requests can't get
+		// around the limit
+		result = acc.TOTP.Attempt(code, time.Now())
+		if _, ok := result.(*TOTPLocked); ok {
+			return nil
+		}
+
+		return tx.Put(acc)
+	}); err != nil {
+		return err
+	}
+
+	return result
+}
@@ -0,0 +1,117 @@
+package padlockcloud
+
+import "testing"
+import "time"
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, truncated to 6 digits
+	totp := &TOTP{Secret: totpEncoding.EncodeToString([]byte("12345678901234567890"))}
+
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if code, err := totp.Code(time.Unix(unix, 0)); err != nil || code != expected {
+			t.Fatalf("Expected code %s for time %d, got %s (%v)", expected, unix, code, err)
+		}
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	totp, err := NewTOTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	code, _ := totp.Code(now)
+	next, _ := totp.Code(now.Add(totpPeriod))
+	late, _ := totp.Code(now.Add(-3 * totpPeriod))
+
+	if totp.Verify(late, now) {
+		t.Fatal("Codes outside the allowed clock drift should be rejected")
+	}
+
+	if !totp.Verify(code, now) {
+		t.Fatal("Current code should be accepted")
+	}
+
+	if totp.Verify(code, now) {
+		t.Fatal("Codes should only be accepted once")
+	}
+
+	if !totp.Verify(next, now) {
+		t.Fatal("Code for the next period should be accepted")
+	}
+
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != recoveryCodeCount || len(totp.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	if totp.RecoveryCodes[0] == codes[0] {
+		t.Fatal("Recovery codes should not be stored in plain text")
+	}
+
+	if !totp.Check(codes[3]) || totp.Check(codes[3]) {
+		t.Fatal("Recovery codes should be accepted exactly once")
+	}
+
+	if len(totp.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Fatal("Used recovery codes should be removed")
+	}
+}
+
+func TestTOTPAttempt(t *testing.T) {
+	totp, err := NewTOTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	for i := 1; i < maxTOTPAttempts; i++ {
+		if _, ok := totp.Attempt("invalid", now).(*InvalidTOTPCode); !ok || !totp.LockedUntil.IsZero() {
+			t.Fatalf("Expected attempt %d to fail without locking", i)
+		}
+	}
+
+	if _, ok := totp.Attempt("invalid", now).(*InvalidTOTPCode); !ok || !totp.LockedUntil.Equal(now.Add(totpLockout)) {
+		t.Fatalf("Expected lockout of %v after %d failed attempts, got %v", totpLockout, maxTOTPAttempts, totp.LockedUntil)
+	}
+
+	if _, ok := totp.Attempt(codes[0], now).(*TOTPLocked); !ok || len(totp.RecoveryCodes) != recoveryCodeCount {
+		t.Fatal("Codes should not be checked while locked")
+	}
+
+	// Each further failed attempt doubles the lockout
+	now = totp.LockedUntil
+	totp.Attempt("invalid", now)
+	if !totp.LockedUntil.Equal(now.Add(2 * totpLockout)) {
+		t.Fatalf("Expected lockout of %v, got %v", 2*totpLockout, totp.LockedUntil.Sub(now))
+	}
+
+	// But never exceeds the maximum
+	totp.FailedAttempts = 100
+	now = totp.LockedUntil
+	totp.Attempt("invalid", now)
+	if !totp.LockedUntil.Equal(now.Add(maxTOTPLockout)) {
+		t.Fatalf("Expected lockout of %v, got %v", maxTOTPLockout, totp.LockedUntil.Sub(now))
+	}
+
+	now = totp.LockedUntil
+	if err := totp.Attempt(codes[0], now); err != nil || totp.FailedAttempts != 0 || !totp.LockedUntil.IsZero() {
+		t.Fatalf("Expected valid code to reset failed attempts, got %v (%d)", err, totp.FailedAttempts)
+	}
+}
@@ -0,0 +1,223 @@
+package padlockcloud
+
+import "regexp"
+import "strings"
+
+// Name under which the default vault of an account is listed. The default vault is kept at the
+// original location of the data store, so clients that don't know about vaults keep working
+const DefaultVault = "default"
+
+var vaultNamePattern = regexp.MustCompile("^[a-z0-9][a-z0-9_-]{0,63}$")
+
+// Returns true if `name` can be used as the name of a vault. Names are made up of lower case letters,
+// digits, dashes and underscores. "history" is reserved since it clashes with the history endpoint
+func ValidVaultName(name string) bool {
+	return vaultNamePattern.MatchString(name) && name != "history"
+}
+
+// Returns the key of the data store or history of a vault. The default vault uses the email of the
+// account while other vaults append their name, separated by a slash. Since the domain part of an
+// email address can't contain slashes, keys of different accounts never clash
+func vaultKey(email string, vault string) []byte {
+	if vault == "" || vault == DefaultVault {
+		return []byte(email)
+	}
+	return []byte(email + "/" + vault)
+}
+
+// Splits the key of a data store or history into the email of the account and the name of the vault,
+// which is empty for the default vault
+func splitVaultKey(key []byte) (string, string) {
+	s := string(key)
+	if i := strings.LastIndex(s, "/"); i > strings.LastIndex(s, "@") {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// Extracts the owner and name of a vault from request paths like `/store/work/`, where `prefix` is the path
+// of the endpoint. Vaults shared by other accounts are addressed by prefixing the name with the email of
+// their owner, e.g. `/store/owner@example.com/work/`. Returns an empty owner for the accounts own vaults
+// and an empty name for the default vault
+func vaultFromPath(path string, prefix string) (string, string, error) {
+	name := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+
+	owner := ""
+	if i := strings.Index(name, "/"); i != -1 && strings.Contains(name[:i], "@") {
+		owner, name = name[:i], name[i+1:]
+	}
+
+	switch {
+	case owner == "" && (name == "" || name == DefaultVault):
+		return "", "", nil
+	case strings.Contains(name, "/"):
+		return "", "", &UnsupportedEndpoint{path}
+	case !ValidVaultName(name) || name == DefaultVault:
+		return "", "", &VaultNotFound{name}
+	default:
+		return owner, name, nil
+	}
+}
+
+// Summary of a single vault
+type Vault struct {
+	Name string
+	// Email of the account owning the vault
+	Owner string
+	// Access the listing account has to the vault, i.e. `VaultRoleOwner` for its own vaults
+	Role string
+	// Size of the current content in bytes
+	Size int64
+	// Identifier of the current revision
+	Revision string
+}
+
+func newVault(data *DataStore) *Vault {
+	name := data.Vault
+	if name == "" {
+		name = DefaultVault
+	}
+
+	return &Vault{
+		Name:     name,
+		Owner:    data.Account.Email,
+		Role:     VaultRoleOwner,
+		Size:     int64(len(data.Content)),
+		Revision: data.Revision(),
+	}
+}
+
+func (v *Vault) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"name":     v.Name,
+		"owner":    v.Owner,
+		"role":     v.Role,
+		"size":     v.Size,
+		"revision": v.Revision,
+	}
+}
+
+// Lists all vaults of an account, ordered by name. The default vault is always listed first, even if
+// nothing has been written to it yet
+func GetVaults(storage Storage, acc *Account) ([]*Vault, error) {
+	def := &DataStore{Account: acc}
+	if err := storage.Get(def); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	vaults := []*Vault{newVault(def)}
+
+	iter, err := storage.Iterator(&DataStore{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Release()
+
+	named := NewPrefixIterator(iter, []byte(acc.Email+"/"))
+	for named.Next() {
+		_, name := splitVaultKey(named.Key())
+		data := &DataStore{Account: acc, Vault: name}
+		if err := named.Get(data); err != nil {
+			return nil, err
+		}
+		vaults = append(vaults, newVault(data))
+	}
+
+	return vaults, nil
+}
+
+// Creates a new, empty vault. Fails with a `VaultExists` error if a vault with the same name exists, with
+// a `TooManyVaults` error if the account already has `maxVaults` vaults (including the default vault) and
+// with a `StoreQuotaExceeded` error if the storage used by the account already exceeds `quota` bytes.
+// A value of 0 means there is no limit for either
+func CreateVault(storage Storage, acc *Account, name string, quota int64, maxVaults int) error {
+	if name == "" || name == DefaultVault {
+		return &VaultExists{DefaultVault}
+	}
+
+	vaults, err := vaultNames(storage, acc)
+	if err != nil {
+		return err
+	}
+
+	return storage.Update(func(tx StorageTx) error {
+		data := &DataStore{Account: acc, Vault: name}
+		if err := tx.Get(data); err == nil {
+			return &VaultExists{name}
+		} else if err != ErrNotFound {
+			return err
+		}
+
+		if maxVaults > 0 && len(vaults) >= maxVaults {
+			return &TooManyVaults{maxVaults}
+		}
+
+		if err := checkStoreQuota(tx, acc, vaults, quota); err != nil {
+			return err
+		}
+
+		return tx.Put(data)
+	})
+}
+
+// Deletes a vault along with its history, change log and sharing settings. Fails with a `VaultNotFound` error if no vault with the given
+// name exists. Since the default vault always exists, deleting it only removes its content and history
+func DeleteVault(storage Storage, acc *Account, name string) error {
+	if name == "" || name == DefaultVault {
+		return storage.Update(func(tx StorageTx) error {
+			if err := tx.Delete(&DataStore{Account: acc}); err != nil {
+				return err
+			}
+			// Otherwise the deleted content could still be restored
+			if err := tx.Delete(&StoreHistory{Account: acc}); err != nil {
+				return err
+			}
+			if err := tx.Delete(&PendingDeletion{Email: acc.Email, Vault: DefaultVault}); err != nil {
+				return err
+			}
+			return clearChangeLog(tx, &ChangeLog{Account: acc})
+		})
+	}
+
+	return storage.Update(func(tx StorageTx) error {
+		data := &DataStore{Account: acc, Vault: name}
+		if err := tx.Get(data); err == ErrNotFound {
+			return &VaultNotFound{name}
+		} else if err != nil {
+			return err
+		}
+
+		if err := tx.Delete(data); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&SharedVault{Owner: acc.Email, Vault: name}); err != nil {
+			return err
+		}
+
+		// Keep the sequence number of the change log, so it continues where it left off if a vault with the
+		// same name is created later on
+		if err := clearChangeLog(tx, &ChangeLog{Account: acc, Vault: name}); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&PendingDeletion{Email: acc.Email, Vault: name}); err != nil {
+			return err
+		}
+
+		return tx.Delete(&StoreHistory{Account: acc, Vault: name})
+	})
+}
+
+// Returns an error if a vault does not exist. The default vault always exists
+func checkVaultExists(storage Storage, acc *Account, name string) error {
+	if name == "" || name == DefaultVault {
+		return nil
+	}
+
+	if err := storage.Get(&DataStore{Account: acc, Vault: name}); err == ErrNotFound {
+		return &VaultNotFound{name}
+	} else {
+		return err
+	}
+}